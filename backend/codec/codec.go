@@ -0,0 +1,52 @@
+// Package codec encodes values stored in redis as JSON, optionally gzipped.
+//
+// Compressed payloads start with a version byte that never begins a JSON
+// document, so values written before compression was enabled still decode.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// gzipVersion marks a gzip-compressed JSON payload.
+const gzipVersion byte = 0x01
+
+// Marshal encodes v as JSON and gzips it when compress is set.
+func Marshal(v any, compress bool) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || !compress {
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(gzipVersion)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a payload written by Marshal, compressed or not, into v.
+func Unmarshal(data []byte, v any) error {
+	if len(data) > 0 && data[0] == gzipVersion {
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return fmt.Errorf("codec: %w", err)
+		}
+		defer zr.Close()
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			return fmt.Errorf("codec: %w", err)
+		}
+		data = raw
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,56 @@
+package codec
+
+import (
+	"strings"
+	"testing"
+)
+
+type payload struct {
+	ID     string   `json:"id"`
+	Tweets []string `json:"tweets"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := payload{ID: "u1", Tweets: []string{strings.Repeat("hello world ", 50), "🌲 hiking"}}
+
+	for _, compress := range []bool{false, true} {
+		data, err := Marshal(in, compress)
+		if err != nil {
+			t.Fatalf("compress=%t: marshal: %v", compress, err)
+		}
+		if compress != (data[0] == gzipVersion) {
+			t.Errorf("compress=%t: unexpected leading byte %#x", compress, data[0])
+		}
+
+		var out payload
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatalf("compress=%t: unmarshal: %v", compress, err)
+		}
+		if out.ID != in.ID || len(out.Tweets) != 2 || out.Tweets[1] != in.Tweets[1] {
+			t.Errorf("compress=%t: round trip mismatch: %+v", compress, out)
+		}
+	}
+
+	plain, _ := Marshal(in, false)
+	packed, _ := Marshal(in, true)
+	if len(packed) >= len(plain) {
+		t.Errorf("expected compressed payload to be smaller (%d >= %d)", len(packed), len(plain))
+	}
+}
+
+func TestUnmarshalLegacyJSON(t *testing.T) {
+	var out payload
+	if err := Unmarshal([]byte(`{"id":"legacy","tweets":["a"]}`), &out); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if out.ID != "legacy" {
+		t.Errorf("expected legacy value to decode, got %+v", out)
+	}
+}
+
+func TestUnmarshalCorrupt(t *testing.T) {
+	var out payload
+	if err := Unmarshal([]byte{gzipVersion, 'n', 'o', 'p', 'e'}, &out); err == nil {
+		t.Error("expected an error for a corrupt compressed payload")
+	}
+}
@@ -1,24 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"glowmeet/blobstore"
+	"glowmeet/codec"
 	"glowmeet/matching"
+	"glowmeet/redisguard"
 	"glowmeet/xai"
+	"html"
 	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -30,11 +46,15 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// version is the build version, set with -ldflags "-X main.version=...".
+var version = "dev"
+
 type Config struct {
-	Port          string
-	ClientID      string
-	ClientSecret  string
-	RedirectURL   string
+	Port         string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// AllowedOrigin is CORS_ORIGIN: "*" or a comma-separated list of origins.
 	AllowedOrigin string
 	FrontendURL   string
 	JWTSecret     string
@@ -45,10 +65,246 @@ type Config struct {
 	RedisPassword string
 	RedisDB       int
 	RedisTLS      bool
+	// RedisReadAddr is an optional replica that serves read-only lookups.
+	RedisReadAddr string
+	// RedisCompress gzips user and match JSON stored in redis.
+	RedisCompress bool
+	// RedisScanLimit caps how many user keys one scan of the store reads.
+	RedisScanLimit int
+	Scopes         []string
+	// OAuthStateTTL is how long a login may take between /auth/x/login and
+	// the callback before its state is rejected.
+	OAuthStateTTL time.Duration
+	// IdempotencyTTL is how long a write's response is replayed for retries
+	// carrying the same Idempotency-Key. 0 disables replay.
+	IdempotencyTTL time.Duration
+	// RequestTimeout bounds each /api and /auth request; expiry returns 503.
+	RequestTimeout time.Duration
+	// ShutdownTimeout bounds a graceful shutdown: finishing in-flight
+	// requests and draining queued matching jobs to storage.
+	ShutdownTimeout time.Duration
+	// MaxBodyBytes caps /api request bodies; larger ones get 413.
+	MaxBodyBytes int64
+	// CompressMinBytes is the smallest /api response gzipped for clients
+	// that accept it; negative disables compression.
+	CompressMinBytes int
+	// RedirectHosts are the hosts absolute post-login redirects may point at.
+	RedirectHosts []string
+	// XAPIBaseURL is the X API origin, overridable for tests.
+	XAPIBaseURL string
+	// XAuthURL and XTokenURL are the OAuth endpoints, overridable for tests.
+	XAuthURL  string
+	XTokenURL string
+	// TweetRefreshInterval is the minimum time between tweet fetches per user.
+	TweetRefreshInterval time.Duration
+	// TweetFetchMax is how many tweets a fetch may gather, paging as needed.
+	TweetFetchMax int
+	// ProfileTweetLimit is how many cached tweets /api/me and
+	// /api/users/{id} embed unless ?tweets= asks for a different number.
+	ProfileTweetLimit int
+	// SeedUsers and SeedMatches are glob patterns for the seed data loaded
+	// at startup; every matching file is loaded, in lexical order.
+	SeedUsers   string
+	SeedMatches string
+	// TweetCacheMaxUsers bounds how many users' tweets are kept in memory,
+	// evicting the least recently fetched; 0 means no bound.
+	TweetCacheMaxUsers int
+	// TweetLanguages limits analyzed tweets to these X lang codes; empty keeps all.
+	TweetLanguages []string
+	// GenerateAvatars toggles the grok-imagine avatar step of profile analysis.
+	GenerateAvatars bool
+	// EnrichBios writes a short bio, with sources, for users who only have
+	// the placeholder description, using the responses API with X search.
+	EnrichBios bool
+	// AvatarStorage is where generated avatars are kept: "" leaves them at
+	// xAI's temporary URL, "s3" copies them to AvatarS3.
+	AvatarStorage string
+	AvatarS3      blobstore.S3Config
+	// Session cookie attributes. SameSite=None requires Secure.
+	CookieName     string
+	CookieSameSite http.SameSite
+	CookieDomain   string
+	// List sizing for paginated endpoints; user-supplied limits are clamped to MaxPageSize.
+	DefaultPageSize int
+	MaxPageSize     int
+	// AdminIDs are X user ids allowed to call /api/admin endpoints.
+	AdminIDs []string
+	// MatchRequireLocation skips matching for users without a location.
+	MatchRequireLocation bool
+	// GeoLatHeader and GeoLongHeader name CDN-injected request headers with
+	// the client's approximate coordinates. When both are set, /api/me
+	// stores them for users who haven't shared a location.
+	GeoLatHeader  string
+	GeoLongHeader string
+	// MatchOnEmpty is what /api/users does for a viewer with no matches yet:
+	// "fallback" lists top users unranked, "compute" queues matching against
+	// the top candidates and answers 202 with X-Matches-Computing set. compute
+	// falls back as well when matching is disabled or the results haven't
+	// arrived within quickMatchWindow.
+	MatchOnEmpty string
+	// InactiveAfter drops users whose last login is older than this from
+	// /api/users; 0 disables the filter.
+	InactiveAfter time.Duration
+	// ReportHideThreshold hides a user from matching once this many distinct
+	// users have reported them. 0 disables hiding.
+	ReportHideThreshold int
+	// MatchSampling picks candidates per viewer: all, top, nearest, random
+	// or overlap.
+	MatchSampling string
+	// MatchSampleSize is how many candidates a sampling strategy keeps.
+	MatchSampleSize int
+	// MatchStrongScore and MatchMinScore split match scores into tiers:
+	// strong at or above MatchStrongScore, moderate at or above
+	// MatchMinScore, weak below it. Weak matches are left out of
+	// /api/users unless asked for.
+	MatchStrongScore float64
+	MatchMinScore    float64
+	// MatchViewerRole and MatchCandidateRole switch matching to role-aware
+	// prompts (e.g. mentee/mentor), scoring each direction separately. Both
+	// empty keeps the symmetric prompt.
+	MatchViewerRole    string
+	MatchCandidateRole string
+	// XAIMaxConcurrency caps in-flight xAI requests; 0 means no cap.
+	XAIMaxConcurrency int
+	// XAIAnalysisMaxTokens and MatchMaxTokens cap the completion length of
+	// profile analysis and match calls; 0 means no cap.
+	XAIAnalysisMaxTokens int
+	MatchMaxTokens       int
+	// AnalysisPromptTweets and MatchPromptTweets are how many tweets per
+	// user the analysis and match prompts include; 0 means the default.
+	AnalysisPromptTweets int
+	MatchPromptTweets    int
+	// MatchRetryAttempts and MatchRetryBackoff bound how matching workers
+	// retry transient AI failures; the backoff doubles per attempt.
+	MatchRetryAttempts int
+	MatchRetryBackoff  time.Duration
+	// Flags are the matching feature flags, set by FLAG_* variables.
+	Flags matching.Flags
+	// UnknownFlags are FLAG_* variables that name no flag, likely typos.
+	UnknownFlags []string
+	// XAIPrecheck pings the xAI API at startup to surface a bad key early.
+	XAIPrecheck bool
+	// XAITraceHeader is the header xAI requests carry the request id in, for
+	// matching our logs with xAI's; empty disables it.
+	XAITraceHeader string
+	// XAIUserAgent is the User-Agent sent to xAI, so our traffic can be
+	// told apart in provider dashboards.
+	XAIUserAgent string
+	// XAIDefaultModel is the chat model for analysis, matching and any xAI
+	// request that doesn't pick one.
+	XAIDefaultModel string
+	// AvatarPromptTemplate is the image prompt; %s is replaced by the summary.
+	AvatarPromptTemplate string
+	// AnalysisPromptTemplate is the summary/score prompt; {interests} and
+	// {tweets} are replaced by the interests and tweet context.
+	AnalysisPromptTemplate string
+}
+
+type xScope string
+
+// OAuth 2.0 scopes understood by X. Only the first three are requested by default.
+const (
+	scopeTweetRead     xScope = "tweet.read"
+	scopeUsersRead     xScope = "users.read"
+	scopeOfflineAccess xScope = "offline.access"
+	scopeTweetWrite    xScope = "tweet.write"
+	scopeTweetModerate xScope = "tweet.moderate.write"
+	scopeFollowsRead   xScope = "follows.read"
+	scopeFollowsWrite  xScope = "follows.write"
+	scopeSpaceRead     xScope = "space.read"
+	scopeMuteRead      xScope = "mute.read"
+	scopeMuteWrite     xScope = "mute.write"
+	scopeLikeRead      xScope = "like.read"
+	scopeLikeWrite     xScope = "like.write"
+	scopeListRead      xScope = "list.read"
+	scopeListWrite     xScope = "list.write"
+	scopeBlockRead     xScope = "block.read"
+	scopeBlockWrite    xScope = "block.write"
+	scopeBookmarkRead  xScope = "bookmark.read"
+	scopeBookmarkWrite xScope = "bookmark.write"
+	scopeDMRead        xScope = "dm.read"
+	scopeDMWrite       xScope = "dm.write"
+	scopeMediaWrite    xScope = "media.write"
+)
+
+var defaultXScopes = []xScope{scopeTweetRead, scopeUsersRead, scopeOfflineAccess}
+
+// xScopes lists every scope above once; knownXScopes is built from it.
+var xScopes = []xScope{
+	scopeTweetRead,
+	scopeUsersRead,
+	scopeOfflineAccess,
+	scopeTweetWrite,
+	scopeTweetModerate,
+	scopeFollowsRead,
+	scopeFollowsWrite,
+	scopeSpaceRead,
+	scopeMuteRead,
+	scopeMuteWrite,
+	scopeLikeRead,
+	scopeLikeWrite,
+	scopeListRead,
+	scopeListWrite,
+	scopeBlockRead,
+	scopeBlockWrite,
+	scopeBookmarkRead,
+	scopeBookmarkWrite,
+	scopeDMRead,
+	scopeDMWrite,
+	scopeMediaWrite,
+}
+
+// knownXScopes indexes xScopes for parseScopes.
+var knownXScopes = scopeSet(xScopes)
+
+func scopeSet(scopes []xScope) map[xScope]bool {
+	set := make(map[xScope]bool, len(scopes))
+	for _, sc := range scopes {
+		set[sc] = true
+	}
+	return set
+}
+
+// parseScopes splits a space-separated X_SCOPES value, dropping duplicates.
+// An empty value yields the default set. Unknown scopes are kept but logged,
+// as is leaving out a scope the login flow relies on.
+func parseScopes(raw string) []string {
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		out := make([]string, 0, len(defaultXScopes))
+		for _, sc := range defaultXScopes {
+			out = append(out, string(sc))
+		}
+		return out
+	}
+
+	seen := make(map[string]bool)
+	out := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		if !knownXScopes[xScope(f)] {
+			log.Printf("warning: unknown X scope %q in X_SCOPES", f)
+		}
+		out = append(out, f)
+	}
+
+	for _, required := range []xScope{scopeTweetRead, scopeUsersRead} {
+		if !seen[string(required)] {
+			log.Printf("warning: X_SCOPES is missing %q; profile or tweet fetches will fail", required)
+		}
+	}
+	if !seen[string(scopeOfflineAccess)] {
+		log.Printf("X_SCOPES omits %q; X will not issue refresh tokens", scopeOfflineAccess)
+	}
+	return out
 }
 
 type stateEntry struct {
 	verifier  string
+	returnTo  string
 	expiresAt time.Time
 }
 
@@ -56,16 +312,33 @@ type stateStore struct {
 	mu     sync.Mutex
 	ttl    time.Duration
 	values map[string]stateEntry
+	// done stops the background sweeper.
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 type server struct {
-	config  *Config
-	oauth   *oauth2.Config
-	states  *stateStore
-	users   UserStore
-	tokens  tokenStore
-	tweets  *tweetStore
-	matcher *matching.Service
+	config      *Config
+	oauth       *oauth2.Config
+	states      *stateStore
+	users       UserStore
+	tokens      tokenStore
+	tweets      *tweetStore
+	matcher     *matching.Service
+	aiClient    xai.ChatCompleter
+	images      xai.ImageGenerator
+	responses   xai.ResponseGenerator
+	avatars     blobstore.Blobstore
+	suggestions *suggestionCache
+	recompute   *rateLimiter
+	pairRefresh *rateLimiter
+	reports     *rateLimiter
+	// quickMatches limits how often an empty /api/users queues matching and
+	// remembers when it last did.
+	quickMatches *rateLimiter
+	deleted      tombstoneStore
+	// idempotency keeps keyed write responses for replay; nil disables it.
+	idempotency idempotencyStore
 }
 
 func main() {
@@ -75,108 +348,536 @@ func main() {
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
+	cfg.logSummary()
 
 	srv := newServer(cfg)
+	if cfg.XAIPrecheck {
+		srv.precheckXAI()
+	}
 
 	addr := fmt.Sprintf(":%s", cfg.Port)
 	log.Printf("starting GlowMeet auth server on %s (redirect_url=%s, cors_origin=%s, frontend_url=%s, persistence=%s)", addr, cfg.RedirectURL, cfg.AllowedOrigin, cfg.FrontendURL, cfg.Persistence)
-	if err := http.ListenAndServe(addr, srv.routes()); err != nil {
-		log.Fatalf("server error: %v", err)
+	httpServer := &http.Server{Addr: addr, Handler: srv.routes()}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+	<-ctx.Done()
+
+	log.Printf("shutting down (timeout %s)", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	if err := srv.shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
+
+// shutdown stops background work once the HTTP server has stopped taking
+// requests. Queued matching jobs are drained so their results reach storage
+// instead of being lost with the process.
+func (s *server) shutdown(ctx context.Context) error {
+	s.states.stop()
+	if st, ok := s.idempotency.(*memoryIdempotencyStore); ok {
+		st.stop()
 	}
+	return s.matcher.Shutdown(ctx)
 }
 
 func loadConfig() (*Config, error) {
 	cfg := &Config{
-		Port:          getEnv("PORT", "8000"),
-		ClientID:      os.Getenv("X_CLIENT_ID"),
-		ClientSecret:  os.Getenv("X_CLIENT_SECRET"),
-		RedirectURL:   os.Getenv("X_REDIRECT_URL"),
-		AllowedOrigin: getEnv("CORS_ORIGIN", "*"),
-		FrontendURL:   getEnv("FRONTEND_URL", "/"),
-		JWTSecret:     os.Getenv("APP_JWT_SECRET"),
-		JWTTTL:        getEnvDuration("APP_JWT_TTL", 24*time.Hour),
-		XAiAPIKey:     os.Getenv("XAI_API_KEY"),
-		Persistence:   getEnv("PERSISTENCE", "memory"),
-		RedisAddr:     getEnv("REDIS_ADDR", ""),
-		RedisPassword: os.Getenv("REDIS_PASSWORD"),
-		RedisDB:       getEnvInt("REDIS_DB", 0),
-		RedisTLS:      getEnvBool("REDIS_TLS", false),
+		Port:             getEnv("PORT", "8000"),
+		ClientID:         os.Getenv("X_CLIENT_ID"),
+		ClientSecret:     os.Getenv("X_CLIENT_SECRET"),
+		RedirectURL:      os.Getenv("X_REDIRECT_URL"),
+		AllowedOrigin:    getEnv("CORS_ORIGIN", "*"),
+		FrontendURL:      getEnv("FRONTEND_URL", "/"),
+		JWTSecret:        os.Getenv("APP_JWT_SECRET"),
+		JWTTTL:           getEnvDuration("APP_JWT_TTL", 24*time.Hour),
+		XAiAPIKey:        os.Getenv("XAI_API_KEY"),
+		Persistence:      strings.ToLower(getEnv("PERSISTENCE", "memory")),
+		RedisAddr:        getEnv("REDIS_ADDR", ""),
+		RedisPassword:    os.Getenv("REDIS_PASSWORD"),
+		RedisDB:          getEnvInt("REDIS_DB", 0),
+		RedisTLS:         getEnvBool("REDIS_TLS", false),
+		RedisReadAddr:    os.Getenv("REDIS_READ_ADDR"),
+		RedisCompress:    getEnvBool("REDIS_COMPRESS", false),
+		RedisScanLimit:   getEnvInt("REDIS_SCAN_LIMIT", defaultRedisScanLimit),
+		Scopes:           parseScopes(os.Getenv("X_SCOPES")),
+		RequestTimeout:   getEnvDuration("REQUEST_TIMEOUT", 15*time.Second),
+		ShutdownTimeout:  getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		OAuthStateTTL:    getEnvDuration("OAUTH_STATE_TTL", defaultOAuthStateTTL),
+		IdempotencyTTL:   getEnvDuration("IDEMPOTENCY_TTL", 10*time.Minute),
+		CompressMinBytes: getEnvInt("COMPRESS_MIN_BYTES", 1024),
+		MaxBodyBytes:     int64(getEnvInt("MAX_BODY_BYTES", defaultMaxBodyBytes)),
+	}
+	cfg.RedirectHosts = parseRedirectHosts(cfg.FrontendURL, os.Getenv("ALLOWED_REDIRECT_HOSTS"))
+	cfg.TweetLanguages = parseList(os.Getenv("TWEET_LANGUAGES"))
+	cfg.XAPIBaseURL = strings.TrimRight(getEnv("X_API_BASE_URL", "https://api.twitter.com"), "/")
+	cfg.XAuthURL = getEnv("X_OAUTH_AUTH_URL", "https://twitter.com/i/oauth2/authorize")
+	cfg.XTokenURL = getEnv("X_OAUTH_TOKEN_URL", cfg.XAPIBaseURL+"/2/oauth2/token")
+	cfg.TweetFetchMax = getEnvInt("TWEET_FETCH_MAX", 100)
+	cfg.ProfileTweetLimit = getEnvInt("PROFILE_TWEET_LIMIT", defaultProfileTweetLimit)
+	cfg.TweetRefreshInterval = getEnvDuration("TWEET_REFRESH_INTERVAL", 15*time.Minute)
+	cfg.TweetCacheMaxUsers = getEnvInt("TWEET_CACHE_MAX_USERS", 10000)
+	cfg.SeedUsers = getEnv("SEED_USERS", defaultSeedUsers)
+	cfg.SeedMatches = getEnv("SEED_MATCHES", defaultSeedMatches)
+	if cfg.TweetFetchMax <= 0 {
+		cfg.TweetFetchMax = 100
+	}
+	cfg.GenerateAvatars = getEnvBool("GENERATE_AVATARS", true)
+	cfg.EnrichBios = getEnvBool("ENRICH_BIOS", false)
+	cfg.AvatarStorage = strings.ToLower(os.Getenv("AVATAR_STORAGE"))
+	cfg.AvatarS3 = blobstore.S3Config{
+		Endpoint:        os.Getenv("AVATAR_S3_ENDPOINT"),
+		Region:          getEnv("AVATAR_S3_REGION", "us-east-1"),
+		Bucket:          os.Getenv("AVATAR_S3_BUCKET"),
+		AccessKeyID:     getEnv("AVATAR_S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: getEnv("AVATAR_S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		PublicURL:       os.Getenv("AVATAR_S3_PUBLIC_URL"),
+	}
+	cfg.CookieName = getEnv("COOKIE_NAME", "access_token")
+	cfg.CookieDomain = os.Getenv("COOKIE_DOMAIN")
+	cfg.DefaultPageSize = getEnvInt("DEFAULT_PAGE_SIZE", 5)
+	cfg.MaxPageSize = getEnvInt("MAX_PAGE_SIZE", 50)
+	cfg.AdminIDs = parseList(os.Getenv("ADMIN_USER_IDS"))
+	cfg.MatchRequireLocation = getEnvBool("MATCH_REQUIRE_LOCATION", false)
+	cfg.GeoLatHeader = strings.TrimSpace(os.Getenv("GEO_LAT_HEADER"))
+	cfg.GeoLongHeader = strings.TrimSpace(os.Getenv("GEO_LONG_HEADER"))
+	cfg.ReportHideThreshold = getEnvInt("REPORT_HIDE_THRESHOLD", 3)
+	cfg.InactiveAfter = getEnvDuration("INACTIVE_AFTER", 0)
+	cfg.MatchOnEmpty = strings.ToLower(getEnv("MATCH_ON_EMPTY", "fallback"))
+	cfg.MatchSampling = strings.ToLower(getEnv("MATCH_SAMPLING", "all"))
+	cfg.MatchSampleSize = getEnvInt("MATCH_SAMPLE_SIZE", 50)
+	cfg.MatchStrongScore = getEnvFloat("MATCH_STRONG_SCORE", defaultMatchStrongScore)
+	cfg.MatchMinScore = getEnvFloat("MATCH_MIN_SCORE", defaultMatchMinScore)
+	cfg.MatchViewerRole = strings.TrimSpace(os.Getenv("MATCH_VIEWER_ROLE"))
+	cfg.MatchCandidateRole = strings.TrimSpace(os.Getenv("MATCH_CANDIDATE_ROLE"))
+	cfg.XAIMaxConcurrency = getEnvInt("XAI_MAX_CONCURRENCY", 0)
+	cfg.XAITraceHeader = getEnv("XAI_TRACE_HEADER", xai.DefaultTraceHeader)
+	cfg.XAIUserAgent = getEnv("XAI_USER_AGENT", xai.DefaultUserAgent+"/"+version)
+	cfg.XAIDefaultModel = getEnv("XAI_DEFAULT_MODEL", string(xai.DefaultModel))
+	cfg.XAIAnalysisMaxTokens = getEnvInt("XAI_ANALYSIS_MAX_TOKENS", 512)
+	cfg.MatchMaxTokens = getEnvInt("MATCH_MAX_TOKENS", matching.DefaultMaxTokens)
+	cfg.AnalysisPromptTweets = getEnvInt("ANALYSIS_PROMPT_TWEETS", defaultAnalysisTweetLimit)
+	cfg.MatchPromptTweets = getEnvInt("MATCH_PROMPT_TWEETS", matching.DefaultPromptTweetLimit)
+	cfg.MatchRetryAttempts = getEnvInt("MATCH_RETRY_ATTEMPTS", matching.DefaultRetryAttempts)
+	cfg.MatchRetryBackoff = getEnvDuration("MATCH_RETRY_BACKOFF", matching.DefaultRetryBackoff)
+	cfg.XAIPrecheck = getEnvBool("XAI_PRECHECK", false)
+	if cfg.DefaultPageSize <= 0 {
+		cfg.DefaultPageSize = 5
+	}
+	if cfg.MaxPageSize < cfg.DefaultPageSize {
+		cfg.MaxPageSize = cfg.DefaultPageSize
+	}
+
+	sameSite, err := parseSameSite(os.Getenv("COOKIE_SAMESITE"))
+	if err != nil {
+		return nil, err
 	}
+	cfg.CookieSameSite = sameSite
+	cfg.Flags, cfg.UnknownFlags, err = matching.ParseFlags(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	cfg.AvatarPromptTemplate = getEnv("AVATAR_PROMPT_TEMPLATE", defaultAvatarPromptTemplate)
+	cfg.AnalysisPromptTemplate = getEnv("ANALYSIS_PROMPT_TEMPLATE", defaultAnalysisPromptTemplate)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports the first setting that would keep the server from
+// working: a missing required value or one outside its allowed set.
+func (c *Config) Validate() error {
+	if c.ClientID == "" {
+		return errors.New("missing X_CLIENT_ID")
+	}
+	if c.ClientSecret == "" {
+		return errors.New("missing X_CLIENT_SECRET")
+	}
+	if c.RedirectURL == "" {
+		return errors.New("missing X_REDIRECT_URL")
+	}
+	if err := validateJWTSecret(c.JWTSecret); err != nil {
+		return err
+	}
+	if c.MatchOnEmpty != "fallback" && c.MatchOnEmpty != "compute" {
+		return fmt.Errorf("invalid MATCH_ON_EMPTY %q (want fallback or compute)", c.MatchOnEmpty)
+	}
+	if _, err := samplingStrategy(c.MatchSampling, c.MatchSampleSize); err != nil {
+		return err
+	}
+	if c.MatchMinScore < 0 || c.MatchMinScore > c.matchStrongScore() || c.matchStrongScore() > 100 {
+		return fmt.Errorf("invalid match tiers: want 0 <= MATCH_MIN_SCORE (%g) <= MATCH_STRONG_SCORE (%g) <= 100", c.MatchMinScore, c.matchStrongScore())
+	}
+	for name, pattern := range map[string]string{"SEED_USERS": c.SeedUsers, "SEED_MATCHES": c.SeedMatches} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, pattern, err)
+		}
+	}
+	if c.AnalysisPromptTweets < 0 || c.MatchPromptTweets < 0 {
+		return errors.New("ANALYSIS_PROMPT_TWEETS and MATCH_PROMPT_TWEETS must not be negative")
+	}
+	if (c.MatchViewerRole == "") != (c.MatchCandidateRole == "") {
+		return errors.New("MATCH_VIEWER_ROLE and MATCH_CANDIDATE_ROLE must be set together")
+	}
+	if _, err := c.avatarStore(); err != nil {
+		return err
+	}
+	if err := validateAvatarPromptTemplate(c.AvatarPromptTemplate); err != nil {
+		return err
+	}
+	return validateAnalysisPromptTemplate(c.AnalysisPromptTemplate)
+}
 
-	if cfg.ClientID == "" {
-		return nil, errors.New("missing X_CLIENT_ID")
+// Warnings lists valid but risky settings worth an operator's attention.
+func (c *Config) Warnings() []string {
+	var out []string
+	if _, credentials := c.corsOrigins(); !credentials {
+		out = append(out, "CORS_ORIGIN=* disables CORS credentials (browsers reject credentialed requests to a wildcard origin), so cookie sessions will not work cross-origin; set CORS_ORIGIN to the frontend origin(s)")
+	}
+	if c.CookieSameSite == http.SameSiteNoneMode && !strings.HasPrefix(strings.ToLower(c.RedirectURL), "https") {
+		out = append(out, fmt.Sprintf("COOKIE_SAMESITE=none forces Secure cookies; they will not be sent over plain http (X_REDIRECT_URL=%s)", c.RedirectURL))
 	}
-	if cfg.ClientSecret == "" {
-		return nil, errors.New("missing X_CLIENT_SECRET")
+	if c.Persistence != "memory" && c.Persistence != "redis" {
+		out = append(out, fmt.Sprintf("PERSISTENCE=%s is not memory or redis: users and tokens are kept in memory and lost on restart", c.Persistence))
 	}
-	if cfg.RedirectURL == "" {
-		return nil, errors.New("missing X_REDIRECT_URL")
+	if c.Persistence == "redis" && c.RedisAddr == "" {
+		out = append(out, "PERSISTENCE=redis without REDIS_ADDR: users and tokens are kept in memory and lost on restart")
 	}
-	if cfg.JWTSecret == "" {
-		return nil, errors.New("missing APP_JWT_SECRET")
+	if c.XAiAPIKey == "" {
+		out = append(out, "XAI_API_KEY is not set: profile analysis and matching are disabled")
 	}
-	if cfg.Persistence != "memory" && cfg.Persistence != "redis" {
-		cfg.Persistence = "memory"
+	for _, name := range c.UnknownFlags {
+		out = append(out, fmt.Sprintf("%s is not a known feature flag and has no effect", name))
 	}
+	if m := c.defaultModel(); !xai.IsKnownModel(m) {
+		out = append(out, fmt.Sprintf("XAI_DEFAULT_MODEL=%s is not a known chat model; requests will fail if xAI doesn't recognize it", m))
+	}
+	return out
+}
 
-	return cfg, nil
+// Summary lists the effective settings as key=value pairs for the startup
+// log. Secrets only show whether they are set.
+func (c *Config) Summary() []string {
+	secret := func(v string) string {
+		if v == "" {
+			return "(unset)"
+		}
+		return "(set)"
+	}
+	return []string{
+		"port=" + c.Port,
+		"x_client_id=" + c.ClientID,
+		"x_client_secret=" + secret(c.ClientSecret),
+		"x_redirect_url=" + c.RedirectURL,
+		"x_scopes=" + strings.Join(c.Scopes, ","),
+		"cors_origin=" + c.AllowedOrigin,
+		"frontend_url=" + c.FrontendURL,
+		"redirect_hosts=" + strings.Join(c.RedirectHosts, ","),
+		"jwt_secret=" + secret(c.JWTSecret),
+		"jwt_ttl=" + c.JWTTTL.String(),
+		"cookie_name=" + c.CookieName,
+		"cookie_domain=" + c.CookieDomain,
+		"cookie_samesite=" + sameSiteName(c.CookieSameSite),
+		"persistence=" + c.Persistence,
+		"redis_addr=" + c.RedisAddr,
+		"redis_read_addr=" + c.RedisReadAddr,
+		"redis_password=" + secret(c.RedisPassword),
+		fmt.Sprintf("redis_db=%d", c.RedisDB),
+		fmt.Sprintf("redis_tls=%t", c.RedisTLS),
+		fmt.Sprintf("redis_compress=%t", c.RedisCompress),
+		fmt.Sprintf("redis_scan_limit=%d", c.RedisScanLimit),
+		"request_timeout=" + c.RequestTimeout.String(),
+		"shutdown_timeout=" + c.ShutdownTimeout.String(),
+		"oauth_state_ttl=" + c.oauthStateTTL().String(),
+		"idempotency_ttl=" + c.IdempotencyTTL.String(),
+		fmt.Sprintf("compress_min_bytes=%d", c.CompressMinBytes),
+		fmt.Sprintf("max_body_bytes=%d", c.maxBodyBytes()),
+		"seed_users=" + c.seedUsers(),
+		"seed_matches=" + c.seedMatches(),
+		"xai_api_key=" + secret(c.XAiAPIKey),
+		fmt.Sprintf("xai_max_concurrency=%d", c.XAIMaxConcurrency),
+		"xai_trace_header=" + c.XAITraceHeader,
+		"xai_user_agent=" + c.XAIUserAgent,
+		"xai_default_model=" + string(c.defaultModel()),
+		fmt.Sprintf("generate_avatars=%t", c.GenerateAvatars),
+		fmt.Sprintf("enrich_bios=%t", c.EnrichBios),
+		"avatar_storage=" + c.AvatarStorage,
+		"avatar_s3_secret_access_key=" + secret(c.AvatarS3.SecretAccessKey),
+		"match_sampling=" + c.MatchSampling,
+		fmt.Sprintf("match_sample_size=%d", c.MatchSampleSize),
+		fmt.Sprintf("match_strong_score=%g", c.matchStrongScore()),
+		fmt.Sprintf("match_min_score=%g", c.MatchMinScore),
+		"match_roles=" + c.matchRolesName(),
+		"match_on_empty=" + c.MatchOnEmpty,
+		fmt.Sprintf("match_retry_attempts=%d", c.MatchRetryAttempts),
+		fmt.Sprintf("analysis_prompt_tweets=%d", c.analysisPromptTweets()),
+		fmt.Sprintf("match_prompt_tweets=%d", c.MatchPromptTweets),
+		fmt.Sprintf("flag_distance_weighting=%t", c.Flags.DistanceWeighting),
+		fmt.Sprintf("flag_batch_matching=%t", c.Flags.BatchMatching),
+		fmt.Sprintf("report_hide_threshold=%d", c.ReportHideThreshold),
+		"inactive_after=" + c.InactiveAfter.String(),
+		"geo_lat_header=" + c.GeoLatHeader,
+		"geo_long_header=" + c.GeoLongHeader,
+		fmt.Sprintf("admin_ids=%d", len(c.AdminIDs)),
+	}
+}
+
+// logSummary writes the effective settings and any warnings to the log.
+func (c *Config) logSummary() {
+	log.Printf("config: %s", strings.Join(c.Summary(), " "))
+	for _, w := range c.Warnings() {
+		log.Printf("warning: %s", w)
+	}
+}
+
+// minJWTSecretLen is the shortest APP_JWT_SECRET accepted: HS256 keys
+// should carry at least as many bytes as the hash output.
+const minJWTSecretLen = 32
+
+// allowWeakJWTSecret lets tests load configs with short secrets. It is never
+// set outside tests.
+var allowWeakJWTSecret = false
+
+func validateJWTSecret(secret string) error {
+	if secret == "" {
+		return errors.New("missing APP_JWT_SECRET")
+	}
+	if len(secret) < minJWTSecretLen && !allowWeakJWTSecret {
+		return fmt.Errorf("APP_JWT_SECRET is %d bytes; use at least %d (e.g. openssl rand -hex 32)", len(secret), minJWTSecretLen)
+	}
+	return nil
+}
+
+// precheckXAI verifies the xAI key at startup. Failures are logged but never
+// stop the server, since AI features degrade on their own.
+func (s *server) precheckXAI() {
+	if s.config.XAiAPIKey == "" {
+		log.Printf("warning: xai precheck skipped: XAI_API_KEY is not set")
+		return
+	}
+	pinger, ok := s.aiClient.(xai.Pinger)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := pinger.Ping(ctx); err != nil {
+		if errors.Is(err, xai.ErrUnauthorized) {
+			log.Printf("warning: xai precheck failed: XAI_API_KEY was rejected, AI features will not work: %v", err)
+			return
+		}
+		log.Printf("warning: xai precheck failed: %v", err)
+		return
+	}
+	log.Printf("xai precheck ok")
+}
+
+// avatarStore returns the blobstore generated avatars are copied to, or nil
+// when they stay at xAI's URL.
+func (c *Config) avatarStore() (blobstore.Blobstore, error) {
+	switch c.AvatarStorage {
+	case "", "none":
+		return nil, nil
+	case "s3":
+		store, err := blobstore.NewS3(c.AvatarS3)
+		if err != nil {
+			return nil, fmt.Errorf("AVATAR_STORAGE=s3: %w", err)
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("invalid AVATAR_STORAGE %q: want s3 or none", c.AvatarStorage)
+	}
+}
+
+// serverDeps holds the collaborators a server can be built with. Nil fields
+// are created from the config.
+type serverDeps struct {
+	users     UserStore
+	tokens    tokenStore
+	tweets    *tweetStore
+	matcher   *matching.Service
+	ai        xai.ChatCompleter
+	images    xai.ImageGenerator
+	responses xai.ResponseGenerator
+	avatars   blobstore.Blobstore
 }
 
 func newServer(cfg *Config) *server {
+	s := newServerWithDeps(cfg, serverDeps{})
+	s.seedUsers()
+	s.seedMatches()
+	s.resumeAnalysis()
+	return s
+}
+
+// newServerWithDeps wires a server from cfg and deps without seeding from
+// files, so tests can inject in-memory stores and fake AI clients.
+func newServerWithDeps(cfg *Config, deps serverDeps) *server {
+	if deps.users == nil {
+		deps.users = newUserStore(cfg)
+	}
+	if deps.tokens == nil {
+		deps.tokens = newTokenStoreFromConfig(cfg)
+	}
+	if deps.tweets == nil {
+		deps.tweets = newTweetStore(max(50, cfg.TweetFetchMax))
+		deps.tweets.maxUsers = cfg.TweetCacheMaxUsers
+	}
+	// One xAI client serves analysis, images and matching, so
+	// XAI_MAX_CONCURRENCY caps all of them together.
+	if deps.matcher == nil || deps.ai == nil || deps.images == nil || deps.responses == nil {
+		aiClient := xai.NewClient(cfg.XAiAPIKey, cfg.xaiOptions()...)
+		if deps.matcher == nil {
+			var matchAI matching.AIClient
+			if cfg.XAiAPIKey != "" {
+				matchAI = aiClient
+			}
+			deps.matcher = matching.NewService(matchAI, cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+			deps.matcher.SetReadReplica(cfg.RedisReadAddr)
+		}
+		if deps.ai == nil {
+			deps.ai = aiClient
+		}
+		if deps.images == nil {
+			deps.images = aiClient
+		}
+		if deps.responses == nil {
+			deps.responses = aiClient
+		}
+	}
+	if deps.avatars == nil {
+		store, err := cfg.avatarStore()
+		if err != nil {
+			log.Printf("warning: avatar storage disabled: %v", err)
+		}
+		deps.avatars = store
+	}
+
 	s := &server{
 		config: cfg,
 		oauth: &oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
 			RedirectURL:  cfg.RedirectURL,
-			Scopes:       []string{"tweet.read", "users.read", "offline.access"},
+			Scopes:       cfg.Scopes,
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://twitter.com/i/oauth2/authorize",
-				TokenURL: "https://api.twitter.com/2/oauth2/token",
+				AuthURL:  cfg.XAuthURL,
+				TokenURL: cfg.XTokenURL,
 			},
 		},
-		states:  newStateStore(10 * time.Minute),
-		users:   newUserStore(cfg),
-		tokens:  newTokenStoreFromConfig(cfg),
-		tweets:  newTweetStore(50),
-		matcher: matching.NewService(cfg.XAiAPIKey, cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB),
-	}
-
-	s.seedUsers()
-	s.seedMatches()
+		states:       newStateStore(cfg.oauthStateTTL()),
+		users:        deps.users,
+		tokens:       deps.tokens,
+		tweets:       deps.tweets,
+		matcher:      deps.matcher,
+		aiClient:     deps.ai,
+		images:       deps.images,
+		responses:    deps.responses,
+		avatars:      deps.avatars,
+		suggestions:  newSuggestionCache(24 * time.Hour),
+		recompute:    newRateLimiter(5 * time.Minute),
+		pairRefresh:  newRateLimiter(time.Minute),
+		reports:      newRateLimiter(time.Minute),
+		quickMatches: newRateLimiter(quickMatchRetry),
+		deleted:      newTombstoneStore(deps.users, tombstoneTTL),
+		idempotency:  newIdempotencyStore(cfg, deps.users),
+	}
+
+	s.matcher.SetRequireLocation(cfg.MatchRequireLocation)
+	s.matcher.SetMaxTokens(cfg.MatchMaxTokens)
+	s.matcher.SetPromptTweetLimit(cfg.MatchPromptTweets)
+	s.matcher.SetRetry(cfg.MatchRetryAttempts, cfg.MatchRetryBackoff)
+	s.matcher.SetFlags(cfg.Flags)
+	if strategy, err := samplingStrategy(cfg.MatchSampling, cfg.MatchSampleSize); err == nil {
+		s.matcher.SetSampling(strategy)
+	}
+	s.matcher.SetRedisCompression(cfg.RedisCompress)
+	s.matcher.SetRoles(cfg.matchRoles())
+	s.matcher.SetModel(cfg.defaultModel())
+	s.matcher.SetInterestLookup(func(ctx context.Context, userIDs []string) map[string][]string {
+		out := make(map[string][]string, len(userIDs))
+		for id, u := range s.users.getMany(ctx, userIDs) {
+			out[id] = interestTokens(u.Interests)
+		}
+		return out
+	})
 	return s
 }
 
 func (s *server) routes() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
+	r.Use(traceAIRequests)
 	r.Use(requestMetaLogger)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{s.config.AllowedOrigin},
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodOptions},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	r.Use(cors.Handler(s.config.corsOptions()))
 
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-	})
+	r.Get("/health", s.handleHealth)
 
 	r.Route("/auth/x", func(r chi.Router) {
+		r.Use(requestTimeout(s.config.RequestTimeout))
 		r.Get("/login", s.handleXLogin)
 		r.Get("/callback", s.handleXCallback)
 	})
 
 	r.Route("/api", func(r chi.Router) {
-		r.Get("/me", s.handleMe)
-		r.Post("/me", s.handleUpdateMe)
-		r.Post("/me/location", s.handleUpdateLocation)
-		r.Get("/users", s.handleUsers)
-		r.Get("/users/{id}", s.handleUser)
-		r.Post("/debug/flush", s.handleDebugFlush)
+		r.Use(apiVersionHeader)
+		r.Use(gzipResponses(s.config.CompressMinBytes))
+		r.Use(limitRequestBody(s.config.maxBodyBytes()))
+
+		// Streams flush as they go, which the buffered request timeout would
+		// hold back, so they are registered outside it.
+		r.Get("/users/{id}/match/stream", s.handleMatchStream)
+		r.With(s.requireAdmin).Get("/admin/matches.csv", s.handleAdminMatchesCSV)
+		// Reindexing walks every key, so it can outlast REQUEST_TIMEOUT.
+		r.With(s.requireAdmin).Post("/admin/reindex", s.handleAdminReindex)
+
+		r.Group(func(r chi.Router) {
+			r.Use(requestTimeout(s.config.RequestTimeout))
+			r.Get("/me", s.handleMe)
+			r.Get("/me/suggested-interests", s.handleSuggestedInterests)
+			r.Get("/me/matched-by", s.handleMatchedBy)
+			r.Get("/me/stats", s.handleMyStats)
+			r.Post("/matches/lookup", s.handleMatchLookup)
+			r.Get("/users", s.handleUsers)
+			r.Get("/users/{id}", s.handleUser)
+
+			// Writes a client may retry; see idempotent.
+			r.Group(func(r chi.Router) {
+				r.Use(s.idempotent)
+				r.Post("/me", s.handleUpdateMe)
+				r.Delete("/me", s.handleDeleteMe)
+				r.Post("/me/location", s.handleUpdateLocation)
+				r.Post("/me/interests", s.handleUpdateInterests)
+				r.Post("/me/matches/recompute", s.handleRecomputeMatches)
+				r.Post("/users/{id}/match/refresh", s.handleRefreshMatch)
+				r.Post("/users/{id}/report", s.handleReportUser)
+				r.Post("/users/{id}/pin", s.handlePinMatch)
+				r.Delete("/users/{id}/pin", s.handleUnpinMatch)
+			})
+			r.Post("/debug/flush", s.handleDebugFlush)
+			r.Get("/debug/stats", s.handleDebugStats)
+			r.With(s.requireAdmin).Get("/debug/flags", s.handleDebugFlags)
+
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(s.requireAdmin)
+				r.Get("/match", s.handleAdminMatch)
+				r.Get("/users/{id}/prompt", s.handleAdminUserPrompt)
+				r.Post("/users/{id}/score", s.handleAdminSetScore)
+				r.Delete("/users/{id}/score", s.handleAdminClearScore)
+			})
+		})
 	})
 
 	return r
@@ -197,8 +898,19 @@ func (s *server) handleXLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	returnTo := ""
+	if raw := r.URL.Query().Get("return_to"); raw != "" {
+		target, ok := sanitizeReturnTo(raw, s.config.FrontendURL, s.config.RedirectHosts)
+		if !ok {
+			logError(r, fmt.Sprintf("rejected return_to=%q", raw), nil)
+			writeError(w, http.StatusBadRequest, "invalid return_to")
+			return
+		}
+		returnTo = target
+	}
+
 	challenge := pkceChallenge(verifier)
-	s.states.put(state, verifier)
+	s.states.put(state, verifier, returnTo)
 	log.Printf("req_id=%s login issued state=%s host=%s", middleware.GetReqID(r.Context()), state, r.Host)
 
 	authURL := s.oauth.AuthCodeURL(
@@ -223,7 +935,7 @@ func (s *server) handleXCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	verifier, ok := s.states.pop(state)
+	entry, ok := s.states.pop(state)
 	if !ok {
 		logError(r, "invalid or expired state", nil)
 		writeError(w, http.StatusBadRequest, "invalid or expired state")
@@ -233,7 +945,7 @@ func (s *server) handleXCallback(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	token, err := s.oauth.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	token, err := s.oauth.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", entry.verifier))
 	if err != nil {
 		logError(r, "token exchange failed", err)
 		writeError(w, http.StatusBadGateway, fmt.Sprintf("token exchange failed: %v", err))
@@ -252,11 +964,22 @@ func (s *server) handleXCallback(w http.ResponseWriter, r *http.Request) {
 		logError(r, "failed fetching X profile after login", err)
 	} else if profile.ID != "" {
 		log.Printf("req_id=%s profile fetched login id=%s username=%s", middleware.GetReqID(r.Context()), profile.ID, profile.Username)
-		s.users.upsert(profile)
-		go s.fetchUserTweets(profile.ID, token.AccessToken) // This will trigger XAI analysis -> then trigger matching
+		now := time.Now()
+		profile.LastLoginAt = &now
+		if _, ok := s.users.get(ctx, profile.ID); ok {
+			fresh := profile
+			s.users.updateProfile(ctx, profile.ID, func(u userProfile) userProfile {
+				return mergeXProfile(u, fresh)
+			})
+			profile, _ = s.users.get(ctx, profile.ID)
+		} else {
+			s.users.upsert(ctx, profile)
+		}
+		s.deleted.remove(ctx, profile.ID)
+		go s.fetchUserTweets(ctx, profile.ID, token.AccessToken) // This will trigger XAI analysis -> then trigger matching
 	}
 
-	s.tokens.upsert(profile.ID, tokenInfo{
+	s.tokens.upsert(ctx, profile.ID, tokenInfo{
 		UserID:       profile.ID,
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
@@ -270,18 +993,12 @@ func (s *server) handleXCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	secureCookie := strings.HasPrefix(strings.ToLower(s.config.RedirectURL), "https")
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    sessionToken,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   secureCookie,
-		SameSite: http.SameSiteLaxMode,
-		Expires:  token.Expiry,
-	})
+	http.SetCookie(w, s.sessionCookie(sessionToken, token.Expiry))
 
-	redirectTarget := resolveRedirectTarget(s.config.FrontendURL)
+	redirectTarget := resolveRedirectTarget(s.config.FrontendURL, s.config.RedirectHosts)
+	if entry.returnTo != "" {
+		redirectTarget = entry.returnTo
+	}
 	if wantsJSON(r) {
 		writeJSON(w, http.StatusOK, map[string]interface{}{
 			"session":        sessionID,
@@ -295,7 +1012,12 @@ func (s *server) handleXCallback(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleMe(w http.ResponseWriter, r *http.Request) {
-	userID := s.resolveAccessToken(r)
+	ctx := r.Context()
+	claims := s.resolveSession(r)
+	var userID string
+	if claims != nil {
+		userID = claims.Subject
+	}
 	if userID == "" {
 		writeError(w, http.StatusUnauthorized, "missing access token")
 		return
@@ -306,15 +1028,15 @@ func (s *server) handleMe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	profile, ok := s.users.get(userID)
+	profile, ok := s.users.get(ctx, userID)
 	if !ok {
 		// try to fetch using stored token
-		if tok, ok := s.tokens.get(userID); ok && tok.AccessToken != "" {
+		if tok, ok := s.tokens.get(ctx, userID); ok && tok.AccessToken != "" {
 			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 			defer cancel()
 			fresh, err := s.fetchXUser(ctx, tok.AccessToken)
 			if err == nil && fresh.ID != "" {
-				s.users.upsert(fresh)
+				s.users.upsert(ctx, fresh)
 				profile = fresh
 				ok = true
 			}
@@ -325,16 +1047,126 @@ func (s *server) handleMe(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	tweetLimit, err := s.config.tweetsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if profile.ID != "" {
-		profile.Tweets = s.tweets.get(profile.ID)
+		profile.Tweets = limitTweets(s.tweets.get(profile.ID), tweetLimit)
+	}
+	if lat, long, ok := s.geoLocation(r); ok && geoLocatable(profile) && (profile.Lat != lat || profile.Long != long) {
+		s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
+			if geoLocatable(u) {
+				u.Lat, u.Long, u.LocationSource = lat, long, locationSourceGeoIP
+			}
+			return u
+		})
+		if u, ok := s.users.get(ctx, userID); ok {
+			profile.Lat, profile.Long, profile.LocationSource = u.Lat, u.Long, u.LocationSource
+		}
 	}
 
-	writeJSON(w, http.StatusOK, profile)
+	resp := struct {
+		userProfile
+		SessionExpiry *time.Time `json:"session_expiry,omitempty"`
+	}{userProfile: profile}
+	if claims.ExpiresAt != nil {
+		resp.SessionExpiry = &claims.ExpiresAt.Time
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Defaults for MATCH_STRONG_SCORE and MATCH_MIN_SCORE.
+const (
+	defaultMatchStrongScore = 70
+	defaultMatchMinScore    = 40
+)
+
+// Match tiers, from matchTier.
+const (
+	tierStrong   = "strong"
+	tierModerate = "moderate"
+	tierWeak     = "weak"
+)
+
+// matchStrongScore returns MatchStrongScore, or the default when it is not
+// positive.
+func (c *Config) matchStrongScore() float64 {
+	if c.MatchStrongScore <= 0 {
+		return defaultMatchStrongScore
+	}
+	return c.MatchStrongScore
+}
+
+// matchTier buckets a match score for display.
+func (c *Config) matchTier(score float64) string {
+	switch {
+	case score >= c.matchStrongScore():
+		return tierStrong
+	case score >= c.MatchMinScore:
+		return tierModerate
+	default:
+		return tierWeak
+	}
 }
 
 func (s *server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	viewerID := s.resolveAccessToken(r)
 
+	limit, err := s.config.limitParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// include_self keeps the viewer's own card in the fallback list.
+	includeSelf := false
+	if raw := r.URL.Query().Get("include_self"); raw != "" {
+		includeSelf, err = strconv.ParseBool(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "include_self must be true or false")
+			return
+		}
+	}
+
+	// include_weak keeps matches scored below MATCH_MIN_SCORE.
+	includeWeak := false
+	if raw := r.URL.Query().Get("include_weak"); raw != "" {
+		includeWeak, err = strconv.ParseBool(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "include_weak must be true or false")
+			return
+		}
+	}
+
+	// cursor continues a previous page of matches; see X-Next-Cursor.
+	var cursor *matching.MatchCursor
+	if raw := r.URL.Query().Get("cursor"); raw != "" {
+		cursor, err = matching.ParseMatchCursor(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// mode=diverse trades some score for variety; see DiverseMatches.
+	diverse := false
+	switch r.URL.Query().Get("mode") {
+	case "", "top":
+	case "diverse":
+		if cursor != nil {
+			writeError(w, http.StatusBadRequest, "cursor is not supported with mode=diverse")
+			return
+		}
+		diverse = true
+	default:
+		writeError(w, http.StatusBadRequest, "mode must be top or diverse")
+		return
+	}
+
 	type userSummary struct {
 		UserID        string   `json:"user_id"`
 		Name          string   `json:"name,omitempty"`
@@ -344,37 +1176,84 @@ func (s *server) handleUsers(w http.ResponseWriter, r *http.Request) {
 		Long          float64  `json:"long,omitempty"`
 		MatchingScore float64  `json:"matching_score,omitempty"`
 		MatchReason   string   `json:"match_reason,omitempty"`
-		Summary       string   `json:"summary,omitempty"`
-		Description   string   `json:"description,omitempty"`
-		Tweets        []string `json:"tweets,omitempty"`
-		Interests     string   `json:"interests,omitempty"`
-	}
-
-	var out []userSummary
+		MatchTags     []string `json:"match_tags,omitempty"`
+		// Tier is strong, moderate or weak, from the match score.
+		Tier string `json:"tier,omitempty"`
+		// Pinned marks matches the viewer pinned; they lead the first page.
+		Pinned bool `json:"pinned,omitempty"`
+		// SharedAvailability is set when the viewer's and the match's
+		// availability windows overlap.
+		SharedAvailability bool     `json:"shared_availability,omitempty"`
+		Summary            string   `json:"summary,omitempty"`
+		Description        string   `json:"description,omitempty"`
+		Tweets             []string `json:"tweets,omitempty"`
+		Interests          string   `json:"interests,omitempty"`
+	}
+
+	out := []userSummary{}
+	var matches []matching.MatchResult
 
 	// 1. Try to get Top Matches if logged in
+	if viewerID != "" && diverse {
+		minScore := s.config.MatchMinScore
+		if includeWeak {
+			minScore = 0
+		}
+		// A diverse page isn't a slice of the score ranking, so it has no
+		// cursor.
+		matches = s.matcher.DiverseMatches(ctx, viewerID, limit, minScore)
+	} else if viewerID != "" {
+		matches = s.matcher.GetTopMatchesAfter(ctx, viewerID, cursor, limit)
+		// A full page may have more behind it. Pinned matches are extra to
+		// the page and never end it.
+		var ranked []matching.MatchResult
+		for _, m := range matches {
+			if !m.Pinned {
+				ranked = append(ranked, m)
+			}
+		}
+		// Matches are ranked by score, so once the page reaches weak ones
+		// every later page would be filtered out too.
+		if len(ranked) == limit && (includeWeak || ranked[len(ranked)-1].Score >= s.config.MatchMinScore) {
+			w.Header().Set("X-Next-Cursor", matching.CursorAfter(ranked[len(ranked)-1]).Encode())
+		}
+	}
 	if viewerID != "" {
-		matches := s.matcher.GetTopMatches(viewerID, 5)
 		if len(matches) > 0 {
+			viewer, _ := s.users.get(ctx, viewerID)
+			now := time.Now()
+			ids := make([]string, len(matches))
+			for i, m := range matches {
+				ids[i] = m.TargetID
+			}
+			hidden := s.hiddenUsers(ctx, ids)
 			out = make([]userSummary, 0, len(matches))
 			for _, m := range matches {
-				u, ok := s.users.get(m.TargetID)
-				if !ok {
+				tier := s.config.matchTier(m.Score)
+				if tier == tierWeak && !includeWeak && !m.Pinned {
+					continue
+				}
+				u, ok := s.users.get(ctx, m.TargetID)
+				if !ok || hidden[u.ID] || s.inactive(u, now) {
 					continue
 				}
 				tweets := s.tweets.get(u.ID)
 				out = append(out, userSummary{
-					UserID:        u.ID,
-					Name:          u.Name,
-					Username:      u.Username,
-					ProfileImage:  u.ProfileImageURL,
-					Lat:           u.Lat,
-					Long:          u.Long,
-					MatchingScore: m.Score,
-					MatchReason:   m.Reason,
-					Summary:       u.Summary,
-					Description:   u.Description,
-					Interests:     u.Interests,
+					UserID:             u.ID,
+					Name:               u.Name,
+					Username:           u.Username,
+					ProfileImage:       u.ProfileImageURL,
+					Lat:                u.Lat,
+					Long:               u.Long,
+					MatchingScore:      m.Score,
+					MatchReason:        m.Reason,
+					MatchTags:          m.ReasonTags,
+					Tier:               tier,
+					Pinned:             m.Pinned,
+					SharedAvailability: sharedAvailability(viewer, u, now),
+					Summary:            u.Summary,
+					Description:        u.Description,
+					Interests:          u.Interests,
 					Tweets: func() []string {
 						if len(tweets) > 0 {
 							return []string{tweets[0]}
@@ -386,13 +1265,34 @@ func (s *server) handleUsers(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// 2. Fallback to default top 5 if no specific matches found
-	if len(out) == 0 {
-		users := s.users.top(5)
+	// A viewer with no matches yet can be asked to poll while the top
+	// candidates are matched, instead of being shown unranked users.
+	if viewerID != "" && len(matches) == 0 && cursor == nil && s.config.MatchOnEmpty == "compute" {
+		if pending := s.quickMatch(ctx, viewerID, limit); pending > 0 {
+			log.Printf("req_id=%s matches computing viewer=%s candidates=%d", middleware.GetReqID(r.Context()), viewerID, pending)
+			w.Header().Set("X-Matches-Computing", "true")
+			writeJSON(w, http.StatusAccepted, out)
+			return
+		}
+	}
+
+	// 2. Fallback to default top users if no specific matches found. Later
+	// pages of matches never fall back.
+	if len(out) == 0 && cursor == nil {
+		now := time.Now()
+		users := s.users.top(ctx, limit)
+		ids := make([]string, len(users))
+		for i, u := range users {
+			ids[i] = u.ID
+		}
+		hidden := s.hiddenUsers(ctx, ids)
 		out = make([]userSummary, 0, len(users))
 		for _, u := range users {
 			// Skip self if logged in (optional but good UI)
-			if u.ID == viewerID {
+			if u.ID == viewerID && !includeSelf {
+				continue
+			}
+			if hidden[u.ID] || s.inactive(u, now) {
 				continue
 			}
 			tweets := s.tweets.get(u.ID)
@@ -421,21 +1321,31 @@ func (s *server) handleUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	userID := chi.URLParam(r, "id")
 	if userID == "" {
 		writeError(w, http.StatusBadRequest, "missing user id")
 		return
 	}
 
-	user, ok := s.users.get(userID)
+	user, ok := s.users.get(ctx, userID)
 	if !ok {
+		if s.deleted.has(ctx, userID) {
+			writeError(w, http.StatusGone, "user deleted")
+			return
+		}
 		writeError(w, http.StatusNotFound, "user not found")
 		return
 	}
 
+	tweetLimit, err := s.config.tweetsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	// Populate tweets from separate store
 	if user.ID != "" {
-		user.Tweets = s.tweets.get(user.ID)
+		user.Tweets = limitTweets(s.tweets.get(user.ID), tweetLimit)
 	}
 
 	// Calculate/Fetch Match Score if viewer is logged in
@@ -443,26 +1353,37 @@ func (s *server) handleUser(w http.ResponseWriter, r *http.Request) {
 
 	// Define response structure that flattens userProfile fields
 	// and adds an optional Match field.
+	type matchInfo struct {
+		matching.MatchResult
+		Tier string `json:"tier"`
+	}
 	type userResponse struct {
 		userProfile
-		Match *matching.MatchResult `json:"match_info,omitempty"`
+		Match              *matchInfo `json:"match_info,omitempty"`
+		SharedAvailability bool       `json:"shared_availability,omitempty"`
 	}
 
-	var match *matching.MatchResult
+	var match *matchInfo
+	shared := false
 	if viewerID != "" && viewerID != user.ID {
-		m := s.matcher.GetMatch(viewerID, user.ID)
+		m := s.matcher.GetMatch(ctx, viewerID, user.ID)
 		if m.Score > 0 {
-			match = &m
+			match = &matchInfo{MatchResult: m, Tier: s.config.matchTier(m.Score)}
+			if viewer, ok := s.users.get(ctx, viewerID); ok {
+				shared = sharedAvailability(viewer, user, time.Now())
+			}
 		}
 	}
 
 	writeJSON(w, http.StatusOK, userResponse{
-		userProfile: user,
-		Match:       match,
+		userProfile:        user,
+		Match:              match,
+		SharedAvailability: shared,
 	})
 }
 
 func (s *server) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	userID := s.resolveAccessToken(r)
 	if userID == "" {
 		writeError(w, http.StatusUnauthorized, "missing access token")
@@ -473,22 +1394,44 @@ func (s *server) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
 		Lat       float64 `json:"lat"`
 		Long      float64 `json:"long"`
 		Interests string  `json:"interests"`
+		// Omitted leaves the timezone unchanged; "" or null clears it.
+		Timezone optionalString `json:"timezone"`
+		// nil leaves availability unchanged; an empty list clears it.
+		Availability []availabilityWindow `json:"availability"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid json body")
+	if !decodeJSONBody(w, r, &body) {
 		return
 	}
 
-	if len(body.Interests) > 512 {
-		writeError(w, http.StatusBadRequest, "interests too long (max 512 chars)")
+	// The limit applies to the interests as stored, so padding and
+	// duplicate separators don't count against it.
+	interests := normalizeInterests(body.Interests)
+	if len(interests) > maxInterestsLen {
+		writeError(w, http.StatusBadRequest, interestsTooLongMsg)
+		return
+	}
+	if err := validateTimezone(body.Timezone.Value); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateAvailability(body.Availability); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	s.users.updateProfile(userID, func(u userProfile) userProfile {
+	var updated userProfile
+	s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
 		if body.Interests != "" {
-			u.Interests = body.Interests
+			u.Interests = interests
+		}
+		if body.Timezone.Set {
+			u.Timezone = body.Timezone.Value
 		}
+		if body.Availability != nil {
+			u.Availability = body.Availability
+		}
+		updated = u
 		return u
 	})
 
@@ -496,16 +1439,27 @@ func (s *server) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
 	if body.Interests != "" {
 		tweets := s.tweets.get(userID)
 		if len(tweets) > 0 {
-			go s.callXAIAnalysis(userID, tweets)
+			go s.callXAIAnalysis(ctx, userID, tweets)
 		}
 	}
 
 	writeJSON(w, http.StatusOK, map[string]any{
-		"interests": body.Interests,
+		"interests":    interests,
+		"timezone":     updated.Timezone,
+		"availability": updated.Availability,
 	})
 }
 
-func (s *server) handleUpdateLocation(w http.ResponseWriter, r *http.Request) {
+const (
+	maxInterestsLen     = 512
+	interestsTooLongMsg = "interests too long (max 512 chars)"
+)
+
+// handleUpdateInterests sets the user's interests. With mode=append (query
+// or body) the new interests are merged into the existing list, skipping
+// duplicates; replace is the default.
+func (s *server) handleUpdateInterests(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	userID := s.resolveAccessToken(r)
 	if userID == "" {
 		writeError(w, http.StatusUnauthorized, "missing access token")
@@ -513,841 +1467,4233 @@ func (s *server) handleUpdateLocation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var body struct {
-		Lat  float64 `json:"lat"`
-		Long float64 `json:"long"`
+		Interests string `json:"interests"`
+		Mode      string `json:"mode"`
 	}
-
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid json body")
+		writeBodyError(w, err)
 		return
 	}
-	if body.Lat == 0 && body.Long == 0 {
-		writeError(w, http.StatusBadRequest, "lat/long required")
+
+	mode := body.Mode
+	if q := r.URL.Query().Get("mode"); q != "" {
+		mode = q
+	}
+	switch mode {
+	case "", "replace", "append":
+	default:
+		writeError(w, http.StatusBadRequest, "mode must be append or replace")
+		return
+	}
+
+	if _, ok := s.users.get(ctx, userID); !ok {
+		writeError(w, http.StatusNotFound, "user not cached")
+		return
+	}
+
+	var interests string
+	tooLong := false
+	s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
+		combined := body.Interests
+		if mode == "append" {
+			combined = u.Interests + "," + body.Interests
+		}
+		interests = normalizeInterests(combined)
+		if len(interests) > maxInterestsLen {
+			tooLong = true
+			return u
+		}
+		u.Interests = interests
+		return u
+	})
+	if tooLong {
+		writeError(w, http.StatusBadRequest, interestsTooLongMsg)
 		return
 	}
 
-	s.users.updateLocation(userID, body.Lat, body.Long)
+	if tweets := s.tweets.get(userID); len(tweets) > 0 {
+		go s.callXAIAnalysis(ctx, userID, tweets)
+	}
+
 	writeJSON(w, http.StatusOK, map[string]any{
-		"lat":  body.Lat,
-		"long": body.Long,
+		"interests": interests,
 	})
 }
 
-func newStateStore(ttl time.Duration) *stateStore {
-	return &stateStore{
-		ttl:    ttl,
-		values: make(map[string]stateEntry),
+// handleDeleteMe erases the user's profile, tweets, tokens, matches in both
+// directions and stored avatar, then clears the session cookie. Only the
+// current avatar is known, so ones replaced by earlier analyses stay in the
+// blobstore. Reports are kept on
+// purpose: those about the user keep a reported account hidden if it logs
+// in again, and those it filed still count toward other users' thresholds.
+func (s *server) handleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := s.resolveAccessToken(r)
+	if userID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
 	}
-}
 
-func (s *stateStore) put(state, verifier string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.cleanupLocked()
-	s.values[state] = stateEntry{
-		verifier:  verifier,
-		expiresAt: time.Now().Add(s.ttl),
+	if u, ok := s.users.get(ctx, userID); ok && s.avatars != nil && u.BgImage != "" {
+		if err := s.avatars.Delete(ctx, u.BgImage); err != nil {
+			logError(r, "avatar delete failed", err)
+		}
 	}
+	s.matcher.RemoveUserMatches(ctx, userID)
+	s.tweets.delete(userID)
+	s.tokens.delete(ctx, userID)
+	s.suggestions.delete(userID)
+	s.users.delete(ctx, userID)
+	s.deleted.add(ctx, userID)
+	log.Printf("req_id=%s user data deleted user=%s", middleware.GetReqID(r.Context()), userID)
+
+	cookie := s.sessionCookie("", time.Unix(0, 0))
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 }
 
-func (s *stateStore) pop(state string) (string, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.cleanupLocked()
-	entry, ok := s.values[state]
-	if !ok {
-		return "", false
-	}
-	delete(s.values, state)
-	if time.Now().After(entry.expiresAt) {
-		return "", false
+func (s *server) handleUpdateLocation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := s.resolveAccessToken(r)
+	if userID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
 	}
-	return entry.verifier, true
-}
 
-func (s *stateStore) cleanupLocked() {
-	now := time.Now()
-	for key, entry := range s.values {
-		if now.After(entry.expiresAt) {
-			delete(s.values, key)
-		}
+	var body struct {
+		Lat  float64 `json:"lat"`
+		Long float64 `json:"long"`
 	}
-}
 
-func randomString(length int) (string, error) {
-	raw := make([]byte, length)
-	if _, err := rand.Read(raw); err != nil {
-		return "", err
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Lat == 0 && body.Long == 0 {
+		writeError(w, http.StatusBadRequest, "lat/long required")
+		return
 	}
-	return base64.RawURLEncoding.EncodeToString(raw), nil
-}
-
-func pkceChallenge(verifier string) string {
-	sum := sha256.Sum256([]byte(verifier))
-	return base64.RawURLEncoding.EncodeToString(sum[:])
-}
 
-type userProfile struct {
-	ID              string   `json:"id"`
-	Name            string   `json:"name"`
-	Username        string   `json:"username"`
-	ProfileImageURL string   `json:"profile_image_url,omitempty"`
-	Lat             float64  `json:"lat,omitempty"`
-	Long            float64  `json:"long,omitempty"`
-	Summary         string   `json:"summary,omitempty"`
-	BgImage         string   `json:"bg_image,omitempty"`
-	Tweets          []string `json:"tweets,omitempty"`
-	Interests       string   `json:"interests,omitempty"`
-	MatchingScore   float64  `json:"matching_score,omitempty"`
-	Description     string   `json:"description,omitempty"`
+	s.users.updateLocation(ctx, userID, body.Lat, body.Long)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"lat":  body.Lat,
+		"long": body.Long,
+	})
 }
 
-type UserStore interface {
-	upsert(u userProfile)
-	get(userID string) (userProfile, bool)
-	top(n int) []userProfile
-	getAllAsInputs() []matching.UserInput
-	updateXAIData(userID, summary, imageURL string, score float64)
-	updateLocation(userID string, lat, long float64)
-	updateProfile(userID string, mutate func(userProfile) userProfile)
-	loadFromFile(path string) error
-	getRawMap() map[string]userProfile // helper for seeding logic access if needed, or refactor seeding
+// geoLocatable reports whether u's location may come from geo headers: it
+// has none yet, or only a previous geoip one. Older records with a location
+// but no source were set by the user.
+func geoLocatable(u userProfile) bool {
+	return u.LocationSource == locationSourceGeoIP || (u.Lat == 0 && u.Long == 0)
 }
 
-// memoryUserStore implementation
-type memoryUserStore struct {
-	mu   sync.Mutex
-	lim  int
-	data map[string]userProfile
+// geoLocation reads the approximate coordinates a CDN put in the configured
+// GEO_LAT_HEADER and GEO_LONG_HEADER. ok is false when geo headers are off,
+// missing or out of range.
+func (s *server) geoLocation(r *http.Request) (lat, long float64, ok bool) {
+	if s.config.GeoLatHeader == "" || s.config.GeoLongHeader == "" {
+		return 0, 0, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(r.Header.Get(s.config.GeoLatHeader)), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	long, err = strconv.ParseFloat(strings.TrimSpace(r.Header.Get(s.config.GeoLongHeader)), 64)
+	if err != nil || long < -180 || long > 180 {
+		return 0, 0, false
+	}
+	// 0,0 means "not set" elsewhere, so it can't be stored.
+	if lat == 0 && long == 0 {
+		return 0, 0, false
+	}
+	return lat, long, true
 }
 
-func (s *memoryUserStore) getRawMap() map[string]userProfile {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.data
-}
+func (s *server) handleSuggestedInterests(w http.ResponseWriter, r *http.Request) {
+	userID := s.resolveAccessToken(r)
+	if userID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
 
-func (s *server) handleDebugFlush(w http.ResponseWriter, r *http.Request) {
-	var client *redis.Client
+	if cached, ok := s.suggestions.get(userID); ok {
+		writeSuggestions(w, cached)
+		return
+	}
 
-	if rs, ok := s.users.(*redisUserStore); ok {
-		client = rs.client
-	} else if ts, ok := s.tokens.(*redisTokenStore); ok {
-		client = ts.client
+	if s.config.XAiAPIKey == "" {
+		writeError(w, http.StatusServiceUnavailable, "ai not configured")
+		return
 	}
 
-	if client == nil {
-		writeError(w, http.StatusBadRequest, "server not running in redis mode")
+	tweets := s.tweets.get(userID)
+	if len(tweets) == 0 {
+		writeError(w, http.StatusNotFound, "no cached tweets to analyze")
 		return
 	}
 
-	if err := client.FlushAll(r.Context()).Err(); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to flush redis: %v", err))
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	suggested, err := s.suggestInterests(ctx, tweets)
+	if err != nil {
+		logError(r, "interest suggestion failed", err)
+		writeError(w, http.StatusBadGateway, "interest suggestion failed")
 		return
 	}
 
-	log.Printf("redis flushed via debug endpoint")
-	writeJSON(w, http.StatusOK, map[string]string{"status": "flushed"})
+	s.suggestions.put(userID, suggested)
+	writeSuggestions(w, suggested)
 }
 
-type redisUserStore struct {
-	client *redis.Client
+func writeSuggestions(w http.ResponseWriter, suggested []string) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"suggestions": suggested,
+		"interests":   strings.Join(suggested, ", "),
+	})
 }
 
-func (s *redisUserStore) getRawMap() map[string]userProfile {
-	return nil // not supported in redis mode effectively or implemented differently
-}
+func (s *server) suggestInterests(ctx context.Context, tweets []string) ([]string, error) {
+	tweets = sanitizeTweets(tweets)
+	limit := min(50, len(tweets))
+	prompt := fmt.Sprintf(`Based on the following tweets, list the user's main interests.
+- %s
 
-type tokenInfo struct {
-	UserID       string    `json:"user_id"`
-	AccessToken  string    `json:"access_token"`
-	RefreshToken string    `json:"refresh_token"`
-	Expiry       time.Time `json:"expiry"`
+Return at most 8 short interests (1-3 words each) as a comma-separated list.
+Output purely JSON in the following format:
+{"interests": "hiking, jazz, machine learning"}`, strings.Join(tweets[:limit], "\n- "))
+
+	resp, err := s.aiClient.CreateChatCompletion(ctx, xai.ChatRequest{
+		Model: s.config.defaultModel(),
+		Messages: []xai.Message{
+			{Role: "user", Content: prompt},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("xai suggest interests trace_id=%s response_id=%s", xai.TraceID(ctx), resp.ID)
+	content, err := xai.FirstChoiceContent(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var out struct {
+		Interests string `json:"interests"`
+	}
+	if err := json.Unmarshal([]byte(xai.ExtractJSON(content)), &out); err != nil {
+		return nil, err
+	}
+	return splitInterests(out.Interests, 8), nil
 }
 
-type tokenStore interface {
-	upsert(userID string, token tokenInfo)
-	get(userID string) (tokenInfo, bool)
+// splitInterests tokenizes a comma-separated interest list, trimming blanks,
+// collapsing inner whitespace and dropping case-insensitive duplicates while
+// keeping the first spelling.
+func splitInterests(raw string, limit int) []string {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.Join(strings.Fields(part), " ")
+		key := strings.ToLower(part)
+		if part == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, part)
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+	}
+	return out
 }
 
-type memoryTokenStore struct {
-	mu   sync.Mutex
-	lim  int
-	data map[string]tokenInfo
+// normalizeInterests rewrites an interest list into the stored display form:
+// "  Go,ai ,, Machine   learning" becomes "Go, ai, Machine learning".
+func normalizeInterests(raw string) string {
+	return strings.Join(splitInterests(raw, 0), ", ")
 }
 
-type redisTokenStore struct {
-	client      *redis.Client
-	ttlFallback time.Duration
+// interestTokens returns the lowercase interest tokens used for matching.
+func interestTokens(raw string) []string {
+	tokens := splitInterests(raw, 0)
+	for i, t := range tokens {
+		tokens[i] = strings.ToLower(t)
+	}
+	return tokens
 }
 
-type tweetStore struct {
-	mu          sync.Mutex
-	lim         int
-	data        map[string][]string
-	lastFetched map[string]time.Time
+// availabilityWindow is a weekly slot, in the user's timezone, when they are
+// free to meet. Times are "HH:MM"; End may be "24:00".
+type availabilityWindow struct {
+	Day   string `json:"day"`
+	Start string `json:"start"`
+	End   string `json:"end"`
 }
 
-func newUserStore(cfg *Config) UserStore {
-	if cfg.Persistence == "redis" && cfg.RedisAddr != "" {
-		opts := &redis.Options{
-			Addr:     cfg.RedisAddr,
-			Password: cfg.RedisPassword,
-			DB:       cfg.RedisDB,
-			TLSConfig: func() *tls.Config {
-				if cfg.RedisTLS {
-					return &tls.Config{InsecureSkipVerify: false}
-				}
-				return nil
-			}(),
-		}
-		client := redis.NewClient(opts)
-		// No strict ping here to allow fallback logic in other places or lazy connect,
-		// but consistent with token store, we return redis store.
-		return &redisUserStore{client: client}
-	}
+const maxAvailabilityWindows = 28
 
-	return &memoryUserStore{
-		lim:  50,
-		data: make(map[string]userProfile),
+var weekdays = map[string]int{"mon": 0, "tue": 1, "wed": 2, "thu": 3, "fri": 4, "sat": 5, "sun": 6}
+
+// optionalString tells a JSON field that was left out (Set is false) from
+// one sent as a string or null, which leaves Value empty.
+type optionalString struct {
+	Set   bool
+	Value string
+}
+
+func (o *optionalString) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Value = ""
+		return nil
 	}
+	return json.Unmarshal(data, &o.Value)
 }
 
-func newMemoryTokenStore(limit int) *memoryTokenStore {
-	return &memoryTokenStore{
-		lim:  limit,
-		data: make(map[string]tokenInfo),
+// validateTimezone accepts empty (no timezone) or an IANA zone name. "Local"
+// is rejected since it means the server's zone, not the user's.
+func validateTimezone(tz string) error {
+	if tz == "" {
+		return nil
+	}
+	if tz == "Local" {
+		return fmt.Errorf("invalid timezone %q", tz)
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return fmt.Errorf("invalid timezone %q", tz)
 	}
+	return nil
 }
 
-func newTokenStoreFromConfig(cfg *Config) tokenStore {
-	if cfg.Persistence == "redis" && cfg.RedisAddr != "" {
-		opts := &redis.Options{
-			Addr:     cfg.RedisAddr,
-			Password: cfg.RedisPassword,
-			DB:       cfg.RedisDB,
-			TLSConfig: func() *tls.Config {
-				if cfg.RedisTLS {
-					return &tls.Config{InsecureSkipVerify: false} // use defaults
-				}
-				return nil
-			}(),
+func validateAvailability(windows []availabilityWindow) error {
+	if len(windows) > maxAvailabilityWindows {
+		return fmt.Errorf("too many availability windows (max %d)", maxAvailabilityWindows)
+	}
+	for _, w := range windows {
+		if _, ok := weekdays[strings.ToLower(w.Day)]; !ok {
+			return fmt.Errorf("invalid availability day %q (want mon..sun)", w.Day)
 		}
-		client := redis.NewClient(opts)
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		if err := client.Ping(ctx).Err(); err != nil {
-			log.Printf("redis ping failed, falling back to memory: %v", err)
-		} else {
-			log.Printf("using redis persistence at %s db=%d tls=%t", cfg.RedisAddr, cfg.RedisDB, cfg.RedisTLS)
-			return &redisTokenStore{client: client, ttlFallback: cfg.JWTTTL}
+		start, err := parseClock(w.Start)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(w.End)
+		if err != nil {
+			return err
+		}
+		if end <= start {
+			return fmt.Errorf("availability window %s %s-%s must end after it starts", w.Day, w.Start, w.End)
 		}
 	}
+	return nil
+}
 
-	log.Printf("using in-memory token store (persistence=%s)", cfg.Persistence)
-	return newMemoryTokenStore(200)
+// parseClock converts "HH:MM" to minutes after midnight.
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if v == "24:00" {
+		return 24 * 60, nil
+	}
+	return 0, fmt.Errorf("invalid availability time %q (want HH:MM)", v)
 }
 
-func newTweetStore(limit int) *tweetStore {
-	return &tweetStore{
-		lim:         limit,
-		data:        make(map[string][]string),
-		lastFetched: make(map[string]time.Time),
+// sharedAvailability reports whether two users have overlapping windows in
+// the week containing now. Users without a timezone have no windows.
+func sharedAvailability(a, b userProfile, now time.Time) bool {
+	aw, bw := availabilitySpans(a, now), availabilitySpans(b, now)
+	week := 7 * 24 * time.Hour
+	for _, x := range aw {
+		for _, y := range bw {
+			// The two zones may disagree on which week now falls in, so also
+			// compare against b's windows a week either side.
+			for _, shift := range []time.Duration{-week, 0, week} {
+				if x[0].Before(y[1].Add(shift)) && y[0].Add(shift).Before(x[1]) {
+					return true
+				}
+			}
+		}
 	}
+	return false
 }
 
-func (s *memoryUserStore) upsert(u userProfile) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if u.MatchingScore == 0 {
-		u.MatchingScore = defaultScore(u.ID)
+// availabilitySpans resolves a user's windows to absolute times in the week
+// containing now, so zone offsets (including DST) are applied.
+func availabilitySpans(u userProfile, now time.Time) [][2]time.Time {
+	if u.Timezone == "" || len(u.Availability) == 0 {
+		return nil
 	}
-	if u.Description == "" && u.Username != "" {
-		u.Description = fmt.Sprintf("X user @%s", u.Username)
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return nil
 	}
-	s.data[u.ID] = u
-	if len(s.data) > s.lim {
-		// trim oldest by deleting arbitrary entries when limit exceeded
-		for k := range s.data {
-			delete(s.data, k)
-			if len(s.data) <= s.lim {
-				break
-			}
+	local := now.In(loc)
+	sinceMonday := (int(local.Weekday()) + 6) % 7
+	monday := time.Date(local.Year(), local.Month(), local.Day()-sinceMonday, 0, 0, 0, 0, loc)
+
+	spans := make([][2]time.Time, 0, len(u.Availability))
+	for _, w := range u.Availability {
+		day, ok := weekdays[strings.ToLower(w.Day)]
+		start, err1 := parseClock(w.Start)
+		end, err2 := parseClock(w.End)
+		if !ok || err1 != nil || err2 != nil || end <= start {
+			continue
 		}
+		date := monday.AddDate(0, 0, day)
+		spans = append(spans, [2]time.Time{
+			time.Date(date.Year(), date.Month(), date.Day(), 0, start, 0, 0, loc),
+			time.Date(date.Year(), date.Month(), date.Day(), 0, end, 0, 0, loc),
+		})
 	}
+	return spans
 }
 
-func (s *redisUserStore) upsert(u userProfile) {
-	ctx := context.Background()
-	data, _ := json.Marshal(u)
-	s.client.Set(ctx, "user:"+u.ID, data, 0)
+// suggestionCache keeps AI interest suggestions per user so repeated calls
+// don't re-spend tokens.
+type suggestionCache struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	values map[string]suggestionEntry
 }
 
-func (s *memoryUserStore) loadFromFile(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	var users []userProfile
-	if err := json.NewDecoder(f).Decode(&users); err != nil {
-		return err
-	}
+type suggestionEntry struct {
+	interests []string
+	expiresAt time.Time
+}
 
-	for _, u := range users {
-		s.upsert(u)
+func newSuggestionCache(ttl time.Duration) *suggestionCache {
+	return &suggestionCache{
+		ttl:    ttl,
+		values: make(map[string]suggestionEntry),
 	}
-	return nil
 }
 
-func (s *redisUserStore) loadFromFile(path string) error {
-	// Same logic, just calls upsert
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+func (c *suggestionCache) get(userID string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.values[userID]
+	if !ok {
+		return nil, false
 	}
-	defer f.Close()
-
-	var users []userProfile
-	if err := json.NewDecoder(f).Decode(&users); err != nil {
-		return err
+	if time.Now().After(entry.expiresAt) {
+		delete(c.values, userID)
+		return nil, false
 	}
+	return append([]string(nil), entry.interests...), true
+}
 
-	for _, u := range users {
-		s.upsert(u)
+func (c *suggestionCache) delete(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, userID)
+}
+
+func (c *suggestionCache) put(userID string, interests []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[userID] = suggestionEntry{
+		interests: append([]string(nil), interests...),
+		expiresAt: time.Now().Add(c.ttl),
 	}
-	return nil
 }
 
-func (s *memoryUserStore) top(n int) []userProfile {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	result := make([]userProfile, 0, min(n, len(s.data)))
-	for _, u := range s.data {
-		result = append(result, u)
-		if len(result) >= n {
+func (s *server) handleRecomputeMatches(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := s.resolveAccessToken(r)
+	if userID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+
+	// Look the user up first, so a request for an unknown user doesn't use
+	// up the rate limit.
+	if _, ok := s.users.get(ctx, userID); !ok {
+		writeError(w, http.StatusNotFound, "user not cached")
+		return
+	}
+
+	if ok, retryAfter := s.recompute.allow(userID); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "recompute recently requested, try again later")
+		return
+	}
+
+	s.matcher.ClearMatches(ctx, userID)
+	log.Printf("req_id=%s matches cleared for recompute user=%s", middleware.GetReqID(r.Context()), userID)
+	s.triggerMatching(ctx, userID, s.tweets.get(userID))
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "recomputing"})
+}
+
+// handleRefreshMatch recomputes the match between the viewer and one user in
+// both directions, using both users' current profiles and tweets.
+func (s *server) handleRefreshMatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+
+	targetID := chi.URLParam(r, "id")
+	if targetID == "" || targetID == viewerID {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	viewer, ok := s.users.get(ctx, viewerID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "user not cached")
+		return
+	}
+	target, ok := s.users.get(ctx, targetID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	// Key on the unordered pair so either side refreshing counts once.
+	pairKey := viewerID + "|" + targetID
+	if targetID < viewerID {
+		pairKey = targetID + "|" + viewerID
+	}
+	if ok, retryAfter := s.pairRefresh.allow(pairKey); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "match refresh recently requested, try again later")
+		return
+	}
+
+	primary := matchingInput(viewer)
+	primary.Tweets = sanitizeTweets(s.tweets.get(viewerID))
+	candidate := matchingInput(target)
+	candidate.Tweets = sanitizeTweets(s.tweets.get(targetID))
+
+	// Explain mode is for admins debugging match reasons: the viewer's side is
+	// computed now and the model's raw reply returned with it. Others asking
+	// for it get a normal refresh.
+	if explain, _ := strconv.ParseBool(r.URL.Query().Get("explain")); explain && s.isAdmin(viewerID) {
+		log.Printf("req_id=%s match explain viewer=%s target=%s", middleware.GetReqID(r.Context()), viewerID, targetID)
+		res, raw, err := s.matcher.ExplainMatch(r.Context(), primary, candidate)
+		if err != nil {
+			logError(r, "match explain failed", err)
+			writeJSON(w, http.StatusBadGateway, map[string]any{
+				"error":      fmt.Sprintf("match failed: %v", err),
+				"raw_output": raw,
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"status":     "refreshed",
+			"match":      res,
+			"raw_output": raw,
+		})
+		return
+	}
+
+	log.Printf("req_id=%s match refresh viewer=%s target=%s", middleware.GetReqID(r.Context()), viewerID, targetID)
+	s.matcher.CalculateMatchesAsync(r.Context(), primary, []matching.UserInput{candidate})
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "refreshing"})
+}
+
+// reportReasons are the accepted values for a report's reason.
+var reportReasons = map[string]bool{
+	"spam":          true,
+	"harassment":    true,
+	"impersonation": true,
+	"inappropriate": true,
+	"other":         true,
+}
+
+const maxReportTextLen = 500
+
+// userReport is one trust & safety report against a user.
+type userReport struct {
+	ReporterID string    `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	Text       string    `json:"text,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// maxLookupIDs caps how many users one /api/matches/lookup call may ask about.
+const maxLookupIDs = 100
+
+// handleMatchLookup returns the viewer's cached match for each requested
+// user id, keyed by id. Users without a cached match are left out; it never
+// calls the AI.
+func (s *server) handleMatchLookup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(body.IDs) > maxLookupIDs {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("too many ids (max %d)", maxLookupIDs))
+		return
+	}
+
+	ids := make([]string, 0, len(body.IDs))
+	seen := make(map[string]bool, len(body.IDs))
+	for _, id := range body.IDs {
+		if id == "" || id == viewerID || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	type matchInfo struct {
+		Score     float64   `json:"score"`
+		Tier      string    `json:"tier"`
+		Reason    string    `json:"reason"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	out := make(map[string]matchInfo)
+	hidden := s.hiddenUsers(ctx, ids)
+	for id, m := range s.matcher.GetMatches(ctx, viewerID, ids) {
+		if hidden[id] {
+			continue
+		}
+		out[id] = matchInfo{Score: m.Score, Tier: s.config.matchTier(m.Score), Reason: m.Reason, Timestamp: m.Timestamp}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleAdminReindex rebuilds the user and match secondary indexes from the
+// primary records, e.g. after a bulk import or a corrupted index.
+func (s *server) handleAdminReindex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	users, err := s.users.reindex(ctx)
+	if errors.Is(err, errReindexRunning) {
+		writeError(w, http.StatusConflict, "reindex already running")
+		return
+	}
+	if err != nil {
+		logError(r, "user reindex failed", err)
+		writeError(w, http.StatusInternalServerError, "user reindex failed")
+		return
+	}
+	matches, err := s.matcher.Reindex(ctx)
+	if errors.Is(err, matching.ErrReindexRunning) {
+		writeError(w, http.StatusConflict, "reindex already running")
+		return
+	}
+	if err != nil {
+		logError(r, "match reindex failed", err)
+		writeError(w, http.StatusInternalServerError, "match reindex failed")
+		return
+	}
+	log.Printf("req_id=%s reindexed users=%d matches=%d", middleware.GetReqID(r.Context()), users, matches)
+	writeJSON(w, http.StatusOK, map[string]int{"users": users, "matches": matches})
+}
+
+// handleMyStats summarizes the viewer's matches: how many, their average
+// score, how many are mutual and the interests most often shared.
+func (s *server) handleMyStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.matcher.ViewerStats(ctx, viewerID))
+}
+
+// handleMatchedBy lists users whose own match with the viewer scored highly,
+// whether or not they are among the viewer's top matches.
+func (s *server) handleMatchedBy(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+	limit, err := s.config.limitParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Without ?min_score=, only strong matches count as interest.
+	minScore := s.config.matchStrongScore()
+	if raw := r.URL.Query().Get("min_score"); raw != "" {
+		minScore, err = strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(minScore) || math.IsInf(minScore, 0) {
+			writeError(w, http.StatusBadRequest, "invalid min_score")
+			return
+		}
+	}
+
+	type matchedBy struct {
+		UserID       string  `json:"user_id"`
+		Name         string  `json:"name,omitempty"`
+		Username     string  `json:"username,omitempty"`
+		ProfileImage string  `json:"profile_image_url,omitempty"`
+		Score        float64 `json:"score"`
+	}
+	// Hidden and deleted viewers are only dropped after the fetch, so fetch
+	// twice the page and widen until it fills or the viewers run out.
+	var out []matchedBy
+	for fetch := 2 * limit; ; fetch *= 2 {
+		viewers := s.matcher.MatchedBy(ctx, viewerID, minScore, fetch)
+		ids := make([]string, len(viewers))
+		for i, m := range viewers {
+			ids[i] = m.ViewerID
+		}
+		hidden := s.hiddenUsers(ctx, ids)
+		users := s.users.getMany(ctx, ids)
+		out = []matchedBy{}
+		for _, m := range viewers {
+			u, ok := users[m.ViewerID]
+			if !ok || hidden[m.ViewerID] {
+				continue
+			}
+			out = append(out, matchedBy{
+				UserID:       u.ID,
+				Name:         u.Name,
+				Username:     u.Username,
+				ProfileImage: u.ProfileImageURL,
+				Score:        m.Score,
+			})
+		}
+		if len(out) >= limit || len(viewers) < fetch {
 			break
 		}
 	}
-	return result
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"users": out})
+}
+
+// handlePinMatch pins the viewer's match with a user so it leads /api/users
+// regardless of score.
+func (s *server) handlePinMatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+	targetID := chi.URLParam(r, "id")
+	if targetID == "" || targetID == viewerID {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	switch err := s.matcher.PinMatch(ctx, viewerID, targetID); {
+	case errors.Is(err, matching.ErrMatchNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, matching.ErrPinLimit):
+		writeError(w, http.StatusConflict, fmt.Sprintf("at most %d matches can be pinned", matching.MaxPinnedMatches))
+		return
+	case err != nil:
+		logError(r, "pin match failed", err)
+		writeError(w, http.StatusInternalServerError, "pin failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "pinned", "user_id": targetID})
+}
+
+// handleUnpinMatch returns a pinned match to its score-ranked place.
+func (s *server) handleUnpinMatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+	targetID := chi.URLParam(r, "id")
+	if targetID == "" || targetID == viewerID {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	s.matcher.UnpinMatch(ctx, viewerID, targetID)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "unpinned", "user_id": targetID})
+}
+
+// handleReportUser records a report against a user. Once enough distinct
+// users have reported someone they are hidden from matching and lists.
+func (s *server) handleReportUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+
+	targetID := chi.URLParam(r, "id")
+	if targetID == "" || targetID == viewerID {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	if _, ok := s.users.get(ctx, targetID); !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+		Text   string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	body.Reason = strings.ToLower(strings.TrimSpace(body.Reason))
+	if !reportReasons[body.Reason] {
+		writeError(w, http.StatusBadRequest, "reason must be one of spam, harassment, impersonation, inappropriate, other")
+		return
+	}
+	body.Text = strings.TrimSpace(body.Text)
+	if len(body.Text) > maxReportTextLen {
+		writeError(w, http.StatusBadRequest, "text too long (max 500 chars)")
+		return
+	}
+
+	if ok, retryAfter := s.reports.allow(viewerID); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "report recently submitted, try again later")
+		return
+	}
+
+	count := s.users.reportUser(ctx, targetID, userReport{
+		ReporterID: viewerID,
+		Reason:     body.Reason,
+		Text:       body.Text,
+		CreatedAt:  time.Now().UTC(),
+	})
+	log.Printf("req_id=%s user reported target=%s reporter=%s reason=%s reports=%d", middleware.GetReqID(r.Context()), targetID, viewerID, body.Reason, count)
+	if s.config.ReportHideThreshold > 0 && count == s.config.ReportHideThreshold {
+		// Drop existing matches so the user disappears from everyone's lists.
+		s.matcher.RemoveUserMatches(ctx, targetID)
+		log.Printf("req_id=%s user hidden after reports target=%s", middleware.GetReqID(r.Context()), targetID)
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "reported"})
+}
+
+// hidden reports whether a user has crossed the report threshold.
+func (s *server) hidden(ctx context.Context, userID string) bool {
+	return s.hiddenUsers(ctx, []string{userID})[userID]
+}
+
+// hiddenUsers returns which of userIDs have crossed the report threshold,
+// with one store round trip for the lot.
+func (s *server) hiddenUsers(ctx context.Context, userIDs []string) map[string]bool {
+	hidden := make(map[string]bool)
+	if s.config.ReportHideThreshold <= 0 {
+		return hidden
+	}
+	for id, n := range s.users.reportCounts(ctx, userIDs) {
+		if n >= s.config.ReportHideThreshold {
+			hidden[id] = true
+		}
+	}
+	return hidden
+}
+
+// inactive reports whether u last logged in longer than InactiveAfter ago.
+// Users with no recorded login are kept, so seeded profiles still show.
+func (s *server) inactive(u userProfile, now time.Time) bool {
+	return s.config.InactiveAfter > 0 && u.LastLoginAt != nil && now.Sub(*u.LastLoginAt) > s.config.InactiveAfter
+}
+
+// handleMatchStream computes the viewer->user match on demand and streams the
+// reason over server-sent events as the model writes it: "reason" events
+// carry JSON-encoded text pieces, then a final "done" event carries the
+// stored match (or an "error" event if it failed). Shares the per-pair limit
+// with handleRefreshMatch.
+func (s *server) handleMatchStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	viewerID := s.resolveAccessToken(r)
+	if viewerID == "" {
+		writeError(w, http.StatusUnauthorized, "missing access token")
+		return
+	}
+
+	targetID := chi.URLParam(r, "id")
+	if targetID == "" || targetID == viewerID {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	viewer, ok := s.users.get(ctx, viewerID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "user not cached")
+		return
+	}
+	target, ok := s.users.get(ctx, targetID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	pairKey := viewerID + "|" + targetID
+	if targetID < viewerID {
+		pairKey = targetID + "|" + viewerID
+	}
+	if ok, retryAfter := s.pairRefresh.allow(pairKey); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "match refresh recently requested, try again later")
+		return
+	}
+
+	primary := matchingInput(viewer)
+	primary.Tweets = sanitizeTweets(s.tweets.get(viewerID))
+	candidate := matchingInput(target)
+	candidate.Tweets = sanitizeTweets(s.tweets.get(targetID))
+
+	started := time.Now()
+	chunks, err := s.matcher.CalculateMatchStream(r.Context(), primary, candidate)
+	if err != nil {
+		logError(r, fmt.Sprintf("match stream failed viewer=%s target=%s", viewerID, targetID), err)
+		status := http.StatusBadGateway
+		if errors.Is(err, matching.ErrNoAIClient) || errors.Is(err, matching.ErrStreamingUnsupported) {
+			status = http.StatusServiceUnavailable
+		}
+		writeError(w, status, "match stream unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for chunk := range chunks {
+		writeSSE(w, "reason", chunk)
+		flusher.Flush()
+	}
+
+	// The matcher stores the result before closing the channel.
+	if m, ok := s.matcher.FindMatch(ctx, viewerID, targetID); ok && m.LastErrorAt == nil && !m.Timestamp.Before(started) {
+		writeSSE(w, "done", m)
+	} else {
+		writeSSE(w, "error", map[string]string{"error": "match calculation failed"})
+	}
+	flusher.Flush()
+}
+
+// writeSSE writes one server-sent event with v JSON-encoded as its data.
+func writeSSE(w io.Writer, event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// tombstoneTTL is how long a deleted user's id is remembered.
+const tombstoneTTL = 30 * 24 * time.Hour
+
+// tombstoneStore remembers deleted user ids for a while so lookups can tell
+// "deleted" apart from "never existed".
+type tombstoneStore interface {
+	add(ctx context.Context, id string)
+	has(ctx context.Context, id string) bool
+	// remove clears a tombstone, e.g. when a deleted user signs up again.
+	remove(ctx context.Context, id string)
+}
+
+// newTombstoneStore keeps tombstones in redis, sharing the user store's
+// client, when users live there, so every instance sees them and they
+// survive restarts; otherwise in memory.
+func newTombstoneStore(users UserStore, ttl time.Duration) tombstoneStore {
+	if rs, ok := users.(*redisUserStore); ok {
+		return &redisTombstoneStore{client: rs.client, ttl: ttl}
+	}
+	return newTombstoneSet(ttl)
+}
+
+// tombstoneSet is the in-memory tombstoneStore.
+type tombstoneSet struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	until map[string]time.Time
+}
+
+func newTombstoneSet(ttl time.Duration) *tombstoneSet {
+	return &tombstoneSet{
+		ttl:   ttl,
+		until: make(map[string]time.Time),
+	}
+}
+
+func (t *tombstoneSet) add(ctx context.Context, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, exp := range t.until {
+		if now.After(exp) {
+			delete(t.until, k)
+		}
+	}
+	t.until[id] = now.Add(t.ttl)
+}
+
+func (t *tombstoneSet) has(ctx context.Context, id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	exp, ok := t.until[id]
+	return ok && time.Now().Before(exp)
+}
+
+func (t *tombstoneSet) remove(ctx context.Context, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.until, id)
+}
+
+// redisTombstoneStore keeps each tombstone as a key that expires on its own.
+type redisTombstoneStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func tombstoneRedisKey(id string) string {
+	return "deleted:" + id
+}
+
+func (t *redisTombstoneStore) add(ctx context.Context, id string) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	if err := t.client.Set(ctx, tombstoneRedisKey(id), 1, t.ttl).Err(); err != nil {
+		log.Printf("redis tombstone add err user=%s: %v", id, err)
+	}
+}
+
+// has reports false when redis fails, so a lookup falls back to 404.
+func (t *redisTombstoneStore) has(ctx context.Context, id string) bool {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	n, err := t.client.Exists(ctx, tombstoneRedisKey(id)).Result()
+	if err != nil {
+		log.Printf("redis tombstone lookup err user=%s: %v", id, err)
+		return false
+	}
+	return n > 0
+}
+
+func (t *redisTombstoneStore) remove(ctx context.Context, id string) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	if err := t.client.Del(ctx, tombstoneRedisKey(id)).Err(); err != nil {
+		log.Printf("redis tombstone remove err user=%s: %v", id, err)
+	}
+}
+
+// rateLimiter allows one action per key within the configured interval.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// allow records an attempt for key. When the key was used within the
+// interval it returns false and the time left until the next allowed call.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, t := range l.last {
+		if now.Sub(t) >= l.interval {
+			delete(l.last, k)
+		}
+	}
+	if t, ok := l.last[key]; ok {
+		return false, l.interval - now.Sub(t)
+	}
+	l.last[key] = now
+	return true, 0
+}
+
+// defaultOAuthStateTTL is the login state lifetime when OAUTH_STATE_TTL is
+// unset.
+const defaultOAuthStateTTL = 10 * time.Minute
+
+// oauthStateTTL returns OAuthStateTTL, or the default when it is not positive.
+func (c *Config) oauthStateTTL() time.Duration {
+	if c.OAuthStateTTL <= 0 {
+		return defaultOAuthStateTTL
+	}
+	return c.OAuthStateTTL
+}
+
+// newStateStore returns a store whose entries expire after ttl. Expired
+// entries are dropped on every put and pop, and by a background sweep every
+// half ttl so they don't linger when logins stop; call stop to end it.
+func newStateStore(ttl time.Duration) *stateStore {
+	s := &stateStore{
+		ttl:    ttl,
+		values: make(map[string]stateEntry),
+		done:   make(chan struct{}),
+	}
+	if interval := ttl / 2; interval > 0 {
+		go s.sweep(interval)
+	}
+	return s
+}
+
+func (s *stateStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.cleanupLocked()
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// stop ends the background sweep. It is safe to call more than once.
+func (s *stateStore) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// size returns how many entries are held, expired or not.
+func (s *stateStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.values)
+}
+
+func (s *stateStore) put(state, verifier, returnTo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupLocked()
+	s.values[state] = stateEntry{
+		verifier:  verifier,
+		returnTo:  returnTo,
+		expiresAt: time.Now().Add(s.ttl),
+	}
+}
+
+func (s *stateStore) pop(state string) (stateEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanupLocked()
+	entry, ok := s.values[state]
+	if !ok {
+		return stateEntry{}, false
+	}
+	delete(s.values, state)
+	if time.Now().After(entry.expiresAt) {
+		return stateEntry{}, false
+	}
+	return entry, true
+}
+
+func (s *stateStore) cleanupLocked() {
+	now := time.Now()
+	for key, entry := range s.values {
+		if now.After(entry.expiresAt) {
+			delete(s.values, key)
+		}
+	}
+}
+
+func randomString(length int) (string, error) {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type userProfile struct {
+	ID              string  `json:"id"`
+	Name            string  `json:"name"`
+	Username        string  `json:"username"`
+	ProfileImageURL string  `json:"profile_image_url,omitempty"`
+	Lat             float64 `json:"lat,omitempty"`
+	Long            float64 `json:"long,omitempty"`
+	// LocationSource is "user" for a location set via /api/me/location and
+	// "geoip" for one approximated from CDN headers. Empty on older records.
+	LocationSource string   `json:"location_source,omitempty"`
+	Summary        string   `json:"summary,omitempty"`
+	BgImage        string   `json:"bg_image,omitempty"`
+	Tweets         []string `json:"tweets,omitempty"`
+	Interests      string   `json:"interests,omitempty"`
+	MatchingScore  float64  `json:"matching_score,omitempty"`
+	Description    string   `json:"description,omitempty"`
+	// Timezone is an IANA zone name; Availability windows are in that zone.
+	Timezone     string               `json:"timezone,omitempty"`
+	Availability []availabilityWindow `json:"availability,omitempty"`
+	// LastLoginAt is set on each X login; nil for users who never logged in
+	// (e.g. seeded profiles).
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	// AnalysisError and AnalysisErrorAt record the most recent analysis that
+	// produced no result; a successful analysis clears them.
+	AnalysisError   string     `json:"analysis_error,omitempty"`
+	AnalysisErrorAt *time.Time `json:"analysis_error_at,omitempty"`
+	// ScoreOverridden marks a MatchingScore set by an admin; analysis then
+	// leaves the score alone until the override is cleared.
+	ScoreOverridden bool `json:"score_overridden,omitempty"`
+	// Sources are the citations behind an AI-written Description, so the UI
+	// can show where it came from. Empty for X-provided or placeholder bios.
+	Sources []string `json:"sources,omitempty"`
+}
+
+// Values of userProfile.LocationSource.
+const (
+	locationSourceUser  = "user"
+	locationSourceGeoIP = "geoip"
+)
+
+// matchingInput converts a profile into the matcher's input, without tweets.
+func matchingInput(u userProfile) matching.UserInput {
+	// The placeholder bio says nothing about the user, so it is left out
+	// and checkMatchInputs can skip viewers with no real data.
+	description := u.Description
+	if description == placeholderDescription(u.Username) {
+		description = ""
+	}
+	return matching.UserInput{
+		ID:          u.ID,
+		Name:        u.Name,
+		Username:    u.Username,
+		Summary:     u.Summary,
+		Description: description,
+		Interests:   u.Interests,
+		// Tokens are derived on read so older, unnormalized records match too.
+		InterestTokens: interestTokens(u.Interests),
+		Score:          u.MatchingScore,
+		// updateLocation rejects 0,0, so it doubles as "not set".
+		HasLocation: u.Lat != 0 || u.Long != 0,
+		Lat:         u.Lat,
+		Long:        u.Long,
+	}
+}
+
+type UserStore interface {
+	upsert(ctx context.Context, u userProfile)
+	get(ctx context.Context, userID string) (userProfile, bool)
+	// getMany returns the stored profiles among userIDs keyed by id,
+	// leaving out unknown users.
+	getMany(ctx context.Context, userIDs []string) map[string]userProfile
+	top(ctx context.Context, n int) []userProfile
+	// topPage returns up to limit users after skipping offset, ordered by
+	// matching score desc, then id desc.
+	topPage(ctx context.Context, offset, limit int) []userProfile
+	getAllAsInputs(ctx context.Context) []matching.UserInput
+	// iterInputs calls fn with each user's matcher input, without loading
+	// the whole store at once, until fn returns false.
+	iterInputs(ctx context.Context, fn func(matching.UserInput) bool)
+	// reindex rebuilds secondary indexes from the stored profiles and
+	// returns how many users it indexed.
+	reindex(ctx context.Context) (int, error)
+	updateXAIData(ctx context.Context, userID, summary, imageURL string, score float64)
+	updateLocation(ctx context.Context, userID string, lat, long float64)
+	updateProfile(ctx context.Context, userID string, mutate func(userProfile) userProfile)
+	loadFromFile(path string) error
+	delete(ctx context.Context, userID string)
+	// reportUser stores a report and returns how many distinct users have
+	// reported userID; reportCounts returns the same count for each of
+	// userIDs, leaving out users nobody reported.
+	reportUser(ctx context.Context, userID string, report userReport) int
+	reportCounts(ctx context.Context, userIDs []string) map[string]int
+	getRawMap() map[string]userProfile // helper for seeding logic access if needed, or refactor seeding
+}
+
+// memoryUserStore implementation
+type memoryUserStore struct {
+	mu      sync.Mutex
+	lim     int
+	data    map[string]userProfile
+	reports map[string][]userReport
+}
+
+func (s *memoryUserStore) getRawMap() map[string]userProfile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data
+}
+
+func (s *server) handleDebugFlush(w http.ResponseWriter, r *http.Request) {
+	var client *redis.Client
+
+	if rs, ok := s.users.(*redisUserStore); ok {
+		client = rs.client
+	} else if ts, ok := s.tokens.(*redisTokenStore); ok {
+		client = ts.client
+	}
+
+	if client == nil {
+		writeError(w, http.StatusBadRequest, "server not running in redis mode")
+		return
+	}
+
+	// The store clients carry redisguard, which refuses FLUSHALL on
+	// purpose, so the flush goes through its own unguarded client.
+	opts := *client.Options()
+	admin := redis.NewClient(&opts)
+	defer admin.Close()
+	if err := admin.FlushAll(r.Context()).Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to flush redis: %v", err))
+		return
+	}
+
+	log.Printf("redis flushed via debug endpoint")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "flushed"})
+}
+
+// queueDegradedRatio is the matcher backlog, as a share of queue capacity,
+// at which /health reports "degraded".
+const queueDegradedRatio = 0.8
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	depth := s.matcher.QueueDepth()
+	status := "ok"
+	if capacity := s.matcher.QueueCapacity(); capacity > 0 && float64(depth) >= queueDegradedRatio*float64(capacity) {
+		status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":      status,
+		"queue_depth": depth,
+	})
+}
+
+func (s *server) handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tweets": s.tweets.Stats(),
+		"matcher": map[string]any{
+			"dropped_jobs": s.matcher.DroppedJobs(),
+		},
+	})
+}
+
+// handleDebugFlags reports the feature flags matching is running with and
+// any FLAG_* variables that were ignored.
+func (s *server) handleDebugFlags(w http.ResponseWriter, r *http.Request) {
+	unknown := s.config.UnknownFlags
+	if unknown == nil {
+		unknown = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"flags":   s.matcher.Flags(),
+		"unknown": unknown,
+	})
+}
+
+// handleAdminSetScore pins a user's MatchingScore to a curated value that
+// later analyses don't overwrite.
+func (s *server) handleAdminSetScore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := chi.URLParam(r, "id")
+	if _, ok := s.users.get(ctx, userID); !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	var body struct {
+		Score *float64 `json:"score"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if body.Score == nil || math.IsNaN(*body.Score) || *body.Score <= 0 || *body.Score > 100 {
+		writeError(w, http.StatusBadRequest, "score must be greater than 0 and at most 100")
+		return
+	}
+	score := *body.Score
+	s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
+		u.MatchingScore = score
+		u.ScoreOverridden = true
+		return u
+	})
+	log.Printf("req_id=%s admin score override user=%s score=%.1f by=%s", middleware.GetReqID(r.Context()), userID, score, s.resolveAccessToken(r))
+	writeJSON(w, http.StatusOK, map[string]any{"user_id": userID, "matching_score": score, "score_overridden": true})
+}
+
+// handleAdminClearScore drops a score override. The curated score stays until
+// the next analysis replaces it.
+func (s *server) handleAdminClearScore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := chi.URLParam(r, "id")
+	if _, ok := s.users.get(ctx, userID); !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
+		u.ScoreOverridden = false
+		return u
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"user_id": userID, "score_overridden": false})
+}
+
+// handleAdminUserPrompt returns the analysis prompt for a user and, with
+// ?target=, the match prompt against that user, built from current data.
+// It never calls the AI.
+func (s *server) handleAdminUserPrompt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := chi.URLParam(r, "id")
+	u, ok := s.users.get(ctx, userID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	type matchPrompt struct {
+		TargetID string `json:"target_id"`
+		Prompt   string `json:"prompt"`
+	}
+	resp := struct {
+		UserID string `json:"user_id"`
+		// AnalysisPrompt is empty when the user has no usable tweets, since
+		// analysis is skipped then.
+		AnalysisPrompt string       `json:"analysis_prompt"`
+		MatchPrompt    *matchPrompt `json:"match_prompt,omitempty"`
+	}{UserID: userID}
+
+	tweets := sanitizeTweets(s.tweets.get(userID))
+	if len(tweets) > 0 {
+		resp.AnalysisPrompt = buildAnalysisPrompt(s.config.AnalysisPromptTemplate, tweets, u.Interests, s.config.analysisPromptTweets())
+	}
+
+	if targetID := r.URL.Query().Get("target"); targetID != "" {
+		target, ok := s.users.get(ctx, targetID)
+		if !ok {
+			writeError(w, http.StatusNotFound, "target not found")
+			return
+		}
+		viewer := matchingInput(u)
+		viewer.Tweets = tweets
+		candidate := matchingInput(target)
+		candidate.Tweets = sanitizeTweets(s.tweets.get(targetID))
+		resp.MatchPrompt = &matchPrompt{TargetID: targetID, Prompt: s.matcher.MatchPrompt(viewer, candidate, matching.Forward)}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// requireAdmin rejects requests whose session user is not in ADMIN_USER_IDS.
+func (s *server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := s.resolveAccessToken(r)
+		if userID == "" {
+			writeError(w, http.StatusUnauthorized, "missing access token")
+			return
+		}
+		if !s.isAdmin(userID) {
+			logError(r, fmt.Sprintf("admin access denied user=%s", userID), nil)
+			writeError(w, http.StatusForbidden, "admin access required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) isAdmin(userID string) bool {
+	for _, id := range s.config.AdminIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// matchInput mirrors what the matcher sends to the AI for one user.
+type matchInput struct {
+	UserID      string   `json:"user_id"`
+	Username    string   `json:"username,omitempty"`
+	Summary     string   `json:"summary"`
+	Description string   `json:"description,omitempty"`
+	Interests   string   `json:"interests"`
+	Tweets      []string `json:"tweets"`
+}
+
+func (s *server) matchInputFor(u userProfile) matchInput {
+	tweets := sanitizeTweets(s.tweets.get(u.ID))
+	if limit := s.matcher.PromptTweetLimit(); len(tweets) > limit {
+		tweets = tweets[:limit]
+	}
+	return matchInput{
+		UserID:      u.ID,
+		Username:    u.Username,
+		Summary:     u.Summary,
+		Description: u.Description,
+		Interests:   u.Interests,
+		Tweets:      tweets,
+	}
+}
+
+// handleAdminMatch shows the cached match in both directions between two users
+// together with the inputs the matching prompt would see. It never calls the AI.
+func (s *server) handleAdminMatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	aID, bID := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+	if aID == "" || bID == "" {
+		writeError(w, http.StatusBadRequest, "a and b are required")
+		return
+	}
+	a, ok := s.users.get(ctx, aID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "user a not found")
+		return
+	}
+	b, ok := s.users.get(ctx, bID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "user b not found")
+		return
+	}
+
+	var aToB, bToA *matching.MatchResult
+	if m, ok := s.matcher.FindMatch(ctx, aID, bID); ok {
+		aToB = &m
+	}
+	if m, ok := s.matcher.FindMatch(ctx, bID, aID); ok {
+		bToA = &m
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"a_to_b": aToB,
+		"b_to_a": bToA,
+		"inputs": map[string]matchInput{
+			"a": s.matchInputFor(a),
+			"b": s.matchInputFor(b),
+		},
+	})
+}
+
+// matchesCSVFlushEvery is how many rows handleAdminMatchesCSV writes between
+// flushes to the client.
+const matchesCSVFlushEvery = 500
+
+// csvSafe keeps a text cell from being read as a formula when the export is
+// opened in a spreadsheet: cells starting with one of =, +, -, @, tab or CR
+// get a leading apostrophe. Reasons come from the model, which can be
+// steered by user-written bios and tweets.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// handleAdminMatchesCSV streams every stored match as CSV, one row per
+// direction, without buffering the whole export.
+func (s *server) handleAdminMatchesCSV(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="matches.csv"`)
+	flusher, _ := w.(http.Flusher)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"viewer_id", "target_id", "score", "reason", "timestamp"}); err != nil {
+		logError(r, "matches csv write failed", err)
+		return
+	}
+	rows := 0
+	err := s.matcher.AllMatches(ctx, func(viewerID string, m matching.MatchResult) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if err := cw.Write([]string{
+			csvSafe(viewerID),
+			csvSafe(m.TargetID),
+			strconv.FormatFloat(m.Score, 'f', -1, 64),
+			csvSafe(m.Reason),
+			m.Timestamp.UTC().Format(time.RFC3339),
+		}); err != nil {
+			return err
+		}
+		rows++
+		if rows%matchesCSVFlushEvery == 0 {
+			cw.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return cw.Error()
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		// The status line is already out, so a truncated file is all the
+		// client gets; the log says why.
+		logError(r, fmt.Sprintf("matches csv export stopped after %d rows", rows), err)
+		return
+	}
+	log.Printf("req_id=%s matches csv exported rows=%d", middleware.GetReqID(r.Context()), rows)
+}
+
+// Bounds for redis calls made by the user store, so a slow redis can't hold a
+// request (or background job) open indefinitely.
+const (
+	redisOpTimeout   = 3 * time.Second
+	redisScanTimeout = 10 * time.Second
+)
+
+const (
+	// redisScanBatch is the COUNT hint for each SCAN and the size of the
+	// MGET that follows it.
+	redisScanBatch = 500
+	// defaultRedisScanLimit is the REDIS_SCAN_LIMIT default.
+	defaultRedisScanLimit = 100000
+)
+
+type redisUserStore struct {
+	client *redis.Client
+	// readClient, when set, serves read-only lookups (e.g. a replica).
+	// Read-modify-write updates still read from client.
+	readClient *redis.Client
+	// compress gzips stored profile JSON; either form is read back.
+	compress bool
+	// scanLimit caps the user keys one scanUsers call reads; 0 means
+	// defaultRedisScanLimit.
+	scanLimit int
+}
+
+// scanUsers walks the stored profiles with SCAN, loading each batch with one
+// MGET, and stops after scanLimit keys so a single call can't walk an
+// unbounded keyspace. fn returning false stops the walk early. It reports
+// whether the limit cut the walk short.
+func (s *redisUserStore) scanUsers(ctx context.Context, client *redis.Client, fn func(u userProfile) bool) (truncated bool, err error) {
+	limit := s.scanLimit
+	if limit <= 0 {
+		limit = defaultRedisScanLimit
+	}
+	var cursor uint64
+	scanned := 0
+	for {
+		keys, next, err := client.Scan(ctx, cursor, "user:*", redisScanBatch).Result()
+		if err != nil {
+			return false, err
+		}
+		if rest := limit - scanned; len(keys) > rest {
+			keys, truncated = keys[:rest], true
+		}
+		scanned += len(keys)
+		if len(keys) > 0 {
+			vals, err := client.MGet(ctx, keys...).Result()
+			if err != nil {
+				return false, err
+			}
+			for _, v := range vals {
+				raw, ok := v.(string)
+				if !ok {
+					continue // deleted since the scan
+				}
+				var u userProfile
+				if codec.Unmarshal([]byte(raw), &u) != nil || u.ID == "" {
+					continue
+				}
+				if !fn(u) {
+					return false, nil
+				}
+			}
+		}
+		if truncated || next == 0 {
+			return truncated, nil
+		}
+		cursor = next
+	}
+}
+
+func (s *redisUserStore) reader() *redis.Client {
+	if s.readClient != nil {
+		return s.readClient
+	}
+	return s.client
+}
+
+func (s *redisUserStore) getRawMap() map[string]userProfile {
+	return nil // not supported in redis mode effectively or implemented differently
+}
+
+type tokenInfo struct {
+	UserID       string    `json:"user_id"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+type tokenStore interface {
+	upsert(ctx context.Context, userID string, token tokenInfo)
+	get(ctx context.Context, userID string) (tokenInfo, bool)
+	delete(ctx context.Context, userID string)
+}
+
+type memoryTokenStore struct {
+	mu   sync.Mutex
+	lim  int
+	data map[string]tokenInfo
+}
+
+type redisTokenStore struct {
+	client      *redis.Client
+	ttlFallback time.Duration
+}
+
+// tweet is a cached post along with the metadata X returned for it.
+type tweet struct {
+	ID        string    `json:"id,omitempty"`
+	Text      string    `json:"text"`
+	Lang      string    `json:"lang,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+type tweetStore struct {
+	mu          sync.Mutex
+	lim         int
+	data        map[string][]tweet
+	lastFetched map[string]time.Time
+	// newest is the newest tweet id seen per user, sent as since_id so the
+	// next fetch only returns newer tweets.
+	newest map[string]string
+	// maxUsers bounds how many users' tweets are cached; past it the least
+	// recently fetched user is evicted. 0 means no bound.
+	maxUsers int
+	// fetchOrder lists cached user ids, most recently fetched first, and
+	// fetchElems indexes it, so eviction takes the back without a scan.
+	fetchOrder *list.List
+	fetchElems map[string]*list.Element
+	// evicted counts users dropped to stay within maxUsers.
+	evicted uint64
+	// skipped counts fetches avoided because the user was fetched recently.
+	skipped uint64
+	// rateLimited holds when X's rate limit for each user's token resets;
+	// no fetch is attempted before then.
+	rateLimited map[string]time.Time
+}
+
+// tweetStoreStats summarizes tweet cache usage for the debug stats endpoint.
+type tweetStoreStats struct {
+	CachedUsers    int            `json:"cached_users"`
+	CachedTweets   int            `json:"cached_tweets"`
+	SkippedFetches uint64         `json:"skipped_fetches"`
+	EvictedUsers   uint64         `json:"evicted_users"`
+	FetchAges      map[string]int `json:"fetch_ages"`
+	OldestFetchAge string         `json:"oldest_fetch_age,omitempty"`
+	NewestFetchAge string         `json:"newest_fetch_age,omitempty"`
+}
+
+func newUserStore(cfg *Config) UserStore {
+	if cfg.Persistence == "redis" && cfg.RedisAddr != "" {
+		opts := &redis.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+			TLSConfig: func() *tls.Config {
+				if cfg.RedisTLS {
+					return &tls.Config{InsecureSkipVerify: false}
+				}
+				return nil
+			}(),
+		}
+		client := redisguard.Install(redis.NewClient(opts))
+		// No strict ping here to allow fallback logic in other places or lazy connect,
+		// but consistent with token store, we return redis store.
+		store := &redisUserStore{client: client, compress: cfg.RedisCompress, scanLimit: cfg.RedisScanLimit}
+		if cfg.RedisReadAddr != "" {
+			readOpts := *opts
+			readOpts.Addr = cfg.RedisReadAddr
+			store.readClient = redisguard.Install(redis.NewClient(&readOpts))
+		}
+		return store
+	}
+
+	return &memoryUserStore{
+		lim:  50,
+		data: make(map[string]userProfile),
+	}
+}
+
+func newMemoryTokenStore(limit int) *memoryTokenStore {
+	return &memoryTokenStore{
+		lim:  limit,
+		data: make(map[string]tokenInfo),
+	}
+}
+
+func newTokenStoreFromConfig(cfg *Config) tokenStore {
+	if cfg.Persistence == "redis" && cfg.RedisAddr != "" {
+		opts := &redis.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+			TLSConfig: func() *tls.Config {
+				if cfg.RedisTLS {
+					return &tls.Config{InsecureSkipVerify: false} // use defaults
+				}
+				return nil
+			}(),
+		}
+		client := redisguard.Install(redis.NewClient(opts))
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		if err := client.Ping(ctx).Err(); err != nil {
+			log.Printf("redis ping failed, falling back to memory: %v", err)
+		} else {
+			log.Printf("using redis persistence at %s db=%d tls=%t", cfg.RedisAddr, cfg.RedisDB, cfg.RedisTLS)
+			return &redisTokenStore{client: client, ttlFallback: cfg.JWTTTL}
+		}
+	}
+
+	log.Printf("using in-memory token store (persistence=%s)", cfg.Persistence)
+	return newMemoryTokenStore(200)
+}
+
+func newTweetStore(limit int) *tweetStore {
+	return &tweetStore{
+		lim:         limit,
+		data:        make(map[string][]tweet),
+		lastFetched: make(map[string]time.Time),
+		newest:      make(map[string]string),
+		rateLimited: make(map[string]time.Time),
+		fetchOrder:  list.New(),
+		fetchElems:  make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryUserStore) upsert(ctx context.Context, u userProfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u.MatchingScore == 0 {
+		u.MatchingScore = defaultScore(u.ID)
+	}
+	if u.Description == "" && u.Username != "" {
+		u.Description = placeholderDescription(u.Username)
+	}
+	s.data[u.ID] = u
+	if len(s.data) > s.lim {
+		// trim oldest by deleting arbitrary entries when limit exceeded
+		for k := range s.data {
+			delete(s.data, k)
+			if len(s.data) <= s.lim {
+				break
+			}
+		}
+	}
+}
+
+// upsertUserScript stores a profile and its score index entry. While a
+// reindex runs (KEYS[3] names the index it is building) the entry goes into
+// that index too, so the swap keeps it.
+var upsertUserScript = redis.NewScript(`
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+local tmp = redis.call('GET', KEYS[3])
+if tmp then
+	redis.call('ZADD', tmp, ARGV[2], ARGV[3])
+	redis.call('EXPIRE', tmp, ARGV[4])
+end
+return 1
+`)
+
+// deleteUserScript removes a profile and its score index entries, including
+// the one in an index a running reindex is building.
+var deleteUserScript = redis.NewScript(`
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+local tmp = redis.call('GET', KEYS[3])
+if tmp then
+	redis.call('ZREM', tmp, ARGV[1])
+end
+return 1
+`)
+
+func (s *redisUserStore) upsert(ctx context.Context, u userProfile) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	data, _ := codec.Marshal(u, s.compress)
+	keys := []string{"user:" + u.ID, usersByScoreKey, usersReindexActiveKey}
+	score := strconv.FormatFloat(u.MatchingScore, 'f', -1, 64)
+	if err := upsertUserScript.Run(ctx, s.client, keys, data, score, u.ID, int(usersReindexTTL.Seconds())).Err(); err != nil {
+		log.Printf("redis user upsert err: %v", err)
+	}
+}
+
+func (s *memoryUserStore) loadFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var users []userProfile
+	if err := json.NewDecoder(f).Decode(&users); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		s.upsert(context.Background(), u)
+	}
+	return nil
+}
+
+func (s *redisUserStore) loadFromFile(path string) error {
+	// Same logic, just calls upsert
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var users []userProfile
+	if err := json.NewDecoder(f).Decode(&users); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		s.upsert(context.Background(), u)
+	}
+	return nil
+}
+
+func (s *memoryUserStore) top(ctx context.Context, n int) []userProfile {
+	return s.topPage(ctx, 0, n)
+}
+
+func (s *memoryUserStore) topPage(ctx context.Context, offset, limit int) []userProfile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset < 0 || limit <= 0 || offset >= len(s.data) {
+		return []userProfile{}
+	}
+	all := make([]userProfile, 0, len(s.data))
+	for _, u := range s.data {
+		all = append(all, u)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].MatchingScore != all[j].MatchingScore {
+			return all[i].MatchingScore > all[j].MatchingScore
+		}
+		return all[i].ID > all[j].ID
+	})
+	all = all[offset:]
+	return all[:min(limit, len(all))]
+}
+
+// usersByScoreKey is a sorted set of user ids scored by matching score,
+// kept in step by upsert and delete. usersByScoreBuiltKey marks that it has
+// been backfilled from every stored profile.
+const (
+	usersByScoreKey      = "users:by_score"
+	usersByScoreBuiltKey = "users:by_score:built"
+	// usersReindexActiveKey names the score index a running reindex is
+	// building, so upsert and delete keep it current.
+	usersReindexActiveKey = "reindex:users:active"
+	// usersReindexTTL expires the marker and the index being built if a
+	// reindex dies midway.
+	usersReindexTTL = time.Hour
+)
+
+// swapUserIndexScript moves a rebuilt score index (KEYS[1]) into place, or
+// clears the index if nothing was rebuilt, and ends the reindex. Doing it in
+// one step means no write lands in the temporary key after the swap.
+var swapUserIndexScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('RENAME', KEYS[1], KEYS[2])
+	redis.call('PERSIST', KEYS[2])
+else
+	redis.call('DEL', KEYS[2])
+end
+redis.call('SET', KEYS[3], '1')
+redis.call('DEL', KEYS[4])
+return 1
+`)
+
+// errReindexRunning is returned by reindex while another run is in
+// progress.
+var errReindexRunning = errors.New("a reindex is already running")
+
+func (s *redisUserStore) top(ctx context.Context, n int) []userProfile {
+	return s.topPage(ctx, 0, n)
+}
+
+func (s *redisUserStore) topPage(ctx context.Context, offset, limit int) []userProfile {
+	out := []userProfile{}
+	if offset < 0 || limit <= 0 {
+		return out
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisScanTimeout)
+	defer cancel()
+	s.ensureScoreIndex(ctx)
+	ids, err := s.reader().ZRevRange(ctx, usersByScoreKey, int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		log.Printf("redis user page err: %v", err)
+		return out
+	}
+	if len(ids) == 0 {
+		return out
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = "user:" + id
+	}
+	vals, err := s.reader().MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("redis user page err: %v", err)
+		return out
+	}
+	for _, v := range vals {
+		raw, ok := v.(string)
+		if !ok {
+			continue // deleted since the index was read
+		}
+		var u userProfile
+		if err := codec.Unmarshal([]byte(raw), &u); err != nil {
+			continue
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// ensureScoreIndex adds every stored profile to the score index once, so
+// users written before the index existed are listed too.
+func (s *redisUserStore) ensureScoreIndex(ctx context.Context) {
+	if n, err := s.client.Exists(ctx, usersByScoreBuiltKey).Result(); err != nil || n > 0 {
+		return
+	}
+	var members []redis.Z
+	truncated, err := s.scanUsers(ctx, s.client, func(u userProfile) bool {
+		members = append(members, redis.Z{Score: u.MatchingScore, Member: u.ID})
+		return true
+	})
+	if err != nil {
+		log.Printf("redis user index scan err: %v", err)
+		return
+	}
+	if len(members) > 0 {
+		if err := s.client.ZAdd(ctx, usersByScoreKey, members...).Err(); err != nil {
+			log.Printf("redis user index rebuild err: %v", err)
+			return
+		}
+	}
+	if truncated {
+		// Leave the index unmarked so the next call scans again.
+		log.Printf("redis user index rebuild stopped at REDIS_SCAN_LIMIT after %d users", len(members))
+		return
+	}
+	s.client.Set(ctx, usersByScoreBuiltKey, "1", 0)
+}
+
+// reindex has nothing to rebuild; the memory store keeps no indexes.
+func (s *memoryUserStore) reindex(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data), nil
+}
+
+// reindex rebuilds the score index under a temporary key and renames it into
+// place, so topPage never reads a half-built index. While it runs,
+// usersReindexActiveKey names the temporary key and upsert and delete update
+// it too, so live writes survive the swap. A user deleted just as the scan
+// reads them can stay listed; topPage skips ids whose profile is gone. A
+// store larger than REDIS_SCAN_LIMIT is left as it was.
+func (s *redisUserStore) reindex(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisScanTimeout)
+	defer cancel()
+	tmp := fmt.Sprintf("reindex:%d:%s", time.Now().UnixNano(), usersByScoreKey)
+	started, err := s.client.SetNX(ctx, usersReindexActiveKey, tmp, usersReindexTTL).Result()
+	if err != nil {
+		return 0, fmt.Errorf("mark reindex: %w", err)
+	}
+	if !started {
+		return 0, errReindexRunning
+	}
+	var batch []redis.Z
+	indexed := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		pipe := s.client.Pipeline()
+		pipe.ZAdd(ctx, tmp, batch...)
+		pipe.Expire(ctx, tmp, usersReindexTTL)
+		_, err := pipe.Exec(ctx)
+		batch = batch[:0]
+		return err
+	}
+	var flushErr error
+	truncated, err := s.scanUsers(ctx, s.client, func(u userProfile) bool {
+		batch = append(batch, redis.Z{Score: u.MatchingScore, Member: u.ID})
+		indexed++
+		if len(batch) >= redisScanBatch {
+			flushErr = flush()
+		}
+		return flushErr == nil
+	})
+	if err == nil {
+		err = flushErr
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err == nil && truncated {
+		err = fmt.Errorf("more than REDIS_SCAN_LIMIT (%d) users", indexed)
+	}
+	if err != nil {
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), redisOpTimeout)
+		defer cancel()
+		s.client.Del(cleanupCtx, usersReindexActiveKey, tmp)
+		return 0, fmt.Errorf("rebuild score index: %w", err)
+	}
+
+	keys := []string{tmp, usersByScoreKey, usersByScoreBuiltKey, usersReindexActiveKey}
+	if err := swapUserIndexScript.Run(ctx, s.client, keys).Err(); err != nil {
+		return 0, fmt.Errorf("swap score index: %w", err)
+	}
+	return indexed, nil
+}
+
+func (s *memoryUserStore) getAllAsInputs(ctx context.Context) []matching.UserInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]matching.UserInput, 0, len(s.data))
+	for _, u := range s.data {
+		out = append(out, matchingInput(u))
+	}
+	return out
+}
+
+// iterInputs walks a snapshot, so fn may call back into the store. The
+// memory store is capped at lim users, so the copy stays small.
+func (s *memoryUserStore) iterInputs(ctx context.Context, fn func(matching.UserInput) bool) {
+	for _, in := range s.getAllAsInputs(ctx) {
+		if !fn(in) {
+			return
+		}
+	}
+}
+
+func (s *redisUserStore) getAllAsInputs(ctx context.Context) []matching.UserInput {
+	out := []matching.UserInput{}
+	s.iterInputs(ctx, func(in matching.UserInput) bool {
+		out = append(out, in)
+		return true
+	})
+	return out
+}
+
+// iterInputs decodes one SCAN batch at a time.
+func (s *redisUserStore) iterInputs(ctx context.Context, fn func(matching.UserInput) bool) {
+	ctx, cancel := context.WithTimeout(ctx, redisScanTimeout)
+	defer cancel()
+	seen := 0
+	truncated, err := s.scanUsers(ctx, s.reader(), func(u userProfile) bool {
+		seen++
+		return fn(matchingInput(u))
+	})
+	if err != nil {
+		log.Printf("redis user scan err: %v", err)
+	} else if truncated {
+		log.Printf("redis user scan stopped at REDIS_SCAN_LIMIT after %d users", seen)
+	}
+}
+
+func (s *memoryUserStore) updateXAIData(ctx context.Context, userID, summary, imageURL string, score float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.data[userID]; ok {
+		user.Summary = summary
+		if imageURL != "" {
+			user.BgImage = imageURL
+		}
+		if !user.ScoreOverridden {
+			user.MatchingScore = score
+		}
+		s.data[userID] = user
+	}
+}
+
+func (s *redisUserStore) updateXAIData(ctx context.Context, userID, summary, imageURL string, score float64) {
+	u, ok := s.getForUpdate(ctx, userID)
+	if ok {
+		u.Summary = summary
+		if imageURL != "" {
+			u.BgImage = imageURL
+		}
+		if !u.ScoreOverridden {
+			u.MatchingScore = score
+		}
+		s.upsert(ctx, u)
+	}
+}
+
+func (s *memoryUserStore) updateLocation(ctx context.Context, userID string, lat, long float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.data[userID]; ok {
+		user.Lat = lat
+		user.Long = long
+		user.LocationSource = locationSourceUser
+		s.data[userID] = user
+	}
+}
+
+func (s *redisUserStore) updateLocation(ctx context.Context, userID string, lat, long float64) {
+	u, ok := s.getForUpdate(ctx, userID)
+	if ok {
+		u.Lat = lat
+		u.Long = long
+		u.LocationSource = locationSourceUser
+		s.upsert(ctx, u)
+	}
+}
+
+func (s *memoryUserStore) get(ctx context.Context, userID string) (userProfile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.data[userID]
+	return user, ok
+}
+
+func (s *memoryUserStore) getMany(ctx context.Context, userIDs []string) map[string]userProfile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]userProfile, len(userIDs))
+	for _, id := range userIDs {
+		if u, ok := s.data[id]; ok {
+			out[id] = u
+		}
+	}
+	return out
+}
+
+func (s *redisUserStore) get(ctx context.Context, userID string) (userProfile, bool) {
+	u, ok, err := s.lookup(ctx, userID)
+	if err != nil {
+		log.Printf("warning: redis user get err user=%s: %v", userID, err)
+	}
+	return u, ok
+}
+
+// getMany reads every profile in one MGET.
+func (s *redisUserStore) getMany(ctx context.Context, userIDs []string) map[string]userProfile {
+	out := make(map[string]userProfile, len(userIDs))
+	if len(userIDs) == 0 {
+		return out
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = "user:" + id
+	}
+	vals, err := s.reader().MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("warning: redis user get err users=%d: %v", len(userIDs), err)
+		return out
+	}
+	for i, v := range vals {
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var u userProfile
+		if err := codec.Unmarshal([]byte(raw), &u); err != nil {
+			log.Printf("warning: redis user decode err user=%s: %v", userIDs[i], err)
+			continue
+		}
+		out[userIDs[i]] = u
+	}
+	return out
+}
+
+// getForUpdate reads from the primary so updates never build on stale
+// replica data.
+func (s *redisUserStore) getForUpdate(ctx context.Context, userID string) (userProfile, bool) {
+	u, ok, err := s.lookupFrom(ctx, s.client, userID)
+	if err != nil {
+		log.Printf("warning: redis user get err user=%s: %v", userID, err)
+	}
+	return u, ok
+}
+
+// lookup distinguishes a missing user (false, nil) from a redis or decode
+// failure (false, err), so outages are not mistaken for an empty database.
+func (s *redisUserStore) lookup(ctx context.Context, userID string) (userProfile, bool, error) {
+	return s.lookupFrom(ctx, s.reader(), userID)
+}
+
+func (s *redisUserStore) lookupFrom(ctx context.Context, client *redis.Client, userID string) (userProfile, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	val, err := client.Get(ctx, "user:"+userID).Bytes()
+	if err == redis.Nil {
+		return userProfile{}, false, nil
+	}
+	if err != nil {
+		return userProfile{}, false, err
+	}
+	var u userProfile
+	if err := codec.Unmarshal(val, &u); err != nil {
+		return userProfile{}, false, fmt.Errorf("decode user %s: %w", userID, err)
+	}
+	return u, true, nil
+}
+
+func (s *memoryUserStore) delete(ctx context.Context, userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, userID)
+}
+
+func (s *redisUserStore) delete(ctx context.Context, userID string) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	keys := []string{"user:" + userID, usersByScoreKey, usersReindexActiveKey}
+	if err := deleteUserScript.Run(ctx, s.client, keys, userID).Err(); err != nil {
+		log.Printf("redis user delete err: %v", err)
+	}
+}
+
+func (s *memoryUserStore) reportUser(ctx context.Context, userID string, report userReport) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reports == nil {
+		s.reports = make(map[string][]userReport)
+	}
+	s.reports[userID] = append(s.reports[userID], report)
+	return s.reportCountLocked(userID)
+}
+
+func (s *memoryUserStore) reportCounts(ctx context.Context, userIDs []string) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int)
+	for _, id := range userIDs {
+		if n := s.reportCountLocked(id); n > 0 {
+			out[id] = n
+		}
+	}
+	return out
+}
+
+func (s *memoryUserStore) reportCountLocked(userID string) int {
+	reporters := make(map[string]bool)
+	for _, r := range s.reports[userID] {
+		reporters[r.ReporterID] = true
+	}
+	return len(reporters)
+}
+
+// Reports are kept in a list per reported user, with a set of reporter ids
+// alongside so repeat reports from one user count once.
+func (s *redisUserStore) reportUser(ctx context.Context, userID string, report userReport) int {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	data, _ := json.Marshal(report)
+	pipe := s.client.TxPipeline()
+	pipe.RPush(ctx, "reports:"+userID, data)
+	pipe.SAdd(ctx, "reporters:"+userID, report.ReporterID)
+	count := pipe.SCard(ctx, "reporters:"+userID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("redis report err: %v", err)
+		return 0
+	}
+	return int(count.Val())
+}
+
+// reportCounts reads every reporter set in one pipeline.
+func (s *redisUserStore) reportCounts(ctx context.Context, userIDs []string) map[string]int {
+	out := make(map[string]int)
+	if len(userIDs) == 0 {
+		return out
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	pipe := s.reader().Pipeline()
+	cmds := make([]*redis.IntCmd, len(userIDs))
+	for i, id := range userIDs {
+		cmds[i] = pipe.SCard(ctx, "reporters:"+id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("redis report count err: %v", err)
+		return out
+	}
+	for i, cmd := range cmds {
+		if n := cmd.Val(); n > 0 {
+			out[userIDs[i]] = int(n)
+		}
+	}
+	return out
+}
+
+func (s *memoryUserStore) updateProfile(ctx context.Context, userID string, mutate func(userProfile) userProfile) {
+	if mutate == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.data[userID]
+	if !ok {
+		return
+	}
+	user = mutate(user)
+	user.Interests = normalizeInterests(user.Interests)
+	s.data[userID] = user
+}
+
+func (s *redisUserStore) updateProfile(ctx context.Context, userID string, mutate func(userProfile) userProfile) {
+	u, ok := s.getForUpdate(ctx, userID)
+	if ok {
+		u = mutate(u)
+		u.Interests = normalizeInterests(u.Interests)
+		s.upsert(ctx, u)
+	}
+}
+
+func defaultScore(id string) float64 {
+	if id == "" {
+		return 0
+	}
+	sum := sha256.Sum256([]byte(id))
+	val := binary.BigEndian.Uint16(sum[:2])
+	return float64(val%1000) / 10 // 0.0 - 99.9
+}
+
+func (s *memoryTokenStore) upsert(ctx context.Context, userID string, token tokenInfo) {
+	if userID == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[userID] = token
+	if len(s.data) > s.lim {
+		for k := range s.data {
+			delete(s.data, k)
+			if len(s.data) <= s.lim {
+				break
+			}
+		}
+	}
+}
+
+func (s *memoryTokenStore) get(ctx context.Context, userID string) (tokenInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.data[userID]
+	return token, ok
+}
+
+func (s *memoryTokenStore) delete(ctx context.Context, userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, userID)
+}
+
+func (s *redisTokenStore) upsert(ctx context.Context, userID string, token tokenInfo) {
+	if userID == "" || s == nil || s.client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ttl := time.Until(token.Expiry)
+	if ttl <= 0 {
+		ttl = s.ttlFallback
+	}
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	payload, err := json.Marshal(token)
+	if err != nil {
+		log.Printf("redis token marshal err: %v", err)
+		return
+	}
+	if err := s.client.Set(ctx, redisTokenKey(userID), payload, ttl).Err(); err != nil {
+		log.Printf("redis token set err: %v", err)
+	}
+}
+
+func (s *redisTokenStore) get(ctx context.Context, userID string) (tokenInfo, bool) {
+	if userID == "" || s == nil || s.client == nil {
+		return tokenInfo{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	raw, err := s.client.Get(ctx, redisTokenKey(userID)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("redis token get err: %v", err)
+		}
+		return tokenInfo{}, false
+	}
+	var tok tokenInfo
+	if err := json.Unmarshal(raw, &tok); err != nil {
+		log.Printf("redis token unmarshal err: %v", err)
+		return tokenInfo{}, false
+	}
+	return tok, true
+}
+
+func (s *redisTokenStore) delete(ctx context.Context, userID string) {
+	if userID == "" || s == nil || s.client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if err := s.client.Del(ctx, redisTokenKey(userID)).Err(); err != nil {
+		log.Printf("redis token delete err: %v", err)
+	}
+}
+
+// set stores plain tweet texts (e.g. from seed data) without metadata.
+func (s *tweetStore) set(userID string, texts []string) {
+	tweets := make([]tweet, 0, len(texts))
+	for _, t := range texts {
+		tweets = append(tweets, tweet{Text: t})
+	}
+	s.setTweets(userID, tweets)
+}
+
+func (s *tweetStore) setTweets(userID string, tweets []tweet) {
+	if userID == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clone := append([]tweet(nil), tweets...)
+	sortTweetsNewestFirst(clone)
+	if len(clone) > s.lim {
+		clone = clone[:s.lim]
+	}
+	s.data[userID] = clone
+	s.touchLocked(userID)
+	s.evictLocked(userID)
+}
+
+// touchLocked records a fetch of userID now, moving it to the front of the
+// eviction order. Callers must hold s.mu.
+func (s *tweetStore) touchLocked(userID string) {
+	s.lastFetched[userID] = time.Now()
+	if e, ok := s.fetchElems[userID]; ok {
+		s.fetchOrder.MoveToFront(e)
+		return
+	}
+	s.fetchElems[userID] = s.fetchOrder.PushFront(userID)
+}
+
+// evictLocked drops the least recently fetched users until the store is
+// within maxUsers, never evicting keep. Callers must hold s.mu.
+func (s *tweetStore) evictLocked(keep string) {
+	for s.maxUsers > 0 && len(s.data) > s.maxUsers {
+		e := s.fetchOrder.Back()
+		if e == nil || e.Value.(string) == keep {
+			return
+		}
+		s.deleteLocked(e.Value.(string))
+		s.evicted++
+	}
+}
+
+// deleteLocked drops everything cached for userID. Callers must hold s.mu.
+func (s *tweetStore) deleteLocked(userID string) {
+	delete(s.data, userID)
+	delete(s.lastFetched, userID)
+	delete(s.newest, userID)
+	delete(s.rateLimited, userID)
+	if e, ok := s.fetchElems[userID]; ok {
+		s.fetchOrder.Remove(e)
+		delete(s.fetchElems, userID)
+	}
+}
+
+// get returns the cached tweet texts for userID.
+func (s *tweetStore) get(userID string) []string {
+	if userID == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return tweetTexts(s.data[userID])
+}
+
+// getTweets returns the cached tweets for userID including metadata.
+func (s *tweetStore) getTweets(userID string) []tweet {
+	if userID == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]tweet(nil), s.data[userID]...)
+}
+
+// delete drops the user's cached tweets and fetch time.
+func (s *tweetStore) delete(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteLocked(userID)
+}
+
+// backOff holds off fetches for userID until the given time. An earlier
+// time than one already set is ignored.
+func (s *tweetStore) backOff(userID string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until.After(s.rateLimited[userID]) {
+		s.rateLimited[userID] = until
+	}
+}
+
+// rateLimitedUntil returns when fetches for userID may resume, or the zero
+// time if they aren't held off.
+func (s *tweetStore) rateLimitedUntil(userID string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.rateLimited[userID]
+	if ok && !time.Now().Before(until) {
+		delete(s.rateLimited, userID)
+		return time.Time{}
+	}
+	return until
+}
+
+// sinceID returns the newest tweet id fetched for userID, or "" if the
+// user has not been fetched with ids yet.
+func (s *tweetStore) sinceID(userID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newest[userID]
+}
+
+// storeFetched caches a fetch's tweets and records newestID for the next
+// since_id fetch. A full fetch replaces the cache; an incremental one is
+// merged into it, replacing tweets with the same id. The result is capped
+// like setTweets and returned.
+func (s *tweetStore) storeFetched(userID string, fresh []tweet, newestID string, incremental bool) []tweet {
+	if userID == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merged := append(make([]tweet, 0, len(fresh)+len(s.data[userID])), fresh...)
+	if incremental {
+		seen := make(map[string]bool, len(fresh))
+		for _, t := range fresh {
+			seen[t.ID] = true
+		}
+		for _, t := range s.data[userID] {
+			if t.ID == "" || !seen[t.ID] {
+				merged = append(merged, t)
+			}
+		}
+	}
+	sortTweetsNewestFirst(merged)
+	if len(merged) > s.lim {
+		merged = merged[:s.lim]
+	}
+	s.data[userID] = merged
+	s.touchLocked(userID)
+	if newerTweetID(newestID, s.newest[userID]) {
+		s.newest[userID] = newestID
+	}
+	s.evictLocked(userID)
+	return append([]tweet(nil), merged...)
+}
+
+// newerTweetID reports whether tweet id a is newer than b. Ids are
+// snowflakes, so a longer decimal string is a larger (newer) id.
+func newerTweetID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// newestTweetID returns the largest id among tweets, or "".
+func newestTweetID(tweets []tweet) string {
+	var newest string
+	for _, t := range tweets {
+		if newerTweetID(t.ID, newest) {
+			newest = t.ID
+		}
+	}
+	return newest
+}
+
+// sortTweetsNewestFirst orders tweets by CreatedAt, newest first. Undated
+// tweets (e.g. seed data) go last; ties keep their original order.
+func sortTweetsNewestFirst(tweets []tweet) {
+	sort.SliceStable(tweets, func(i, j int) bool {
+		a, b := tweets[i].CreatedAt, tweets[j].CreatedAt
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+		return a.After(b)
+	})
+}
+
+func tweetTexts(tweets []tweet) []string {
+	if len(tweets) == 0 {
+		return nil
+	}
+	texts := make([]string, 0, len(tweets))
+	for _, t := range tweets {
+		texts = append(texts, t.Text)
+	}
+	return texts
+}
+
+var (
+	tweetURLPattern     = regexp.MustCompile(`https?://\S+`)
+	replyMentionPattern = regexp.MustCompile(`^(?:\.?@\w+\s*)+`)
+	hashtagPattern      = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+)
+
+// sanitizeTweet prepares tweet text for AI prompts: it drops links and the
+// @mentions that prefix replies, turns hashtags into plain words, unescapes
+// HTML entities and collapses whitespace. Inline mentions and emoji are kept.
+// The stored tweet keeps its raw text.
+func sanitizeTweet(text string) string {
+	text = html.UnescapeString(text)
+	text = tweetURLPattern.ReplaceAllString(text, "")
+	text = replyMentionPattern.ReplaceAllString(strings.TrimSpace(text), "")
+	text = hashtagPattern.ReplaceAllString(text, "$1")
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// sanitizeTweets applies sanitizeTweet and drops tweets left empty.
+func sanitizeTweets(texts []string) []string {
+	if len(texts) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(texts))
+	for _, t := range texts {
+		if clean := sanitizeTweet(t); clean != "" {
+			out = append(out, clean)
+		}
+	}
+	return out
+}
+
+// filterTweetsByLang keeps tweets whose lang is in allowed. Tweets X could not
+// classify ("und", or no lang at all) are kept since they can't be ruled out.
+// An empty allowed list keeps everything.
+func filterTweetsByLang(tweets []tweet, allowed []string) []tweet {
+	if len(allowed) == 0 {
+		return tweets
+	}
+	out := make([]tweet, 0, len(tweets))
+	for _, t := range tweets {
+		lang := strings.ToLower(t.Lang)
+		if lang == "" || lang == "und" {
+			out = append(out, t)
+			continue
+		}
+		for _, a := range allowed {
+			if strings.EqualFold(a, lang) {
+				out = append(out, t)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (s *tweetStore) shouldFetch(userID string, minInterval time.Duration) (bool, time.Time) {
+	if userID == "" {
+		return false, time.Time{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.lastFetched[userID]
+	if !ok {
+		return true, time.Time{}
+	}
+	if time.Since(last) <= minInterval {
+		s.skipped++
+		return false, last
+	}
+	return true, last
+}
+
+// Stats reports cache size, skipped fetches and how long ago users were
+// last fetched, bucketed by age.
+func (s *tweetStore) Stats() tweetStoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := tweetStoreStats{
+		CachedUsers:    len(s.data),
+		SkippedFetches: s.skipped,
+		EvictedUsers:   s.evicted,
+		FetchAges: map[string]int{
+			"lt_15m":  0,
+			"15m_1h":  0,
+			"1h_24h":  0,
+			"gte_24h": 0,
+		},
+	}
+	for _, tweets := range s.data {
+		stats.CachedTweets += len(tweets)
+	}
+
+	var oldest, newest time.Duration
+	first := true
+	for _, last := range s.lastFetched {
+		age := time.Since(last)
+		switch {
+		case age < 15*time.Minute:
+			stats.FetchAges["lt_15m"]++
+		case age < time.Hour:
+			stats.FetchAges["15m_1h"]++
+		case age < 24*time.Hour:
+			stats.FetchAges["1h_24h"]++
+		default:
+			stats.FetchAges["gte_24h"]++
+		}
+		if first || age > oldest {
+			oldest = age
+		}
+		if first || age < newest {
+			newest = age
+		}
+		first = false
+	}
+	if !first {
+		stats.OldestFetchAge = oldest.Round(time.Second).String()
+		stats.NewestFetchAge = newest.Round(time.Second).String()
+	}
+	return stats
+}
+
+// xAPIClient is used for X API reads; the timeout bounds calls made outside
+// a request (e.g. background tweet fetches) whose context never expires.
+var xAPIClient = &http.Client{Timeout: 20 * time.Second}
+
+// maxXResponseBytes caps an X API response body. A full page of 100 tweets
+// is well under 100KB.
+const maxXResponseBytes = 1 << 20
+
+// errXResponseTooLarge is returned by readXBody for bodies over
+// maxXResponseBytes.
+var errXResponseTooLarge = fmt.Errorf("x.com response larger than %d bytes", maxXResponseBytes)
+
+// readXBody reads an X API response body of at most maxXResponseBytes.
+func readXBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxXResponseBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	if len(body) > maxXResponseBytes {
+		return nil, fmt.Errorf("%w (status=%d)", errXResponseTooLarge, resp.StatusCode)
+	}
+	return body, nil
+}
+
+// xRateLimitLowWater is the remaining-request count at or below which a
+// user's tweet fetches wait for the rate-limit window to reset.
+const xRateLimitLowWater = 1
+
+// xRateLimit is X's rate-limit budget for the endpoint and token a
+// response came from.
+type xRateLimit struct {
+	Remaining int
+	Reset     time.Time
+}
+
+// parseXRateLimit reads the x-rate-limit-remaining and x-rate-limit-reset
+// (unix seconds) headers. ok is false unless both are present and valid.
+func parseXRateLimit(h http.Header) (rl xRateLimit, ok bool) {
+	remaining, err := strconv.Atoi(h.Get("x-rate-limit-remaining"))
+	if err != nil {
+		return rl, false
+	}
+	reset, err := strconv.ParseInt(h.Get("x-rate-limit-reset"), 10, 64)
+	if err != nil || reset <= 0 {
+		return rl, false
+	}
+	return xRateLimit{Remaining: remaining, Reset: time.Unix(reset, 0)}, true
+}
+
+// noteXRateLimit logs the budget left in an X response and, for a 429 or a
+// nearly spent budget, holds off userID's tweet fetches until the window
+// resets instead of retrying on the usual refresh interval.
+func (s *server) noteXRateLimit(userID, endpoint string, resp *http.Response) {
+	rl, ok := parseXRateLimit(resp.Header)
+	if !ok {
+		return
+	}
+	log.Printf("x rate limit endpoint=%s user=%s status=%d remaining=%d reset=%s", endpoint, userID, resp.StatusCode, rl.Remaining, rl.Reset.Format(time.RFC3339))
+	if userID == "" || !rl.Reset.After(time.Now()) {
+		return
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || rl.Remaining <= xRateLimitLowWater {
+		s.tweets.backOff(userID, rl.Reset)
+	}
+}
+
+func (s *server) fetchXUser(ctx context.Context, accessToken string) (userProfile, error) {
+	if accessToken == "" {
+		return userProfile{}, errors.New("missing access token")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.XAPIBaseURL+"/2/users/me?user.fields=profile_image_url,name,username", nil)
+	if err != nil {
+		return userProfile{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := xAPIClient.Do(req)
+	if err != nil {
+		return userProfile{}, err
+	}
+	defer resp.Body.Close()
+	// The user id isn't known until this call succeeds, so there is no one
+	// to back off; the budget is only logged.
+	s.noteXRateLimit("", "users/me", resp)
+
+	body, err := readXBody(resp)
+	if err != nil {
+		return userProfile{}, fmt.Errorf("x.com user fetch: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return userProfile{}, fmt.Errorf("x.com user fetch failed: status=%d body=%s", resp.StatusCode, string(body))
+	}
+
+	return parseXUserResponse(body)
+}
+
+// xAPIError is a single entry of the "errors" array X returns alongside
+// (or instead of) "data" when some fields could not be resolved.
+type xAPIError struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+	Type   string `json:"type"`
+}
+
+func (e xAPIError) String() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("%s: %s", e.Title, e.Detail)
+	}
+	return e.Title
+}
+
+// parseXUserResponse decodes a /2/users/me body. Optional fields (name,
+// profile image) are kept as returned; only a missing id is fatal. Entries in
+// the X "errors" array are logged and included in the error when no id came back.
+// mergeXProfile refreshes the fields X owns on a stored profile from a
+// fresh login, keeping everything the app derived or the user set: the
+// summary and score (including an admin override), interests, location,
+// availability and an AI-written bio with its sources. An X bio replaces
+// the stored one; an empty one doesn't.
+func mergeXProfile(stored, fresh userProfile) userProfile {
+	stored.Name = fresh.Name
+	stored.Username = fresh.Username
+	stored.ProfileImageURL = fresh.ProfileImageURL
+	if fresh.Description != "" {
+		stored.Description = fresh.Description
+		stored.Sources = nil
+	}
+	stored.LastLoginAt = fresh.LastLoginAt
+	return stored
+}
+
+func parseXUserResponse(body []byte) (userProfile, error) {
+	var payload struct {
+		Data   userProfile `json:"data"`
+		Errors []xAPIError `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return userProfile{}, err
+	}
+
+	details := make([]string, 0, len(payload.Errors))
+	for _, e := range payload.Errors {
+		details = append(details, e.String())
+	}
+	if len(details) > 0 {
+		log.Printf("x.com user fetch returned errors id=%s errors=%q", payload.Data.ID, details)
+	}
+
+	if payload.Data.ID == "" {
+		if len(details) > 0 {
+			return userProfile{}, fmt.Errorf("x.com user fetch error: %s", strings.Join(details, "; "))
+		}
+		return userProfile{}, errors.New("missing id in x.com response")
+	}
+	return payload.Data, nil
 }
 
-func (s *redisUserStore) top(n int) []userProfile {
-	// naive scan for now
-	ctx := context.Background()
-	keys, _ := s.client.Keys(ctx, "user:*").Result()
-	out := []userProfile{}
-	for _, k := range keys {
-		val, _ := s.client.Get(ctx, k).Bytes()
-		var u userProfile
-		json.Unmarshal(val, &u)
-		out = append(out, u)
-		if len(out) >= n {
+// fetchUserTweets keeps ctx's values, such as the login's trace id, for the
+// analysis it starts, but not its cancellation.
+func (s *server) fetchUserTweets(ctx context.Context, userID, accessToken string) {
+	if userID == "" || accessToken == "" {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if until := s.tweets.rateLimitedUntil(userID); !until.IsZero() {
+		log.Printf("fetch tweets skip user=%s rate_limited_until=%s", userID, until.Format(time.RFC3339))
+		return
+	}
+	ok, last := s.tweets.shouldFetch(userID, s.config.TweetRefreshInterval)
+	if !ok {
+		if !last.IsZero() {
+			log.Printf("fetch tweets skip user=%s recently_fetched=%s", userID, last.Format(time.RFC3339))
+		}
+		return
+	}
+	sinceID := s.tweets.sinceID(userID)
+	log.Printf("fetch tweets start user=%s since_id=%s", userID, sinceID)
+	fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	fetched, err := s.fetchTweetPages(fetchCtx, userID, accessToken, sinceID)
+	if err != nil {
+		log.Printf("fetch tweets failed user=%s: %v", userID, err)
+		// mark a fetch attempt to avoid hammering when rate limited
+		s.tweets.setTweets(userID, s.tweets.getTweets(userID))
+		return
+	}
+
+	// The newest id counts tweets the language filter drops, so they are not
+	// fetched again.
+	tweets := filterTweetsByLang(fetched, s.config.TweetLanguages)
+	log.Printf("fetched %d tweets for user=%s (kept %d after language filter)", len(fetched), userID, len(tweets))
+	incremental := sinceID != ""
+	stored := s.tweets.storeFetched(userID, tweets, newestTweetID(fetched), incremental)
+	if incremental && len(tweets) == 0 {
+		// Nothing new since the last fetch, so the last analysis still holds.
+		return
+	}
+	texts := tweetTexts(stored)
+
+	// call xai
+	go s.callXAIAnalysis(ctx, userID, texts)
+}
+
+// maxTweetPages caps how many timeline pages one fetch may request.
+const maxTweetPages = 10
+
+// fetchTweetPages follows meta.next_token until TweetFetchMax tweets or
+// maxTweetPages pages have been read. A non-empty sinceID only asks for
+// tweets newer than it. If a later page fails (e.g. a 429) the tweets
+// gathered so far are kept; only a first-page failure is an error.
+func (s *server) fetchTweetPages(ctx context.Context, userID, accessToken, sinceID string) ([]tweet, error) {
+	limit := s.config.TweetFetchMax
+	if limit <= 0 {
+		limit = 100
+	}
+
+	var out []tweet
+	paginationToken := ""
+	for page := 1; page <= maxTweetPages && len(out) < limit; page++ {
+		// X accepts max_results between 5 and 100.
+		pageSize := min(100, max(5, limit-len(out)))
+		batch, next, err := s.fetchTweetPage(ctx, userID, accessToken, pageSize, sinceID, paginationToken)
+		if err != nil {
+			if page == 1 {
+				return nil, err
+			}
+			log.Printf("fetch tweets page=%d failed user=%s, keeping %d tweets: %v", page, userID, len(out), err)
+			break
+		}
+		out = append(out, batch...)
+		if next == "" {
 			break
 		}
+		paginationToken = next
 	}
-	return out
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
 }
 
-func (s *memoryUserStore) getAllAsInputs() []matching.UserInput {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	out := make([]matching.UserInput, 0, len(s.data))
-	for _, u := range s.data {
-		out = append(out, matching.UserInput{
-			ID:        u.ID,
-			Name:      u.Name,
-			Username:  u.Username,
-			Summary:   u.Summary,
-			Interests: u.Interests,
-		})
+func (s *server) fetchTweetPage(ctx context.Context, userID, accessToken string, maxResults int, sinceID, paginationToken string) ([]tweet, string, error) {
+	q := url.Values{}
+	q.Set("max_results", strconv.Itoa(maxResults))
+	q.Set("tweet.fields", "created_at,text,lang")
+	if sinceID != "" {
+		q.Set("since_id", sinceID)
 	}
-	return out
+	if paginationToken != "" {
+		q.Set("pagination_token", paginationToken)
+	}
+	endpoint := fmt.Sprintf("%s/2/users/%s/tweets?%s", s.config.XAPIBaseURL, url.PathEscape(userID), q.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := xAPIClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	s.noteXRateLimit(userID, "users/tweets", resp)
+
+	body, err := readXBody(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status=%d body=%s", resp.StatusCode, string(body))
+	}
+
+	var payload struct {
+		Data []tweet `json:"data"`
+		Meta struct {
+			NextToken string `json:"next_token"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, "", fmt.Errorf("unmarshal: %w", err)
+	}
+	return payload.Data, payload.Meta.NextToken, nil
 }
 
-func (s *redisUserStore) getAllAsInputs() []matching.UserInput {
-	ctx := context.Background()
-	keys, _ := s.client.Keys(ctx, "user:*").Result()
-	out := []matching.UserInput{}
-	for _, k := range keys {
-		val, _ := s.client.Get(ctx, k).Bytes()
-		var u userProfile
-		json.Unmarshal(val, &u)
-		out = append(out, matching.UserInput{
-			ID:        u.ID,
-			Name:      u.Name,
-			Username:  u.Username,
-			Summary:   u.Summary,
-			Interests: u.Interests,
+// callXAIAnalysis keeps ctx's values, so its xAI calls and the matching it
+// triggers carry the trace id of the request that queued it, but outlives
+// that request's cancellation.
+func (s *server) callXAIAnalysis(ctx context.Context, userID string, tweets []string) {
+	ctx = context.WithoutCancel(ctx)
+	if s.config.XAiAPIKey == "" {
+		log.Printf("skipping xai analysis for user=%s: api key missing", userID)
+		return
+	}
+	tweets = sanitizeTweets(tweets)
+	if len(tweets) == 0 {
+		return
+	}
+
+	// Fetch user interests
+	var interests string
+	if user, ok := s.users.get(ctx, userID); ok {
+		interests = user.Interests
+	}
+	prompt := buildAnalysisPrompt(s.config.AnalysisPromptTemplate, tweets, interests, s.config.analysisPromptTweets())
+
+	// Using CreateChatCompletion as we want JSON output which is easier with standard chat.
+	// Ideally we'd use Structured Output if available, but here we'll parse the string.
+	req := xai.ChatRequest{
+		Model: s.config.defaultModel(),
+		Messages: []xai.Message{
+			{Role: "user", Content: prompt},
+		},
+		MaxTokens: max(s.config.XAIAnalysisMaxTokens, 0),
+	}
+
+	var result struct {
+		Summary string  `json:"summary"`
+		Score   float64 `json:"score"`
+	}
+	var resp *xai.ChatResponse
+	// A reply that isn't valid JSON gets one corrective reprompt.
+	for attempt := 0; ; attempt++ {
+		var err error
+		resp, err = s.aiClient.CreateChatCompletion(ctx, req)
+		if err != nil {
+			log.Printf("xai analysis failed for user=%s: %v", userID, err)
+			s.recordAnalysisFailure(ctx, userID, err)
+			return
+		}
+
+		reply, err := xai.FirstChoiceContent(resp)
+		if err != nil {
+			log.Printf("xai analysis empty reply for user=%s response_id=%s", userID, resp.ID)
+			s.recordAnalysisFailure(ctx, userID, err)
+			return
+		}
+		content := xai.ExtractJSON(reply)
+		err = json.Unmarshal([]byte(content), &result)
+		if err == nil {
+			break
+		}
+		log.Printf("xai analysis json parse failed for user=%s response_id=%s attempt=%d: %v content=%s", userID, resp.ID, attempt+1, err, content)
+		if attempt > 0 {
+			s.recordAnalysisFailure(ctx, userID, err)
+			return
+		}
+		req = xai.JSONRetryRequest(req, reply)
+	}
+
+	log.Printf("xai analysis complete for user=%s response_id=%s: score=%.1f", userID, resp.ID, result.Score)
+
+	// Generate AI Background Image based on summary
+	var imageURL string
+	if result.Summary != "" && s.config.GenerateAvatars {
+		imagePrompt := s.avatarPrompt(result.Summary)
+		img, err := s.images.GenerateImage(ctx, imagePrompt)
+		if err != nil {
+			log.Printf("xai image generation failed for user=%s: %v", userID, err)
+		} else {
+			imageURL = s.persistAvatar(userID, img)
+			log.Printf("xai image generated for user=%s: %s", userID, imageURL)
+		}
+	}
+
+	s.users.updateXAIData(ctx, userID, result.Summary, imageURL, result.Score)
+	if s.config.EnrichBios {
+		s.enrichDescription(ctx, userID)
+	}
+	if u, ok := s.users.get(ctx, userID); ok && u.AnalysisError != "" {
+		s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
+			u.AnalysisError, u.AnalysisErrorAt = "", nil
+			return u
 		})
 	}
-	return out
+
+	// After XAI analysis updates the user summary, trigger the Pairwise Matching.
+	// This ensures we have the latest summary to compare against others.
+	go s.triggerMatching(ctx, userID, tweets)
 }
 
-func (s *memoryUserStore) updateXAIData(userID, summary, imageURL string, score float64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if user, ok := s.data[userID]; ok {
-		user.Summary = summary
-		if imageURL != "" {
-			user.BgImage = imageURL
-		}
-		user.MatchingScore = score
-		s.data[userID] = user
+// placeholderDescription is the bio given to users X returned none for.
+func placeholderDescription(username string) string {
+	return fmt.Sprintf("X user @%s", username)
+}
+
+// enrichDescription replaces a missing or placeholder bio with a one-line
+// bio written from the user's public X posts, keeping the responses API's
+// citations as the profile's Sources. Users with a real bio are left alone.
+func (s *server) enrichDescription(ctx context.Context, userID string) {
+	u, ok := s.users.get(ctx, userID)
+	if !ok || u.Username == "" || (u.Description != "" && u.Description != placeholderDescription(u.Username)) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	resp, err := s.responses.GenerateResponse(ctx, xai.ResponseRequest{
+		Model: string(s.config.defaultModel()),
+		Input: []xai.Message{{
+			Role:    "user",
+			Content: fmt.Sprintf("Write a one-sentence, third-person bio for X user @%s based on their public posts. Reply with the bio only.", u.Username),
+		}},
+		Tools: []xai.ResponseTool{{Type: xai.ToolTypeXSearch}},
+	})
+	if err != nil {
+		log.Printf("bio enrichment failed for user=%s: %v", userID, err)
+		return
+	}
+	bio := strings.TrimSpace(resp.OutputText())
+	if bio == "" {
+		log.Printf("bio enrichment empty for user=%s", userID)
+		return
 	}
+	sources := resp.Citations()
+	s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
+		u.Description = bio
+		u.Sources = sources
+		return u
+	})
+	log.Printf("bio enriched for user=%s sources=%d", userID, len(sources))
 }
 
-func (s *redisUserStore) updateXAIData(userID, summary, imageURL string, score float64) {
-	u, ok := s.get(userID)
-	if ok {
-		u.Summary = summary
-		if imageURL != "" {
-			u.BgImage = imageURL
-		}
-		u.MatchingScore = score
-		s.upsert(u)
+// recordAnalysisFailure notes on the profile that the last analysis produced
+// no result, keeping any earlier summary and score.
+func (s *server) recordAnalysisFailure(ctx context.Context, userID string, err error) {
+	now := time.Now()
+	s.users.updateProfile(ctx, userID, func(u userProfile) userProfile {
+		u.AnalysisError = err.Error()
+		u.AnalysisErrorAt = &now
+		return u
+	})
+}
+
+// maxAvatarBytes caps the size of a generated image copied to storage.
+const maxAvatarBytes = 10 << 20
+
+// persistAvatar copies a generated image to the avatar blobstore and returns
+// its durable URL. Without a blobstore, or if the copy fails, the temporary
+// xAI URL is returned unchanged.
+func (s *server) persistAvatar(userID, imageURL string) string {
+	if s.avatars == nil {
+		return imageURL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	data, contentType, err := downloadImage(ctx, imageURL)
+	if err != nil {
+		log.Printf("avatar download failed for user=%s: %v", userID, err)
+		return imageURL
+	}
+	key := fmt.Sprintf("avatars/%s-%d%s", url.PathEscape(userID), time.Now().Unix(), imageExt(contentType))
+	stored, err := s.avatars.Put(ctx, key, contentType, data)
+	if err != nil {
+		log.Printf("avatar upload failed for user=%s: %v", userID, err)
+		return imageURL
 	}
+	return stored
 }
 
-func (s *memoryUserStore) updateLocation(userID string, lat, long float64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if user, ok := s.data[userID]; ok {
-		user.Lat = lat
-		user.Long = long
-		s.data[userID] = user
+// downloadImage fetches an image of at most maxAvatarBytes.
+func downloadImage(ctx context.Context, imageURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("unexpected content type %q", contentType)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxAvatarBytes {
+		return nil, "", fmt.Errorf("image larger than %d bytes", maxAvatarBytes)
+	}
+	return data, contentType, nil
+}
+
+func imageExt(contentType string) string {
+	switch strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]) {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	}
+	return ""
+}
+
+func (s *server) triggerMatching(ctx context.Context, userID string, userTweets []string) {
+	primary, candidates, ok := s.matchingInputs(ctx, userID, userTweets, s.matcher.NewSampler)
+	if !ok {
+		return
 	}
+
+	// Queue the most promising pairs first, so they are scored soonest and
+	// are the last to be dropped if the queue fills up.
+	candidates = s.matcher.RankCandidates(primary, candidates)
+	s.matcher.CalculateMatchesAsync(ctx, primary, s.withTweets(candidates))
 }
 
-func (s *redisUserStore) updateLocation(userID string, lat, long float64) {
-	u, ok := s.get(userID)
+// quickMatchWindow is how long /api/users keeps answering 202 after queueing
+// on-demand matching before it gives up and lists users unranked.
+const quickMatchWindow = time.Minute
+
+// quickMatchRetry is how often on-demand matching may be queued again for a
+// viewer who still has no matches.
+const quickMatchRetry = time.Hour
+
+// quickMatch queues matching between the viewer and the n highest-scored
+// candidates, at most once per quickMatchRetry. It returns how many
+// candidates the viewer has matches pending with, or 0 when there is no one
+// to match, matching is disabled, or the last queued run is older than
+// quickMatchWindow.
+func (s *server) quickMatch(ctx context.Context, viewerID string, n int) int {
+	if !s.matcher.HasAIClient() {
+		return 0
+	}
+	top := matching.SampleTopByScore(n)
+	primary, candidates, ok := s.matchingInputs(ctx, viewerID, nil, func(primary matching.UserInput) matching.Sampler {
+		return matching.NewSampler(top, primary)
+	})
+	if !ok {
+		return 0
+	}
+	if len(candidates) == 0 {
+		return 0
+	}
+	ok, wait := s.quickMatches.allow(viewerID)
 	if ok {
-		u.Lat = lat
-		u.Long = long
-		s.upsert(u)
+		s.matcher.CalculateMatchesAsync(ctx, primary, s.withTweets(candidates))
+	} else if quickMatchRetry-wait >= quickMatchWindow {
+		return 0
 	}
+	return len(candidates)
 }
 
-func (s *memoryUserStore) get(userID string) (userProfile, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	user, ok := s.data[userID]
-	return user, ok
+// matchingInputs builds the matcher inputs for userID and the visible
+// candidates newSampler keeps. Candidates are sampled as the store is
+// scanned, so only the sample is held in memory. Only the primary gets its
+// cached tweets; callers fill them in for the candidates they keep with
+// withTweets. userTweets stands in for the user's own tweets when none are
+// cached. ok is false when the user is unknown or hidden.
+func (s *server) matchingInputs(ctx context.Context, userID string, userTweets []string, newSampler func(primary matching.UserInput) matching.Sampler) (primary matching.UserInput, candidates []matching.UserInput, ok bool) {
+	// Reported-out users neither get matches nor appear as candidates.
+	user, found := s.users.get(ctx, userID)
+	if !found || s.hidden(ctx, userID) {
+		return primary, nil, false
+	}
+	primary = matchingInput(user)
+	sampler := newSampler(primary)
+	// Report counts are checked a batch at a time, not once per user.
+	var batch []matching.UserInput
+	addBatch := func() {
+		ids := make([]string, len(batch))
+		for i, in := range batch {
+			ids[i] = in.ID
+		}
+		hidden := s.hiddenUsers(ctx, ids)
+		for _, in := range batch {
+			if !hidden[in.ID] {
+				sampler.Add(in)
+			}
+		}
+		batch = batch[:0]
+	}
+	s.users.iterInputs(ctx, func(in matching.UserInput) bool {
+		if batch = append(batch, in); len(batch) == redisScanBatch {
+			addBatch()
+		}
+		return true
+	})
+	addBatch()
+	candidates = sampler.Candidates()
+	primary.Tweets = sanitizeTweets(s.tweets.get(userID))
+	if len(primary.Tweets) == 0 {
+		primary.Tweets = sanitizeTweets(userTweets)
+	}
+	return primary, candidates, true
+}
+
+// withTweets fills in each candidate's cached tweets.
+func (s *server) withTweets(candidates []matching.UserInput) []matching.UserInput {
+	for i := range candidates {
+		candidates[i].Tweets = sanitizeTweets(s.tweets.get(candidates[i].ID))
+	}
+	return candidates
 }
 
-func (s *redisUserStore) get(userID string) (userProfile, bool) {
-	ctx := context.Background()
-	val, err := s.client.Get(ctx, "user:"+userID).Bytes()
-	if err != nil {
-		return userProfile{}, false
+// corsOrigins splits CORS_ORIGIN into the allowed origins and reports
+// whether credentialed requests can be allowed. A wildcard anywhere in the
+// list allows every origin but no credentials, since browsers reject that
+// combination; an explicit list echoes back the matching request origin.
+func (c *Config) corsOrigins() ([]string, bool) {
+	origins := parseList(c.AllowedOrigin)
+	if len(origins) == 0 {
+		return []string{"*"}, false
+	}
+	for _, o := range origins {
+		if o == "*" {
+			return []string{"*"}, false
+		}
 	}
-	var u userProfile
-	json.Unmarshal(val, &u)
-	return u, true
+	return origins, true
 }
 
-func (s *memoryUserStore) updateProfile(userID string, mutate func(userProfile) userProfile) {
-	if mutate == nil {
-		return
-	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	user, ok := s.data[userID]
-	if !ok {
-		return
+func (c *Config) corsOptions() cors.Options {
+	origins, credentials := c.corsOrigins()
+	return cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+		AllowedHeaders:   []string{"Accept", "Accept-Version", "Authorization", "Content-Type", idempotencyKeyHeader},
+		ExposedHeaders:   []string{"X-Next-Cursor", "X-API-Version", "X-Matches-Computing", idempotentReplayHeader},
+		AllowCredentials: credentials,
+		MaxAge:           300,
 	}
-	s.data[userID] = mutate(user)
 }
 
-func (s *redisUserStore) updateProfile(userID string, mutate func(userProfile) userProfile) {
-	u, ok := s.get(userID)
-	if ok {
-		s.upsert(mutate(u))
+// defaultModel returns XAIDefaultModel, or xai.DefaultModel when unset.
+func (c *Config) defaultModel() xai.Model {
+	if c.XAIDefaultModel == "" {
+		return xai.DefaultModel
 	}
+	return xai.Model(c.XAIDefaultModel)
 }
 
-func defaultScore(id string) float64 {
-	if id == "" {
-		return 0
+// matchRoles returns the role-aware prompt roles, or nil for the symmetric
+// prompt.
+func (c *Config) matchRoles() *matching.MatchRoles {
+	if c.MatchViewerRole == "" || c.MatchCandidateRole == "" {
+		return nil
 	}
-	sum := sha256.Sum256([]byte(id))
-	val := binary.BigEndian.Uint16(sum[:2])
-	return float64(val%1000) / 10 // 0.0 - 99.9
+	return &matching.MatchRoles{Viewer: c.MatchViewerRole, Candidate: c.MatchCandidateRole}
 }
 
-func (s *memoryTokenStore) upsert(userID string, token tokenInfo) {
-	if userID == "" {
-		return
-	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.data[userID] = token
-	if len(s.data) > s.lim {
-		for k := range s.data {
-			delete(s.data, k)
-			if len(s.data) <= s.lim {
-				break
-			}
-		}
+// matchRolesName describes matchRoles for the startup summary.
+func (c *Config) matchRolesName() string {
+	if roles := c.matchRoles(); roles != nil {
+		return roles.Viewer + "->" + roles.Candidate
 	}
+	return "symmetric"
 }
 
-func (s *memoryTokenStore) get(userID string) (tokenInfo, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	token, ok := s.data[userID]
-	return token, ok
+// xaiOptions are the client options shared by every xAI client.
+func (c *Config) xaiOptions() []xai.Option {
+	return []xai.Option{
+		xai.WithMaxConcurrency(c.XAIMaxConcurrency),
+		xai.WithTraceHeader(c.XAITraceHeader),
+		xai.WithUserAgent(c.XAIUserAgent),
+		xai.WithDefaultModel(c.defaultModel()),
+	}
 }
 
-func (s *redisTokenStore) upsert(userID string, token tokenInfo) {
-	if userID == "" || s == nil || s.client == nil {
-		return
+// samplingStrategy maps MATCH_SAMPLING to a matcher strategy. "all" (or
+// empty) returns nil, meaning every candidate is matched.
+func samplingStrategy(name string, size int) (matching.SamplingStrategy, error) {
+	switch name {
+	case "", "all":
+		return nil, nil
+	case "top":
+		return matching.SampleTopByScore(size), nil
+	case "nearest":
+		return matching.SampleNearest(size), nil
+	case "random":
+		return matching.SampleRandom(size), nil
+	case "overlap":
+		return matching.SampleByInterestOverlap(size), nil
+	default:
+		return nil, fmt.Errorf("invalid MATCH_SAMPLING %q (want all, top, nearest, random or overlap)", name)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	ttl := time.Until(token.Expiry)
-	if ttl <= 0 {
-		ttl = s.ttlFallback
+}
+
+// clampLimit resolves a requested list size: absent or non-positive values
+// use DefaultPageSize and anything above MaxPageSize is capped.
+func (c *Config) clampLimit(requested int) int {
+	def, max := c.DefaultPageSize, c.MaxPageSize
+	if def <= 0 {
+		def = 5
 	}
-	if ttl <= 0 {
-		ttl = 24 * time.Hour
+	if max < def {
+		max = def
 	}
-	payload, err := json.Marshal(token)
-	if err != nil {
-		log.Printf("redis token marshal err: %v", err)
-		return
+	if requested <= 0 {
+		return def
 	}
-	if err := s.client.Set(ctx, redisTokenKey(userID), payload, ttl).Err(); err != nil {
-		log.Printf("redis token set err: %v", err)
+	if requested > max {
+		return max
 	}
+	return requested
 }
 
-func (s *redisTokenStore) get(userID string) (tokenInfo, bool) {
-	if userID == "" || s == nil || s.client == nil {
-		return tokenInfo{}, false
+// limitParam reads the optional ?limit= query parameter and clamps it.
+func (c *Config) limitParam(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("limit")
+	if raw == "" {
+		return c.clampLimit(0), nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	raw, err := s.client.Get(ctx, redisTokenKey(userID)).Bytes()
+	n, err := strconv.Atoi(raw)
 	if err != nil {
-		if err != redis.Nil {
-			log.Printf("redis token get err: %v", err)
-		}
-		return tokenInfo{}, false
-	}
-	var tok tokenInfo
-	if err := json.Unmarshal(raw, &tok); err != nil {
-		log.Printf("redis token unmarshal err: %v", err)
-		return tokenInfo{}, false
+		return 0, errors.New("invalid limit")
 	}
-	return tok, true
+	return c.clampLimit(n), nil
 }
 
-func (s *tweetStore) set(userID string, tweets []string) {
-	if userID == "" {
-		return
+// defaultProfileTweetLimit is the PROFILE_TWEET_LIMIT default.
+const defaultProfileTweetLimit = 20
+
+// tweetsParam resolves how many tweets a profile response embeds: ?tweets=
+// when given (any number; the tweet cache's own cap still applies), else
+// PROFILE_TWEET_LIMIT.
+func (c *Config) tweetsParam(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("tweets")
+	if raw == "" {
+		if c.ProfileTweetLimit <= 0 {
+			return defaultProfileTweetLimit, nil
+		}
+		return c.ProfileTweetLimit, nil
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if len(tweets) > s.lim {
-		tweets = tweets[:s.lim]
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, errors.New("tweets must be a non-negative integer")
 	}
-	clone := append([]string(nil), tweets...)
-	s.data[userID] = clone
-	s.lastFetched[userID] = time.Now()
+	return n, nil
 }
 
-func (s *tweetStore) get(userID string) []string {
-	if userID == "" {
-		return nil
+// limitTweets keeps the first n tweets, the newest ones.
+func limitTweets(tweets []string, n int) []string {
+	if len(tweets) > n {
+		return tweets[:n]
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	tweets := s.data[userID]
-	return append([]string(nil), tweets...)
+	return tweets
 }
 
-func (s *tweetStore) shouldFetch(userID string, minInterval time.Duration) (bool, time.Time) {
-	if userID == "" {
-		return false, time.Time{}
-	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	last, ok := s.lastFetched[userID]
-	if !ok {
-		return true, time.Time{}
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("json encode error: %v", err)
 	}
-	return time.Since(last) > minInterval, last
 }
 
-func (s *server) fetchXUser(ctx context.Context, accessToken string) (userProfile, error) {
-	if accessToken == "" {
-		return userProfile{}, errors.New("missing access token")
-	}
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.twitter.com/2/users/me?user.fields=profile_image_url,name,username", nil)
-	if err != nil {
-		return userProfile{}, err
+// writeBodyError reports a request body that couldn't be read or decoded:
+// 413 when it ran past limitRequestBody's cap, 400 otherwise.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large (max %d bytes)", tooLarge.Limit))
+		return
 	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	writeError(w, http.StatusBadRequest, "invalid json body")
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return userProfile{}, err
+// decodeJSONBody strictly decodes a request body holding one JSON object
+// into dst. The request must be sent as application/json and the body must
+// be non-empty, name only fields dst has, and carry nothing after the
+// object. On failure it writes a 415 or 400 and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return false
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		// encoding/json has no typed error for unknown fields, so only the
+		// field name is taken from its message, wherever it appears.
+		_, field, unknown := strings.Cut(err.Error(), "unknown field ")
+		switch {
+		case errors.Is(err, io.EOF):
+			writeError(w, http.StatusBadRequest, "request body is empty")
+		case unknown:
+			writeError(w, http.StatusBadRequest, "unknown field "+field)
+		default:
+			writeBodyError(w, err)
+		}
+		return false
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return userProfile{}, fmt.Errorf("x.com user fetch failed: status=%d body=%s", resp.StatusCode, string(body))
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "request body must contain a single JSON object")
+		return false
 	}
+	return true
+}
 
-	var payload struct {
-		Data userProfile `json:"data"`
-	}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		return userProfile{}, err
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
-	if payload.Data.ID == "" {
-		return userProfile{}, errors.New("missing id in x.com response")
+	return fallback
+}
+
+// parseList splits a comma-separated env value into trimmed, non-empty entries.
+func parseList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
 	}
-	return payload.Data, nil
+	return out
 }
 
-func (s *server) fetchUserTweets(userID, accessToken string) {
-	if userID == "" || accessToken == "" {
-		return
+func getEnvInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
 	}
-	ok, last := s.tweets.shouldFetch(userID, 15*time.Minute)
-	if !ok {
-		if !last.IsZero() {
-			log.Printf("fetch tweets skip user=%s recently_fetched=%s", userID, last.Format(time.RFC3339))
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
 		}
-		return
 	}
-	log.Printf("fetch tweets start user=%s", userID)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	return fallback
+}
 
-	url := fmt.Sprintf("https://api.twitter.com/2/users/%s/tweets?max_results=100&tweet.fields=created_at,text", userID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		log.Printf("fetch tweets build request err for user=%s: %v", userID, err)
-		return
+func getEnvBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if v == "1" || strings.ToLower(v) == "true" || strings.ToLower(v) == "yes" {
+			return true
+		}
+		if v == "0" || strings.ToLower(v) == "false" || strings.ToLower(v) == "no" {
+			return false
+		}
 	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return fallback
+}
 
-	resp, err := http.DefaultClient.Do(req)
+func logError(r *http.Request, msg string, err error) {
+	requestID := middleware.GetReqID(r.Context())
+	prefix := fmt.Sprintf("req_id=%s %s %s host=%s", requestID, r.Method, r.URL.Path, r.Host)
 	if err != nil {
-		log.Printf("fetch tweets http err for user=%s: %v", userID, err)
+		log.Printf("%s: %s: %v", prefix, msg, err)
 		return
 	}
-	defer resp.Body.Close()
+	log.Printf("%s: %s", prefix, msg)
+}
 
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("fetch tweets failed user=%s status=%d body=%s", userID, resp.StatusCode, string(body))
-		// mark a fetch attempt to avoid hammering when rate limited
-		s.tweets.set(userID, s.tweets.get(userID))
-		return
+// requestTimeout cancels the request context after d and answers 503 if the
+// handler hasn't finished by then. A non-positive d disables the limit.
+func requestTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+		th := http.TimeoutHandler(next, d, `{"error":"request timed out"}`)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// TimeoutHandler writes its body straight to w on expiry; handlers
+			// that finish in time overwrite this with their own Content-Type.
+			w.Header().Set("Content-Type", "application/json")
+			th.ServeHTTP(w, r)
+		})
 	}
+}
 
-	var payload struct {
-		Data []struct {
-			ID        string `json:"id"`
-			Text      string `json:"text"`
-			CreatedAt string `json:"created_at"`
-		} `json:"data"`
-	}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		log.Printf("fetch tweets unmarshal err for user=%s: %v", userID, err)
-		return
-	}
+// idempotencyKeyHeader is the optional request header naming a write so a
+// retried request can be recognized. Replayed responses carry
+// idempotentReplayHeader.
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotentReplayHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLen   = 255
+	// maxIdempotentBody bounds the response bodies kept for replay; larger
+	// responses are served but not remembered.
+	maxIdempotentBody = 64 << 10
+)
 
-	texts := make([]string, 0, len(payload.Data))
-	for _, t := range payload.Data {
-		texts = append(texts, t.Text)
-	}
-	log.Printf("fetched %d tweets for user=%s", len(texts), userID)
-	s.tweets.set(userID, texts)
+// idempotentResponse is a finished response kept for replay. BodyHash
+// fingerprints the request that produced it so a reused key with a
+// different body is rejected instead of replayed.
+type idempotentResponse struct {
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	BodyHash string      `json:"body_hash"`
+}
 
-	// call xai
-	go s.callXAIAnalysis(userID, texts)
+// idempotencyStore remembers keyed write responses for a short window.
+// reserve returns the stored response for a finished key, or claims the key
+// for the caller (claimed=true). A key claimed by a request still in flight
+// yields neither.
+type idempotencyStore interface {
+	reserve(key string) (resp *idempotentResponse, claimed bool, err error)
+	complete(key string, resp idempotentResponse)
+	release(key string)
 }
 
-func (s *server) callXAIAnalysis(userID string, tweets []string) {
-	if s.config.XAiAPIKey == "" {
-		log.Printf("skipping xai analysis for user=%s: api key missing", userID)
-		return
-	}
-	if len(tweets) == 0 {
-		return
-	}
+type idempotencyEntry struct {
+	resp      *idempotentResponse // nil while the request is in flight
+	expiresAt time.Time
+}
 
-	client := xai.NewClient(s.config.XAiAPIKey)
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]idempotencyEntry
+	// done stops the background sweeper.
+	done     chan struct{}
+	stopOnce sync.Once
+}
 
-	// Combine first 50 tweets for context (to fit well within prompt limits while being comprehensive)
-	limit := 50
-	if len(tweets) < limit {
-		limit = len(tweets)
+func newMemoryIdempotencyStore(ttl time.Duration) *memoryIdempotencyStore {
+	s := &memoryIdempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]idempotencyEntry),
+		done:    make(chan struct{}),
+	}
+	if interval := ttl / 2; interval > 0 {
+		go s.sweep(interval)
 	}
-	contextText := strings.Join(tweets[:limit], "\n- ")
+	return s
+}
 
-	// Fetch user interests
-	var interests string
-	if user, ok := s.users.get(userID); ok {
-		interests = user.Interests
+func (s *memoryIdempotencyStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			now := time.Now()
+			for k, e := range s.entries {
+				if now.After(e.expiresAt) {
+					delete(s.entries, k)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
 	}
+}
 
-	interestsContext := ""
-	if interests != "" {
-		interestsContext = fmt.Sprintf("\nThe user also has these stated interests: %s", interests)
+// stop ends the background sweep. It is safe to call more than once.
+func (s *memoryIdempotencyStore) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// reserve only checks the requested key's expiry; the sweeper drops the rest.
+func (s *memoryIdempotencyStore) reserve(key string) (*idempotentResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e, ok := s.entries[key]; ok && !now.After(e.expiresAt) {
+		return e.resp, false, nil
 	}
+	s.entries[key] = idempotencyEntry{expiresAt: now.Add(s.ttl)}
+	return nil, true, nil
+}
 
-	prompt := fmt.Sprintf(`Analyze the following tweets from a user:%s
-- %s
+func (s *memoryIdempotencyStore) complete(key string, resp idempotentResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = idempotencyEntry{resp: &resp, expiresAt: time.Now().Add(s.ttl)}
+}
 
-Generate a short 2-sentence summary of who they are. 
-Also provide a 'matching score' from 0-100 indicating how socially engaging they seem based on their content and interests. 
-Output purely JSON in the following format:
-{"summary": "...", "score": 85.5}`, interestsContext, contextText)
+func (s *memoryIdempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
 
-	// Using CreateChatCompletion as we want JSON output which is easier with standard chat.
-	// Ideally we'd use Structured Output if available, but here we'll parse the string.
-	req := xai.ChatRequest{
-		Model: xai.ModelGrok41Fast, // Use fast model for analysis
-		Messages: []xai.Message{
-			{Role: "user", Content: prompt},
-		},
+// redisIdempotencyStore claims keys with SET NX so retries landing on
+// different instances still see each other.
+type redisIdempotencyStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// idempotencyPending marks a claimed key whose request hasn't finished.
+const idempotencyPending = "pending"
+
+func idempotencyRedisKey(key string) string {
+	return "idempotency:" + key
+}
+
+func (s *redisIdempotencyStore) reserve(key string) (*idempotentResponse, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	rkey := idempotencyRedisKey(key)
+	claimed, err := s.client.SetNX(ctx, rkey, idempotencyPending, s.ttl).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if claimed {
+		return nil, true, nil
+	}
+	val, err := s.client.Get(ctx, rkey).Bytes()
+	if err == redis.Nil {
+		// Expired or released between the two calls; treat it as in flight
+		// rather than racing for it again.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if string(val) == idempotencyPending {
+		return nil, false, nil
+	}
+	var resp idempotentResponse
+	if err := json.Unmarshal(val, &resp); err != nil {
+		return nil, false, fmt.Errorf("decode idempotent response: %w", err)
 	}
+	return &resp, false, nil
+}
 
-	resp, err := client.CreateChatCompletion(context.Background(), req)
+func (s *redisIdempotencyStore) complete(key string, resp idempotentResponse) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	data, err := json.Marshal(resp)
+	if err == nil {
+		err = s.client.Set(ctx, idempotencyRedisKey(key), data, s.ttl).Err()
+	}
 	if err != nil {
-		log.Printf("xai analysis failed for user=%s: %v", userID, err)
-		return
+		log.Printf("idempotency: store response key=%s: %v", key, err)
+	}
+}
+
+func (s *redisIdempotencyStore) release(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := s.client.Del(ctx, idempotencyRedisKey(key)).Err(); err != nil {
+		log.Printf("idempotency: release key=%s: %v", key, err)
 	}
+}
 
-	if len(resp.Choices) == 0 {
-		return
+// newIdempotencyStore returns nil when IDEMPOTENCY_TTL disables replay.
+// With redis persistence it shares the user store's client rather than
+// opening another connection pool.
+func newIdempotencyStore(cfg *Config, users UserStore) idempotencyStore {
+	if cfg.IdempotencyTTL <= 0 {
+		return nil
+	}
+	if rs, ok := users.(*redisUserStore); ok {
+		return &redisIdempotencyStore{client: rs.client, ttl: cfg.IdempotencyTTL}
 	}
+	return newMemoryIdempotencyStore(cfg.IdempotencyTTL)
+}
+
+// idempotencyRecorder passes a response through while keeping a copy for
+// replay, up to maxIdempotentBody.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     []byte
+	overflow bool
+}
 
-	content := resp.Choices[0].Message.Content
-	// Try to find JSON block if wrapped
-	start := strings.Index(content, "{")
-	end := strings.LastIndex(content, "}")
-	if start != -1 && end != -1 && end > start {
-		content = content[start : end+1]
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
 	}
+	w.ResponseWriter.WriteHeader(status)
+}
 
-	var result struct {
-		Summary string  `json:"summary"`
-		Score   float64 `json:"score"`
+func (w *idempotencyRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
 	}
-	if err := json.Unmarshal([]byte(content), &result); err != nil {
-		log.Printf("xai analysis json parse failed for user=%s: %v content=%s", userID, err, content)
-		return
+	if !w.overflow {
+		if len(w.body)+len(p) > maxIdempotentBody {
+			w.overflow = true
+			w.body = nil
+		} else {
+			w.body = append(w.body, p...)
+		}
 	}
+	return w.ResponseWriter.Write(p)
+}
+
+// idempotent makes writes carrying an Idempotency-Key safe to retry: the
+// first response for a (user, route, key) is kept for IDEMPOTENCY_TTL and
+// replayed for repeats instead of running the handler again. Requests
+// without the header, or without a session, pass straight through. Server
+// errors and transient client errors (see retryableStatus) are not kept, so
+// those can be retried for real.
+func (s *server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || s.idempotency == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key too long")
+			return
+		}
+		userID := s.resolveAccessToken(r)
+		if userID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-	log.Printf("xai analysis complete for user=%s: score=%.1f", userID, result.Score)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeBodyError(w, err)
+				return
+			}
+			writeError(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		bodyHash := base64.RawURLEncoding.EncodeToString(sum[:])
 
-	// Generate AI Background Image based on summary
-	var imageURL string
-	if result.Summary != "" {
-		imagePrompt := fmt.Sprintf("A cool, modernistic, abstract avatar representation of a matching persona described as: %s. Cyberpunk, vaporwave, or futuristic digital art style. High quality, vibrant colors, artistic, creative composition.", result.Summary)
-		img, err := client.GenerateImage(context.Background(), imagePrompt)
+		storeKey := userID + ":" + r.Method + ":" + r.URL.Path + ":" + key
+		prev, claimed, err := s.idempotency.reserve(storeKey)
 		if err != nil {
-			log.Printf("xai image generation failed for user=%s: %v", userID, err)
-		} else {
-			imageURL = img
-			log.Printf("xai image generated for user=%s: %s", userID, imageURL)
+			// Failing open risks a double apply, which is what clients
+			// without the header already live with.
+			logError(r, "idempotency lookup failed", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !claimed {
+			if prev == nil {
+				writeError(w, http.StatusConflict, "a request with this Idempotency-Key is in progress")
+				return
+			}
+			if prev.BodyHash != bodyHash {
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was used with a different request body")
+				return
+			}
+			for name, values := range prev.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(idempotentReplayHeader, "true")
+			w.WriteHeader(prev.Status)
+			_, _ = w.Write(prev.Body)
+			return
 		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 || retryableStatus(rec.status) || rec.overflow {
+				s.idempotency.release(storeKey)
+				return
+			}
+			s.idempotency.complete(storeKey, idempotentResponse{
+				Status:   rec.status,
+				Header:   replayableHeader(w.Header()),
+				Body:     rec.body,
+				BodyHash: bodyHash,
+			})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// retryableStatus reports whether a response says nothing final about the
+// request: server errors, timeouts, conflicts and rate limiting. Replaying
+// those would keep a retried request failing after the cause has passed.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
 	}
+	return status >= http.StatusInternalServerError
+}
 
-	s.users.updateXAIData(userID, result.Summary, imageURL, result.Score)
+// replayableHeader copies the headers of a response being kept for replay,
+// minus those describing its encoding on the wire. The recorder sits above
+// gzipResponses and keeps the plain body, so a replay is encoded afresh for
+// whichever client retries.
+func replayableHeader(h http.Header) http.Header {
+	out := h.Clone()
+	out.Del("Content-Encoding")
+	out.Del("Content-Length")
+	out.Del("Vary")
+	return out
+}
 
-	// After XAI analysis updates the user summary, trigger the Pairwise Matching.
-	// This ensures we have the latest summary to compare against others.
-	go s.triggerMatching(userID, tweets)
+// apiVersion is the schema version of /api JSON responses. Bump it when a
+// response shape changes in a way clients need to know about.
+const apiVersion = "1"
+
+// apiVersionHeader stamps responses with X-API-Version. Clients may send
+// Accept-Version; every request is currently served the latest version, so
+// it is only accepted for now.
+func apiVersionHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-API-Version", apiVersion)
+		next.ServeHTTP(w, r)
+	})
 }
 
-func (s *server) triggerMatching(userID string, userTweets []string) {
-	candidates := s.users.getAllAsInputs()
+// limitRequestBody caps request bodies at maxBytes so an oversized body
+// can't exhaust memory. A declared Content-Length over the cap is refused
+// with 413 up front; otherwise reads past it fail with *http.MaxBytesError,
+// which writeBodyError turns into a 413.
+func limitRequestBody(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large (max %d bytes)", maxBytes))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-	// Populate tweets for candidates (expensive loop map lookup but ok for 50 users)
-	// Also create the 'primary' input
-	var primary matching.UserInput
+// gzipResponses compresses JSON, CSV and other text responses of at least
+// minSize bytes for clients that accept gzip. Smaller responses are sent as
+// is, and so are event streams, which must reach the client as written. A
+// negative minSize disables compression.
+func gzipResponses(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if minSize < 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+			defer gw.finish()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
 
-	// Fill tweets for candidates
-	for i := range candidates {
-		candidates[i].Tweets = s.tweets.get(candidates[i].ID)
-		if candidates[i].ID == userID {
-			primary = candidates[i]
-			// Ensure primary has the tweets we just fetched/used
-			if len(primary.Tweets) == 0 {
-				primary.Tweets = userTweets
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
 			}
 		}
+		return q > 0
 	}
+	return false
+}
+
+// gzipResponseWriter holds back the start of a response until it knows
+// whether the body reaches minSize, then sends it gzipped or as is.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
 
-	if primary.ID == "" {
-		// Should have been in the list
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
 		return
 	}
+	w.status = status
+	if !w.compressible() {
+		w.start(false)
+	}
+}
 
-	// Trigger background matching
-	s.matcher.CalculateMatchesAsync(primary, candidates)
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if !w.compressible() {
+			w.start(false)
+		} else {
+			w.buf = append(w.buf, p...)
+			if len(w.buf) >= w.minSize {
+				w.start(true)
+			}
+			return len(p), nil
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
 }
 
-func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		log.Printf("json encode error: %v", err)
+// Flush sends what is buffered so far, deciding on compression early if it
+// has to.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.start(w.compressible() && len(w.buf) >= w.minSize)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
 }
 
-func writeError(w http.ResponseWriter, status int, message string) {
-	writeJSON(w, status, map[string]string{"error": message})
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
-func getEnv(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// compressible reports whether the response so far may be gzipped.
+func (w *gzipResponseWriter) compressible() bool {
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		return false
 	}
-	return fallback
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		return true // sniffed from the body in start
+	}
+	mediaType, _, _ := strings.Cut(ct, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
 }
 
-func getEnvInt(key string, fallback int) int {
-	if v := os.Getenv(key); v != "" {
-		if i, err := strconv.Atoi(v); err == nil {
-			return i
+// start sends the status line and the buffered body, gzipped or not.
+func (w *gzipResponseWriter) start(compress bool) {
+	w.decided = true
+	h := w.Header()
+	if compress {
+		// Sniff before compressing, or net/http would sniff gzip bytes.
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(w.buf))
 		}
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
 	}
-	return fallback
+	w.ResponseWriter.WriteHeader(w.status)
+	if compress {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if len(w.buf) > 0 {
+		if w.gz != nil {
+			w.gz.Write(w.buf)
+		} else {
+			w.ResponseWriter.Write(w.buf)
+		}
+	}
+	w.buf = nil
 }
 
-func getEnvBool(key string, fallback bool) bool {
-	if v := os.Getenv(key); v != "" {
-		if v == "1" || strings.ToLower(v) == "true" || strings.ToLower(v) == "yes" {
-			return true
+// finish sends a response that never reached minSize and closes the gzip
+// stream.
+func (w *gzipResponseWriter) finish() {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			return // nothing written; net/http sends its default 200
 		}
-		if v == "0" || strings.ToLower(v) == "false" || strings.ToLower(v) == "no" {
-			return false
+		if w.status == 0 {
+			w.status = http.StatusOK
 		}
+		w.start(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
 	}
-	return fallback
 }
 
-func logError(r *http.Request, msg string, err error) {
-	requestID := middleware.GetReqID(r.Context())
-	prefix := fmt.Sprintf("req_id=%s %s %s host=%s", requestID, r.Method, r.URL.Path, r.Host)
-	if err != nil {
-		log.Printf("%s: %s: %v", prefix, msg, err)
-		return
-	}
-	log.Printf("%s: %s", prefix, msg)
+// traceAIRequests tags the request context with the chi request id so xAI
+// calls made while handling it send the id in the trace header.
+func traceAIRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			r = r.WithContext(xai.WithTraceID(r.Context(), id))
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func requestMetaLogger(next http.Handler) http.Handler {
@@ -1376,18 +5722,108 @@ func wantsJSON(r *http.Request) bool {
 	return strings.Contains(r.Header.Get("Accept"), "application/json")
 }
 
-func resolveRedirectTarget(frontendURL string) string {
-	if frontendURL == "" {
+// resolveRedirectTarget turns a configured redirect into a safe target.
+// Relative paths are normalized to start with "/". Absolute http(s) URLs are
+// only honored when their host is in allowedHosts; anything else falls back to "/".
+func resolveRedirectTarget(target string, allowedHosts []string) string {
+	if target == "" {
 		return "/"
 	}
-	lowered := strings.ToLower(frontendURL)
+	lowered := strings.ToLower(target)
 	if strings.HasPrefix(lowered, "http://") || strings.HasPrefix(lowered, "https://") {
-		return frontendURL
+		if !isAllowedRedirect(target, allowedHosts) {
+			log.Printf("warning: redirect target %q not in allowed hosts, using /", target)
+			return "/"
+		}
+		return target
+	}
+	if strings.HasPrefix(target, "//") || strings.Contains(target, "\\") {
+		return "/"
+	}
+	if !strings.HasPrefix(target, "/") {
+		return "/" + target
+	}
+	return target
+}
+
+// isAllowedRedirect reports whether target is an absolute http(s) URL, without
+// credentials, whose host is in allowedHosts.
+func isAllowedRedirect(target string, allowedHosts []string) bool {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return false
+	}
+	for _, h := range allowedHosts {
+		if strings.EqualFold(u.Host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRedirectHosts builds the redirect allowlist from FRONTEND_URL's host and
+// the comma-separated ALLOWED_REDIRECT_HOSTS, which may list bare hosts
+// ("app.example.com:8443") or origins ("https://app.example.com").
+func parseRedirectHosts(frontendURL, raw string) []string {
+	var hosts []string
+	add := func(h string) {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			return
+		}
+		for _, existing := range hosts {
+			if existing == h {
+				return
+			}
+		}
+		hosts = append(hosts, h)
+	}
+
+	if u, err := url.Parse(frontendURL); err == nil && u.Host != "" {
+		add(u.Host)
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "://") {
+			if u, err := url.Parse(entry); err == nil {
+				add(u.Host)
+			}
+			continue
+		}
+		add(entry)
+	}
+	return hosts
+}
+
+// sanitizeReturnTo validates a post-login return_to value. Relative paths are
+// accepted and, when the frontend lives on another origin, anchored to it.
+// Absolute URLs are only accepted on an allowlisted host. Protocol-relative
+// URLs ("//evil.com"), backslashes and non-http schemes are rejected.
+func sanitizeReturnTo(raw, frontendURL string, allowedHosts []string) (string, bool) {
+	if raw == "" || strings.ContainsAny(raw, "\\\r\n\t") {
+		return "", false
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+
+	if u.Scheme == "" && u.Host == "" {
+		if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") {
+			return "", false
+		}
+		frontendOrigin := ""
+		if f, err := url.Parse(frontendURL); err == nil && (f.Scheme == "http" || f.Scheme == "https") && f.Host != "" {
+			frontendOrigin = f.Scheme + "://" + f.Host
+		}
+		return frontendOrigin + raw, true
 	}
-	if !strings.HasPrefix(frontendURL, "/") {
-		return "/" + frontendURL
+
+	if !isAllowedRedirect(raw, allowedHosts) {
+		return "", false
 	}
-	return frontendURL
+	return raw, true
 }
 
 func min(a, b int) int {
@@ -1401,73 +5837,287 @@ func redisTokenKey(userID string) string {
 	return "token:" + userID
 }
 
+// defaultMaxBodyBytes is the MAX_BODY_BYTES default, ample for the small
+// JSON bodies the API takes.
+const defaultMaxBodyBytes = 64 << 10
+
+func (c *Config) maxBodyBytes() int64 {
+	if c.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return c.MaxBodyBytes
+}
+
+// Default seed data locations; SEED_USERS and SEED_MATCHES take globs such
+// as data/users/*.json to load several files.
+const (
+	defaultSeedUsers   = "data/users.json"
+	defaultSeedMatches = "data/matches.json"
+)
+
+func (c *Config) seedUsers() string {
+	if c.SeedUsers == "" {
+		return defaultSeedUsers
+	}
+	return c.SeedUsers
+}
+
+func (c *Config) seedMatches() string {
+	if c.SeedMatches == "" {
+		return defaultSeedMatches
+	}
+	return c.SeedMatches
+}
+
+// loadFromGlob calls load for every file matching pattern, in lexical
+// order, so a later file wins for a record that appears in more than one.
+// A file that fails doesn't stop the rest; the failures are returned
+// together. It is an error for nothing to match.
+func loadFromGlob(pattern string, load func(path string) error) error {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no files match %s", pattern)
+	}
+	var errs []error
+	for _, path := range paths {
+		if err := load(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func (s *server) seedUsers() {
-	if err := s.users.loadFromFile("data/users.json"); err != nil {
-		log.Printf("warning: could not load fake users from data/users.json: %v", err)
-	} else {
-		// Populate tweetStore with seed data and trigger analysis
-		// Since we are now behind an interface, we can't lock s.users.mu directly if it's the interface.
-		// However, for seeding we know we just loaded data.
-		// Let's rely on getAllAsInputs (which doesn't return tweets in current impl?) or just refactor.
-		// Actually, loadFromFile calls upsert. so data is there.
-		// We need to iterate all users to set tweets in tweetStore.
-
-		// We can add a helper to iterate or just use a type assertion if we really want to optimize,
-		// but let's just use a top-like scan or add a helper to the interface effectively.
-		// For now, let's use the `top` method with a large number or just use getRawMap if we are in memory mode.
-		// But in redis mode, loadFromFile puts them in redis.
-
-		// Simple approach: get all users via getAllAsInputs (we need to update it to include Tweets or load them separately)
-		// Wait, getAllAsInputs commented out tweets.
-		// Let's just use the file data directly since we just read it!
-		// That avoids all interface issues.
-		f, err := os.Open("data/users.json")
-		if err == nil {
-			defer f.Close()
-			var users []userProfile
-			if err := json.NewDecoder(f).Decode(&users); err == nil {
-				var usersToAnalyze []struct {
-					ID     string
-					Tweets []string
-				}
+	pattern := s.config.seedUsers()
+	if err := loadFromGlob(pattern, s.seedUsersFile); err != nil {
+		log.Printf("warning: could not load fake users from %s: %v", pattern, err)
+	}
+}
 
-				for _, u := range users {
-					if len(u.Tweets) > 0 {
-						s.tweets.set(u.ID, u.Tweets)
-						usersToAnalyze = append(usersToAnalyze, struct {
-							ID     string
-							Tweets []string
-						}{u.ID, u.Tweets})
-					}
-				}
+// seedUsersFile loads the users in one seed file and caches their tweets.
+// Analysis is left to resumeAnalysis, which picks up every user still
+// missing a summary.
+func (s *server) seedUsersFile(path string) error {
+	if err := s.users.loadFromFile(path); err != nil {
+		return err
+	}
+	// Matching and analysis read tweets from the tweet cache, not the profile.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var users []userProfile
+	if err := json.Unmarshal(data, &users); err != nil {
+		return err
+	}
+	for _, u := range users {
+		if len(u.Tweets) > 0 {
+			s.tweets.set(u.ID, u.Tweets)
+		}
+	}
+	return nil
+}
 
-				for _, u := range usersToAnalyze {
-					go s.callXAIAnalysis(u.ID, u.Tweets)
-				}
-			}
+// resumeAnalysisWorkers is how many users resumeAnalysis analyzes at once
+// when XAI_MAX_CONCURRENCY sets no cap.
+const resumeAnalysisWorkers = 4
+
+// resumeAnalysis starts profile analysis for every user with cached tweets
+// but no summary, in either store, so users left unanalyzed by an
+// interrupted seed or a restart are picked up on the next boot. A large
+// backlog is worked through by a small pool, sized by XAI_MAX_CONCURRENCY,
+// rather than all at once. It returns the ids it queued.
+func (s *server) resumeAnalysis() []string {
+	var pending []string
+	for _, u := range s.users.getAllAsInputs(context.Background()) {
+		if u.Summary == "" && len(s.tweets.get(u.ID)) > 0 {
+			pending = append(pending, u.ID)
+		}
+	}
+	sort.Strings(pending)
+	if len(pending) > 0 {
+		log.Printf("resuming analysis for %d users without a summary", len(pending))
+	}
+	workers := resumeAnalysisWorkers
+	if s.config.XAIMaxConcurrency > 0 {
+		workers = s.config.XAIMaxConcurrency
+	}
+	ids := make(chan string)
+	go func() {
+		defer close(ids)
+		for _, id := range pending {
+			ids <- id
 		}
+	}()
+	for range min(workers, len(pending)) {
+		go func() {
+			for id := range ids {
+				s.callXAIAnalysis(context.Background(), id, s.tweets.get(id))
+			}
+		}()
 	}
+	return pending
 }
 
 func (s *server) seedMatches() {
-	if err := s.matcher.LoadFromFile("data/matches.json"); err != nil {
-		log.Printf("warning: could not load fake matches from data/matches.json: %v", err)
+	pattern := s.config.seedMatches()
+	if err := loadFromGlob(pattern, s.matcher.LoadFromFile); err != nil {
+		log.Printf("warning: could not load fake matches from %s: %v", pattern, err)
+	}
+}
+
+// sessionCookie builds the session cookie from the configured name, domain and
+// SameSite mode. Secure follows the redirect URL scheme, except that
+// SameSite=None always sets Secure since browsers drop it otherwise.
+func (s *server) sessionCookie(value string, expires time.Time) *http.Cookie {
+	sameSite := s.config.CookieSameSite
+	if sameSite == 0 {
+		sameSite = http.SameSiteLaxMode
+	}
+	secure := strings.HasPrefix(strings.ToLower(s.config.RedirectURL), "https")
+	if sameSite == http.SameSiteNoneMode {
+		secure = true
+	}
+	return &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    value,
+		Path:     "/",
+		Domain:   s.config.CookieDomain,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+		Expires:  expires,
+	}
+}
+
+func (s *server) cookieName() string {
+	if s.config.CookieName == "" {
+		return "access_token"
+	}
+	return s.config.CookieName
+}
+
+const defaultAvatarPromptTemplate = "A cool, modernistic, abstract avatar representation of a matching persona described as: %s. Cyberpunk, vaporwave, or futuristic digital art style. High quality, vibrant colors, artistic, creative composition."
+
+// validateAvatarPromptTemplate requires exactly one %s for the summary and
+// no other formatting verbs (a literal percent sign is written %%).
+func validateAvatarPromptTemplate(tmpl string) error {
+	rest := strings.ReplaceAll(tmpl, "%%", "")
+	if strings.Count(rest, "%s") != 1 || strings.Count(rest, "%") != 1 {
+		return errors.New("AVATAR_PROMPT_TEMPLATE must contain exactly one %s placeholder for the summary")
+	}
+	return nil
+}
+
+const defaultAnalysisPromptTemplate = `Analyze the following tweets from a user, listed newest first. Weigh recent tweets more heavily.{interests}
+- {tweets}
+
+Generate a short 2-sentence summary of who they are. 
+Also provide a 'matching score' from 0-100 indicating how socially engaging they seem based on their content and interests. 
+Output purely JSON in the following format:
+{"summary": "...", "score": 85.5}`
+
+// validateAnalysisPromptTemplate requires both context placeholders so a
+// custom prompt can't silently drop the user's tweets or interests.
+func validateAnalysisPromptTemplate(tmpl string) error {
+	for _, p := range []string{"{interests}", "{tweets}"} {
+		if !strings.Contains(tmpl, p) {
+			return fmt.Errorf("ANALYSIS_PROMPT_TEMPLATE must contain the %s placeholder", p)
+		}
+	}
+	return nil
+}
+
+// defaultAnalysisTweetLimit is how many of the most recent tweets the
+// analysis prompt includes by default; enough to be representative while
+// staying well within prompt limits.
+const defaultAnalysisTweetLimit = 50
+
+func (c *Config) analysisPromptTweets() int {
+	if c.AnalysisPromptTweets <= 0 {
+		return defaultAnalysisTweetLimit
+	}
+	return c.AnalysisPromptTweets
+}
+
+// buildAnalysisPrompt fills the summary/score template (the default when tmpl
+// is empty) from the newest limit sanitized tweets, newest first, and the
+// stated interests.
+func buildAnalysisPrompt(tmpl string, tweets []string, interests string, limit int) string {
+	if tmpl == "" {
+		tmpl = defaultAnalysisPromptTemplate
+	}
+	if len(tweets) > limit {
+		tweets = tweets[:limit]
+	}
+	interestsContext := ""
+	if interests != "" {
+		interestsContext = fmt.Sprintf("\nThe user also has these stated interests: %s", interests)
+	}
+	return strings.NewReplacer("{interests}", interestsContext, "{tweets}", strings.Join(tweets, "\n- ")).Replace(tmpl)
+}
+
+func (s *server) avatarPrompt(summary string) string {
+	tmpl := s.config.AvatarPromptTemplate
+	if tmpl == "" {
+		tmpl = defaultAvatarPromptTemplate
+	}
+	return fmt.Sprintf(tmpl, summary)
+}
+
+// parseSameSite maps COOKIE_SAMESITE (lax, strict, none) to http.SameSite.
+// Empty defaults to lax.
+func parseSameSite(raw string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid COOKIE_SAMESITE %q (want lax, strict or none)", raw)
+	}
+}
+
+// sameSiteName is the COOKIE_SAMESITE value for mode.
+func sameSiteName(mode http.SameSite) string {
+	switch mode {
+	case http.SameSiteStrictMode:
+		return "strict"
+	case http.SameSiteNoneMode:
+		return "none"
+	default:
+		return "lax"
 	}
 }
 
 func (s *server) resolveAccessToken(r *http.Request) string {
-	sessionCookie, err := r.Cookie("access_token")
-	if err != nil || sessionCookie.Value == "" {
+	claims := s.resolveSession(r)
+	if claims == nil {
 		return ""
 	}
+	return claims.Subject
+}
+
+// resolveSession returns the verified claims from the session cookie, or nil
+// when the cookie is missing or invalid.
+func (s *server) resolveSession(r *http.Request) *jwt.RegisteredClaims {
+	sessionCookie, err := r.Cookie(s.cookieName())
+	if err != nil || sessionCookie.Value == "" {
+		return nil
+	}
 
 	claims, err := s.parseJWT(sessionCookie.Value)
 	if err != nil {
 		logError(r, "invalid session token", err)
-		return ""
+		return nil
 	}
 
-	return claims.Subject
+	return claims
 }
 
 func (s *server) issueJWT(userID string, fallbackExpiry time.Time) (string, error) {
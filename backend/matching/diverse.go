@@ -0,0 +1,87 @@
+package matching
+
+import "context"
+
+// diversePoolFactor is how many top matches per requested slot
+// DiverseMatches chooses from.
+const diversePoolFactor = 4
+
+// diversityWeight balances relevance against variety in DiverseMatches: 1
+// is plain score order, 0 ignores score after the first pick.
+const diversityWeight = 0.7
+
+// DiverseMatches returns the viewer's pinned matches followed by n others
+// picked for variety rather than score alone. It chooses from the top
+// n*diversePoolFactor matches scoring at least minScore by maximal marginal
+// relevance: each pick maximizes its score traded off against its highest
+// interest overlap with the matches already picked, so the page isn't five
+// people who all like the same thing. Interests come from the lookup set
+// with SetInterestLookup; without one this is plain score order.
+func (s *Service) DiverseMatches(ctx context.Context, viewerID string, n int, minScore float64) []MatchResult {
+	pinnedIDs := s.storage.PinnedMatches(ctx, viewerID)
+	isPinned := make(map[string]bool, len(pinnedIDs))
+	for _, id := range pinnedIDs {
+		isPinned[id] = true
+	}
+	out := s.pinnedMatches(ctx, viewerID, pinnedIDs)
+
+	// Over-fetch so skipping the pinned entries still fills the pool.
+	var pool []MatchResult
+	ranked := 0
+	for _, m := range s.storage.GetTopMatches(ctx, viewerID, n*diversePoolFactor+len(pinnedIDs)) {
+		if ranked == n*diversePoolFactor {
+			break
+		}
+		if isPinned[m.TargetID] {
+			continue
+		}
+		ranked++
+		if m.Score >= minScore {
+			pool = append(pool, m)
+		}
+	}
+
+	var tokens map[string][]string
+	if fn := s.interests.Load(); fn != nil && len(pool) > 0 {
+		ids := make([]string, len(pool))
+		for i, m := range pool {
+			ids[i] = m.TargetID
+		}
+		tokens = (*fn)(ctx, ids)
+	}
+	inputs := make(map[string]UserInput, len(pool))
+	for _, m := range pool {
+		inputs[m.TargetID] = UserInput{ID: m.TargetID, InterestTokens: tokens[m.TargetID]}
+	}
+
+	// maxSim[i] is pool[i]'s highest overlap with a picked match.
+	maxSim := make([]float64, len(pool))
+	picked := make([]bool, len(pool))
+	for want := len(out) + n; len(out) < want; {
+		best, bestValue := -1, 0.0
+		for i, m := range pool {
+			if picked[i] {
+				continue
+			}
+			value := diversityWeight*m.Score/100 - (1-diversityWeight)*maxSim[i]
+			// The pool is in score order, so ties keep the higher score.
+			if best < 0 || value > bestValue {
+				best, bestValue = i, value
+			}
+		}
+		if best < 0 {
+			break
+		}
+		picked[best] = true
+		out = append(out, pool[best])
+		for i := range pool {
+			if !picked[i] {
+				maxSim[i] = max(maxSim[i], interestOverlapScore(inputs[pool[i].TargetID], inputs[pool[best].TargetID]))
+			}
+		}
+	}
+	if out == nil {
+		out = []MatchResult{}
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package matching
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"glowmeet/xai/xaitest"
+)
+
+func TestService_DiverseMatches(t *testing.T) {
+	service := NewServiceWithClient(xaitest.NewFakeClient())
+	interests := map[string][]string{
+		"h1":    {"hiking", "camping"},
+		"h2":    {"hiking", "camping"},
+		"h3":    {"hiking", "camping"},
+		"h4":    {"hiking"},
+		"chess": {"chess"},
+		"jazz":  {"jazz"},
+		"weak":  {"pottery"},
+	}
+	lookups := 0
+	service.SetInterestLookup(func(_ context.Context, ids []string) map[string][]string {
+		lookups++
+		out := make(map[string][]string)
+		for _, id := range ids {
+			if tokens, ok := interests[id]; ok {
+				out[id] = tokens
+			}
+		}
+		return out
+	})
+	for id, score := range map[string]float64{"h1": 95, "h2": 94, "h3": 93, "h4": 92, "chess": 80, "jazz": 78, "weak": 20} {
+		service.storage.UpdateMatch(context.Background(), "v", id, MatchResult{TargetID: id, Score: score})
+	}
+
+	ids := func(matches []MatchResult) string {
+		var out []string
+		for _, m := range matches {
+			out = append(out, m.TargetID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if got := ids(service.GetTopMatches(context.Background(), "v", 3)); got != "h1,h2,h3" {
+		t.Fatalf("expected top mode to be all hikers, got %s", got)
+	}
+	// The best match leads; the next picks go to the best-scored matches
+	// that don't repeat the hikers' interests.
+	lookups = 0
+	if got := ids(service.DiverseMatches(context.Background(), "v", 3, 40)); got != "h1,chess,jazz" {
+		t.Errorf("expected a varied page, got %s", got)
+	}
+	if lookups != 1 {
+		t.Errorf("expected interests to be looked up in one batch, got %d calls", lookups)
+	}
+	if got := ids(service.DiverseMatches(context.Background(), "v", 10, 40)); strings.Contains(got, "weak") || len(strings.Split(got, ",")) != 6 {
+		t.Errorf("expected every match above minScore once, got %s", got)
+	}
+
+	if err := service.PinMatch(context.Background(), "v", "h4"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(service.DiverseMatches(context.Background(), "v", 3, 40)); got != "h4,h1,chess,jazz" {
+		t.Errorf("expected the pinned match to lead and not count toward n, got %s", got)
+	}
+
+	// A pinned match below the pool and minScore still leads.
+	if err := service.PinMatch(context.Background(), "v", "weak"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(service.DiverseMatches(context.Background(), "v", 1, 40)); got != "h4,weak,h1" {
+		t.Errorf("expected every pinned match to lead, got %s", got)
+	}
+}
@@ -0,0 +1,74 @@
+package matching
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FlagEnvPrefix starts the name of every feature flag environment variable.
+const FlagEnvPrefix = "FLAG_"
+
+// Flags toggle matching changes that are rolled out per deployment. Code
+// behind a flag reads it from Service.Flags, so a change can be enabled, or
+// turned back off, without a rebuild. All flags default to off.
+type Flags struct {
+	// DistanceWeighting breaks interest-overlap ties in RankCandidates by
+	// distance, nearest first, so nearby pairs are scored sooner.
+	DistanceWeighting bool `json:"distance_weighting"`
+	// BatchMatching is reserved for scoring several candidates per AI call.
+	// Nothing reads it yet; setting it has no effect.
+	BatchMatching bool `json:"batch_matching"`
+}
+
+// vars maps each flag's environment variable to its field.
+func (f *Flags) vars() map[string]*bool {
+	return map[string]*bool{
+		FlagEnvPrefix + "DISTANCE_WEIGHTING": &f.DistanceWeighting,
+		FlagEnvPrefix + "BATCH_MATCHING":     &f.BatchMatching,
+	}
+}
+
+// ParseFlags reads the FLAG_* variables in environ (KEY=value pairs, as
+// from os.Environ). Values use strconv.ParseBool; an empty value leaves the
+// flag off. FLAG_* variables that name no flag are returned in unknown,
+// sorted, so a typo can be reported instead of silently doing nothing.
+func ParseFlags(environ []string) (flags Flags, unknown []string, err error) {
+	vars := flags.vars()
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, FlagEnvPrefix) {
+			continue
+		}
+		field, ok := vars[key]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return Flags{}, nil, fmt.Errorf("invalid %s %q: want true or false", key, value)
+		}
+		*field = on
+	}
+	sort.Strings(unknown)
+	return flags, unknown, nil
+}
+
+// SetFlags replaces the service's feature flags.
+func (s *Service) SetFlags(f Flags) {
+	s.flags.Store(&f)
+}
+
+// Flags returns the service's feature flags; all off unless SetFlags was
+// called.
+func (s *Service) Flags() Flags {
+	if f := s.flags.Load(); f != nil {
+		return *f
+	}
+	return Flags{}
+}
@@ -0,0 +1,55 @@
+package matching
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	flags, unknown, err := ParseFlags([]string{
+		"PATH=/usr/bin",
+		"FLAG_DISTANCE_WEIGHTING=true",
+		"FLAG_BATCH_MATCHING=",
+		"FLAG_DISTANCE_WIEGHTING=1",
+		"FLAG_NEW_PROMPT=1",
+	})
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if want := (Flags{DistanceWeighting: true}); flags != want {
+		t.Errorf("expected %+v, got %+v", want, flags)
+	}
+	if want := []string{"FLAG_DISTANCE_WIEGHTING", "FLAG_NEW_PROMPT"}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("expected unknown flags %v, got %v", want, unknown)
+	}
+
+	if _, _, err := ParseFlags([]string{"FLAG_BATCH_MATCHING=maybe"}); err == nil {
+		t.Error("expected an invalid value to be rejected")
+	}
+
+	service := NewServiceWithClient(nil)
+	if service.Flags() != (Flags{}) {
+		t.Errorf("expected all flags off by default, got %+v", service.Flags())
+	}
+	service.SetFlags(Flags{BatchMatching: true})
+	if !service.Flags().BatchMatching {
+		t.Error("expected SetFlags to take effect")
+	}
+}
+
+func TestService_RankCandidatesDistanceWeighting(t *testing.T) {
+	viewer := UserInput{ID: "v", Interests: "jazz", HasLocation: true, Lat: 37.77, Long: -122.42}
+	cohort := []UserInput{
+		{ID: "far", Interests: "jazz", Score: 90, HasLocation: true, Lat: 40.71, Long: -74.01},
+		{ID: "near", Interests: "jazz", Score: 10, HasLocation: true, Lat: 37.80, Long: -122.27},
+		{ID: "nowhere", Interests: "jazz", Score: 95},
+	}
+	service := NewServiceWithClient(nil)
+	if got := sampleIDs(service.RankCandidates(viewer, cohort)); got != "nowhere,far,near" {
+		t.Errorf("expected score order with the flag off, got %s", got)
+	}
+	service.SetFlags(Flags{DistanceWeighting: true})
+	if got := sampleIDs(service.RankCandidates(viewer, cohort)); got != "near,far,nowhere" {
+		t.Errorf("expected distance order with the flag on, got %s", got)
+	}
+}
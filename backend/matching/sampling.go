@@ -0,0 +1,307 @@
+package matching
+
+import (
+	"container/heap"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// SamplingStrategy picks which candidates a viewer is matched against, so
+// large cohorts don't cost one AI call per user pair.
+type SamplingStrategy interface {
+	Sample(primary UserInput, candidates []UserInput) []UserInput
+}
+
+// SamplingFunc adapts a function to SamplingStrategy.
+type SamplingFunc func(primary UserInput, candidates []UserInput) []UserInput
+
+func (f SamplingFunc) Sample(primary UserInput, candidates []UserInput) []UserInput {
+	return f(primary, candidates)
+}
+
+// A Sampler collects candidates one at a time for a single viewer, so a
+// large store can be sampled while it is scanned instead of loaded whole.
+type Sampler interface {
+	Add(candidate UserInput)
+	// Candidates returns what the strategy keeps from everything added.
+	Candidates() []UserInput
+}
+
+// NewSampler starts sampling candidates for primary. The strategies in this
+// package hold at most their n candidates at a time; a nil strategy keeps
+// every candidate, and any other strategy is applied to the full list when
+// Candidates is called.
+func NewSampler(strategy SamplingStrategy, primary UserInput) Sampler {
+	switch st := strategy.(type) {
+	case nil:
+		return &collectSampler{}
+	case samplerFunc:
+		return st(primary)
+	}
+	return &collectSampler{apply: func(all []UserInput) []UserInput {
+		return strategy.Sample(primary, all)
+	}}
+}
+
+// samplerFunc is a SamplingStrategy that samples incrementally.
+type samplerFunc func(primary UserInput) Sampler
+
+func (f samplerFunc) Sample(primary UserInput, candidates []UserInput) []UserInput {
+	sampler := f(primary)
+	for _, c := range candidates {
+		sampler.Add(c)
+	}
+	return sampler.Candidates()
+}
+
+// collectSampler keeps every candidate, optionally narrowing them once at
+// the end.
+type collectSampler struct {
+	all   []UserInput
+	apply func([]UserInput) []UserInput
+}
+
+func (c *collectSampler) Add(candidate UserInput) { c.all = append(c.all, candidate) }
+
+func (c *collectSampler) Candidates() []UserInput {
+	if c.apply != nil {
+		return c.apply(c.all)
+	}
+	return c.all
+}
+
+// SampleTopByScore keeps the n candidates with the highest profile score.
+func SampleTopByScore(n int) SamplingStrategy {
+	return samplerFunc(func(primary UserInput) Sampler {
+		return newTopSampler(primary, n, func(c UserInput) (rankKey, bool) {
+			return rankKey{c.Score}, true
+		})
+	})
+}
+
+// SampleNearest keeps the n located candidates closest to the viewer. A
+// viewer without a location gets no candidates.
+func SampleNearest(n int) SamplingStrategy {
+	return samplerFunc(func(primary UserInput) Sampler {
+		return newTopSampler(primary, n, func(c UserInput) (rankKey, bool) {
+			if !primary.HasLocation || !c.HasLocation {
+				return rankKey{}, false
+			}
+			return rankKey{-DistanceKm(primary, c)}, true
+		})
+	})
+}
+
+// SampleRandom keeps n candidates chosen uniformly at random.
+func SampleRandom(n int) SamplingStrategy {
+	return samplerFunc(func(primary UserInput) Sampler {
+		return &reservoirSampler{n: n, skipID: primary.ID}
+	})
+}
+
+// SampleByInterestOverlap keeps the n candidates whose interests overlap the
+// viewer's the most, breaking ties by profile score.
+func SampleByInterestOverlap(n int) SamplingStrategy {
+	return samplerFunc(func(primary UserInput) Sampler {
+		return newTopSampler(primary, n, func(c UserInput) (rankKey, bool) {
+			return rankKey{interestOverlapScore(primary, c), c.Score}, true
+		})
+	})
+}
+
+// rankKey orders candidates for a topSampler: compared element by element,
+// higher first.
+type rankKey [2]float64
+
+// ranked is a candidate a topSampler holds, with its key and the order it
+// was added in.
+type ranked struct {
+	in  UserInput
+	key rankKey
+	seq int
+}
+
+// before reports whether a ranks ahead of b. Equal keys keep the order they
+// were added in, as a stable sort would.
+func (a ranked) before(b ranked) bool {
+	for i := range a.key {
+		if a.key[i] != b.key[i] {
+			return a.key[i] > b.key[i]
+		}
+	}
+	return a.seq < b.seq
+}
+
+// topSampler keeps the n best-ranked candidates in a heap whose root is
+// the worst one kept, so each Add is O(log n). key returns false for
+// candidates the strategy skips. n <= 0 keeps every candidate.
+type topSampler struct {
+	n      int
+	skipID string
+	key    func(UserInput) (rankKey, bool)
+	items  []ranked
+	seq    int
+}
+
+func newTopSampler(primary UserInput, n int, key func(UserInput) (rankKey, bool)) *topSampler {
+	return &topSampler{n: n, skipID: primary.ID, key: key}
+}
+
+func (t *topSampler) Len() int           { return len(t.items) }
+func (t *topSampler) Less(i, j int) bool { return t.items[j].before(t.items[i]) }
+func (t *topSampler) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topSampler) Push(x any)         { t.items = append(t.items, x.(ranked)) }
+func (t *topSampler) Pop() any {
+	last := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return last
+}
+
+func (t *topSampler) Add(candidate UserInput) {
+	if candidate.ID == t.skipID {
+		return
+	}
+	key, ok := t.key(candidate)
+	if !ok {
+		return
+	}
+	r := ranked{in: candidate, key: key, seq: t.seq}
+	t.seq++
+	switch {
+	case t.n <= 0 || len(t.items) < t.n:
+		heap.Push(t, r)
+	case r.before(t.items[0]):
+		t.items[0] = r
+		heap.Fix(t, 0)
+	}
+}
+
+func (t *topSampler) Candidates() []UserInput {
+	items := slices.Clone(t.items)
+	sort.Slice(items, func(i, j int) bool { return items[i].before(items[j]) })
+	out := make([]UserInput, len(items))
+	for i, r := range items {
+		out[i] = r.in
+	}
+	return out
+}
+
+// reservoirSampler keeps a uniform random sample of n candidates without
+// knowing how many will be added. n <= 0 keeps every candidate.
+type reservoirSampler struct {
+	n      int
+	skipID string
+	seen   int
+	kept   []UserInput
+}
+
+func (r *reservoirSampler) Add(candidate UserInput) {
+	if candidate.ID == r.skipID {
+		return
+	}
+	r.seen++
+	if r.n <= 0 || len(r.kept) < r.n {
+		r.kept = append(r.kept, candidate)
+	} else if j := rand.IntN(r.seen); j < r.n {
+		r.kept[j] = candidate
+	}
+}
+
+// Candidates shuffles the sample, so its order doesn't follow the order
+// candidates were added in.
+func (r *reservoirSampler) Candidates() []UserInput {
+	out := slices.Clone(r.kept)
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
+
+// RankByInterestOverlap copies candidates without the viewer, ordered by
+// interest overlap with the viewer, highest first. Ties go to the higher
+// profile score. It needs no AI call, so it can decide which pairs are worth
+// one.
+func RankByInterestOverlap(primary UserInput, candidates []UserInput) []UserInput {
+	return rankByInterestOverlap(primary, candidates, false)
+}
+
+// rankByInterestOverlap is RankByInterestOverlap; with byDistance and a
+// located viewer, overlap ties go to the nearer located candidate before
+// profile score is considered.
+func rankByInterestOverlap(primary UserInput, candidates []UserInput, byDistance bool) []UserInput {
+	out := others(primary, candidates)
+	overlap := make(map[string]float64, len(out))
+	for _, c := range out {
+		overlap[c.ID] = interestOverlapScore(primary, c)
+	}
+	byDistance = byDistance && primary.HasLocation
+	sort.SliceStable(out, func(i, j int) bool {
+		if oi, oj := overlap[out[i].ID], overlap[out[j].ID]; oi != oj {
+			return oi > oj
+		}
+		if byDistance && out[i].HasLocation != out[j].HasLocation {
+			return out[i].HasLocation
+		}
+		if byDistance && out[i].HasLocation {
+			if di, dj := DistanceKm(primary, out[i]), DistanceKm(primary, out[j]); di != dj {
+				return di < dj
+			}
+		}
+		return out[i].Score > out[j].Score
+	})
+	return out
+}
+
+// interestOverlapScore is the Jaccard similarity of two users' interest
+// sets: 0 when they share nothing (or either has none), 1 when identical.
+func interestOverlapScore(a, b UserInput) float64 {
+	as, bs := interestSet(a), interestSet(b)
+	if len(as) == 0 || len(bs) == 0 {
+		return 0
+	}
+	shared := 0
+	for t := range as {
+		if bs[t] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(as)+len(bs)-shared)
+}
+
+// interestSet prefers the pre-split InterestTokens and falls back to
+// splitting Interests on commas.
+func interestSet(u UserInput) map[string]bool {
+	tokens := u.InterestTokens
+	if len(tokens) == 0 && u.Interests != "" {
+		tokens = strings.Split(u.Interests, ",")
+	}
+	set := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		if t = strings.ToLower(strings.Join(strings.Fields(t), " ")); t != "" {
+			set[t] = true
+		}
+	}
+	return set
+}
+
+// DistanceKm is the great-circle distance between two users' locations.
+func DistanceKm(a, b UserInput) float64 {
+	const earthRadiusKm = 6371.0
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLong := (b.Long - a.Long) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// others copies candidates without the viewer.
+func others(primary UserInput, candidates []UserInput) []UserInput {
+	out := make([]UserInput, 0, len(candidates))
+	for _, c := range candidates {
+		if c.ID != primary.ID {
+			out = append(out, c)
+		}
+	}
+	return out
+}
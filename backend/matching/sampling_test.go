@@ -0,0 +1,166 @@
+package matching
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func sampleIDs(in []UserInput) string {
+	ids := make([]string, 0, len(in))
+	for _, u := range in {
+		ids = append(ids, u.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+var sampleCohort = []UserInput{
+	{ID: "v1", Score: 99, HasLocation: true, Lat: 37.7749, Long: -122.4194}, // San Francisco
+	{ID: "oakland", Score: 40, HasLocation: true, Lat: 37.8044, Long: -122.2712},
+	{ID: "nyc", Score: 90, HasLocation: true, Lat: 40.7128, Long: -74.0060},
+	{ID: "sanjose", Score: 70, HasLocation: true, Lat: 37.3382, Long: -121.8863},
+	{ID: "nowhere", Score: 80},
+	{ID: "london", Score: 10, HasLocation: true, Lat: 51.5074, Long: -0.1278},
+}
+
+func TestSampleTopByScore(t *testing.T) {
+	got := SampleTopByScore(3).Sample(sampleCohort[0], sampleCohort)
+	if ids := sampleIDs(got); ids != "nyc,nowhere,sanjose" {
+		t.Errorf("expected top 3 by score, got %s", ids)
+	}
+}
+
+func TestSampleNearest(t *testing.T) {
+	got := SampleNearest(3).Sample(sampleCohort[0], sampleCohort)
+	if ids := sampleIDs(got); ids != "oakland,sanjose,nyc" {
+		t.Errorf("expected 3 nearest located users, got %s", ids)
+	}
+	if got := SampleNearest(3).Sample(UserInput{ID: "x"}, sampleCohort); len(got) != 0 {
+		t.Errorf("expected no candidates for a viewer without location, got %s", sampleIDs(got))
+	}
+}
+
+func TestSampleRandom(t *testing.T) {
+	got := SampleRandom(3).Sample(sampleCohort[0], sampleCohort)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 candidates, got %d", len(got))
+	}
+	seen := map[string]bool{}
+	for _, c := range got {
+		if c.ID == "v1" || seen[c.ID] {
+			t.Errorf("unexpected candidate %s in %s", c.ID, sampleIDs(got))
+		}
+		seen[c.ID] = true
+	}
+	if got := SampleRandom(0).Sample(sampleCohort[0], sampleCohort); len(got) != len(sampleCohort)-1 {
+		t.Errorf("expected n=0 to keep everyone but the viewer, got %d", len(got))
+	}
+}
+
+func TestInterestOverlapScore(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b string
+		want float64
+	}{
+		{"disjoint", "hiking, jazz", "chess, go", 0},
+		{"partial", "hiking, Jazz, go", "jazz,  Go , chess", 0.5},
+		{"identical", "hiking, jazz", "Jazz, hiking", 1},
+		{"empty", "", "hiking", 0},
+	}
+	for _, tc := range cases {
+		got := interestOverlapScore(UserInput{Interests: tc.a}, UserInput{Interests: tc.b})
+		if got != tc.want {
+			t.Errorf("%s: interestOverlapScore(%q, %q) = %v, want %v", tc.name, tc.a, tc.b, got, tc.want)
+		}
+	}
+	tokens := UserInput{InterestTokens: []string{"hiking", "jazz"}}
+	if got := interestOverlapScore(tokens, UserInput{Interests: "jazz"}); got != 0.5 {
+		t.Errorf("expected InterestTokens to be used, got %v", got)
+	}
+}
+
+func TestSampleByInterestOverlap(t *testing.T) {
+	viewer := UserInput{ID: "v1", Interests: "hiking, jazz, go"}
+	cohort := []UserInput{
+		viewer,
+		{ID: "none", Score: 90, Interests: "chess"},
+		{ID: "some", Score: 10, Interests: "jazz"},
+		{ID: "most", Score: 20, Interests: "hiking, jazz"},
+		{ID: "some-high", Score: 50, Interests: "go"},
+	}
+	if ids := sampleIDs(RankByInterestOverlap(viewer, cohort)); ids != "most,some-high,some,none" {
+		t.Errorf("expected candidates ranked by overlap then score, got %s", ids)
+	}
+	if ids := sampleIDs(SampleByInterestOverlap(2).Sample(viewer, cohort)); ids != "most,some-high" {
+		t.Errorf("expected the 2 best overlaps, got %s", ids)
+	}
+}
+
+func TestService_SampleCandidates(t *testing.T) {
+	service := &Service{}
+	if got := service.SampleCandidates(sampleCohort[0], sampleCohort); len(got) != len(sampleCohort) {
+		t.Errorf("expected all candidates without a strategy, got %d", len(got))
+	}
+	service.SetSampling(SampleTopByScore(1))
+	if ids := sampleIDs(service.SampleCandidates(sampleCohort[0], sampleCohort)); ids != "nyc" {
+		t.Errorf("expected configured strategy to apply, got %s", ids)
+	}
+}
+
+func TestNewSampler_HoldsAtMostN(t *testing.T) {
+	viewer := UserInput{ID: "v", Interests: "jazz", HasLocation: true, Lat: 37.77, Long: -122.42}
+	for name, strategy := range map[string]SamplingStrategy{
+		"top":     SampleTopByScore(3),
+		"nearest": SampleNearest(3),
+		"random":  SampleRandom(3),
+		"overlap": SampleByInterestOverlap(3),
+	} {
+		sampler := NewSampler(strategy, viewer)
+		for i := range 100 {
+			sampler.Add(UserInput{ID: strconv.Itoa(i), Score: float64(i), Interests: "jazz", HasLocation: true, Lat: 37 + float64(i)/100, Long: -122})
+			held := 0
+			switch s := sampler.(type) {
+			case *topSampler:
+				held = len(s.items)
+			case *reservoirSampler:
+				held = len(s.kept)
+			default:
+				t.Fatalf("%s: expected an incremental sampler, got %T", name, sampler)
+			}
+			if held > 3 {
+				t.Fatalf("%s: held %d candidates after %d adds", name, held, i+1)
+			}
+		}
+		if got := len(sampler.Candidates()); got != 3 {
+			t.Errorf("%s: expected 3 candidates, got %d", name, got)
+		}
+	}
+
+	top := NewSampler(SampleTopByScore(2), sampleCohort[0])
+	for _, c := range sampleCohort {
+		top.Add(c)
+	}
+	if ids := sampleIDs(top.Candidates()); ids != "nyc,nowhere" {
+		t.Errorf("expected the 2 best scores in order, got %s", ids)
+	}
+
+	custom := SamplingFunc(func(_ UserInput, candidates []UserInput) []UserInput { return candidates[:1] })
+	sampler := NewSampler(custom, sampleCohort[0])
+	for _, c := range sampleCohort {
+		sampler.Add(c)
+	}
+	if ids := sampleIDs(sampler.Candidates()); ids != "v1" {
+		t.Errorf("expected a custom strategy to see the full list, got %s", ids)
+	}
+}
+
+func TestDistanceKm(t *testing.T) {
+	sf, nyc := sampleCohort[0], sampleCohort[2]
+	if d := DistanceKm(sf, nyc); d < 4100 || d > 4160 {
+		t.Errorf("expected SF-NYC around 4130km, got %.0f", d)
+	}
+	if d := DistanceKm(sf, sf); d != 0 {
+		t.Errorf("expected zero distance to self, got %f", d)
+	}
+}
@@ -2,46 +2,97 @@ package matching
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"glowmeet/codec"
+	"glowmeet/redisguard"
 	"glowmeet/xai"
 	"log"
+	"math"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type persistedMatch struct {
-	ViewerID string  `json:"viewer_id"`
-	TargetID string  `json:"target_id"`
-	Score    float64 `json:"score"`
-	Reason   string  `json:"reason"`
+	ViewerID   string   `json:"viewer_id"`
+	TargetID   string   `json:"target_id"`
+	Score      float64  `json:"score"`
+	Reason     string   `json:"reason"`
+	ReasonTags []string `json:"reason_tags,omitempty"`
+	Model      string   `json:"model,omitempty"`
 }
 
-type AIClient interface {
-	CreateChatCompletion(ctx context.Context, req xai.ChatRequest) (*xai.ChatResponse, error)
-}
+// DefaultMaxTokens caps a match completion. The reply is a short JSON
+// object, so this leaves plenty of room without paying for rambling.
+const DefaultMaxTokens = 256
+
+// DefaultRetryAttempts and DefaultRetryBackoff bound how a worker retries a
+// match whose AI call failed transiently.
+const (
+	DefaultRetryAttempts = 3
+	DefaultRetryBackoff  = 2 * time.Second
+)
+
+// DefaultPromptTweetLimit is how many tweets per user are included in a
+// match prompt unless SetPromptTweetLimit changes it.
+const DefaultPromptTweetLimit = 5
+
+// MaxReasonTags caps how many category tags are kept per match.
+const MaxReasonTags = 5
+
+// AIClient is the chat client used for matching.
+type AIClient = xai.ChatCompleter
 
 // MatchResult represents a calculated compatibility score between two users.
 type MatchResult struct {
-	TargetID  string    `json:"target_id"`
-	Score     float64   `json:"score"`
-	Reason    string    `json:"reason"`
-	Timestamp time.Time `json:"timestamp"`
+	TargetID string  `json:"target_id"`
+	Score    float64 `json:"score"`
+	Reason   string  `json:"reason"`
+	// ReasonTags are short lowercase categories (e.g. "outdoors", "music")
+	// the UI can render as filter chips.
+	ReasonTags []string  `json:"reason_tags,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	// Model is the xAI model that produced the match, for comparing score
+	// distributions across models. Empty for seeded matches.
+	Model string `json:"model,omitempty"`
+	// Pinned is set on matches the viewer pinned, as returned by
+	// GetTopMatches; it isn't stored with the match.
+	Pinned bool `json:"pinned,omitempty"`
+	// LastError and LastErrorAt record the most recent failed recompute.
+	// Score and Reason keep the last good result; a success clears these.
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
 }
 
 // UserInput contains the necessary data for AI analysis.
 type UserInput struct {
-	ID        string
-	Name      string
-	Username  string
-	Summary   string
-	Interests string
-	Tweets    []string
+	ID       string
+	Name     string
+	Username string
+	Summary  string
+	// Description is the user's bio, from X or generated.
+	Description string
+	Interests   string
+	// InterestTokens are the interests lowercased and split, for comparing
+	// users' interests without re-parsing the display string.
+	InterestTokens []string
+	Tweets         []string
+	// Score is the user's profile score, used by SampleTopByScore.
+	Score float64
+	// HasLocation reports whether the user has shared a location; Lat and
+	// Long are only meaningful when it is set.
+	HasLocation bool
+	Lat         float64
+	Long        float64
 }
 
 // Service handles pairwise matching logic.
@@ -53,21 +104,180 @@ type Service struct {
 
 	// Worker pool
 	jobs chan matchingJob
+
+	// droppedJobs counts jobs discarded because the queue was full.
+	droppedJobs atomic.Uint64
+
+	// closeMu guards closed, which Shutdown sets to stop taking new work.
+	// producers tracks CalculateMatchesAsync calls still enqueueing and
+	// workers the running workers, so Shutdown can drain both.
+	closeMu   sync.Mutex
+	closed    bool
+	producers sync.WaitGroup
+	workers   sync.WaitGroup
+
+	// requireLocation skips viewers and candidates without a location.
+	requireLocation atomic.Bool
+
+	// maxTokens caps each match completion; 0 means no cap.
+	maxTokens atomic.Int64
+
+	// sampling narrows candidate lists; nil matches everyone.
+	sampling atomic.Pointer[SamplingStrategy]
+
+	// flags holds the feature flags; nil means all off.
+	flags atomic.Pointer[Flags]
+
+	// retryAttempts bounds AI calls per job; retryBackoff is the wait
+	// before the second attempt, doubling after each further failure.
+	retryAttempts atomic.Int64
+	retryBackoff  atomic.Int64
+
+	// roles switches to role-aware prompts; nil keeps them symmetric.
+	roles atomic.Pointer[MatchRoles]
+
+	// model is the chat model for match calls; nil means xai.DefaultModel.
+	model atomic.Pointer[xai.Model]
+
+	// promptTweets is how many tweets per user go in a match prompt; 0
+	// means DefaultPromptTweetLimit.
+	promptTweets atomic.Int64
+
+	// interests looks up users' interests for ViewerStats; stats caches
+	// its results.
+	interests atomic.Pointer[InterestLookup]
+	stats     statsCache
 }
 
+// MatchRoles frames the two sides of a directional match, e.g. a mentee
+// viewer looking at a mentor candidate. Each direction of a pair is then
+// scored as "how well does the candidate fill the role for the viewer",
+// so A->B and B->A can differ.
+type MatchRoles struct {
+	Viewer    string
+	Candidate string
+}
+
+// Direction says which side of a pair a match job scores. Forward is the
+// user the matches were computed for, in the MatchRoles.Viewer role;
+// Reverse is the candidate scoring them back, in the MatchRoles.Candidate
+// role. Without roles both directions get the same symmetric prompt.
+type Direction int
+
+const (
+	Forward Direction = iota
+	Reverse
+)
+
 type Storage interface {
-	GetMatch(viewerID, targetID string) (MatchResult, bool)
-	GetTopMatches(viewerID string, n int) []MatchResult
-	UpdateMatch(viewerID, targetID string, res MatchResult)
+	GetMatch(ctx context.Context, viewerID, targetID string) (MatchResult, bool)
+	// GetMatches returns the cached matches among targetIDs, keyed by target
+	// id; targets without a cached match are left out.
+	GetMatches(ctx context.Context, viewerID string, targetIDs []string) map[string]MatchResult
+	GetTopMatches(ctx context.Context, viewerID string, n int) []MatchResult
+	// GetTopMatchesAfter returns up to n matches ranked strictly below the
+	// cursor (score desc, then target id desc); a nil cursor starts at the top.
+	GetTopMatchesAfter(ctx context.Context, viewerID string, cursor *MatchCursor, n int) []MatchResult
+	UpdateMatch(ctx context.Context, viewerID, targetID string, res MatchResult)
+	// RecordFailure sets LastError and LastErrorAt on an existing match and
+	// leaves the rest of it alone. It does nothing when there is no match,
+	// or when another write replaced the match while it was being updated.
+	RecordFailure(ctx context.Context, viewerID, targetID, msg string, at time.Time)
+	ClearMatches(ctx context.Context, viewerID string)
+	// RemoveUserMatches deletes every match the user is part of, both as
+	// viewer and as target.
+	RemoveUserMatches(ctx context.Context, userID string)
+	// MatchVersion returns a counter that increases every time the viewer's
+	// match set changes, so callers can detect changes without diffing.
+	MatchVersion(ctx context.Context, viewerID string) uint64
+	// PinMatch and UnpinMatch add and remove targetID from the viewer's
+	// pinned set; PinnedMatches lists it in no particular order. Pins
+	// survive ClearMatches but not RemoveUserMatches. PinMatch checks the
+	// set's size and adds to it in one step, returning ErrPinLimit when it
+	// already holds limit other targets; re-pinning is a no-op.
+	PinMatch(ctx context.Context, viewerID, targetID string, limit int) error
+	UnpinMatch(ctx context.Context, viewerID, targetID string)
+	IsPinned(ctx context.Context, viewerID, targetID string) bool
+	PinnedMatches(ctx context.Context, viewerID string) []string
+	// AllMatches calls fn for every stored match, in no particular order,
+	// and stops at the first error fn returns.
+	AllMatches(ctx context.Context, fn func(viewerID string, m MatchResult) error) error
+	// MatchedBy returns up to n viewers whose match with targetID scored at
+	// least minScore, highest first (ties by viewer id desc).
+	MatchedBy(ctx context.Context, targetID string, minScore float64, n int) []ReverseMatch
+	// Reindex rebuilds any secondary indexes from the stored matches and
+	// returns how many matches it indexed.
+	Reindex(ctx context.Context) (int, error)
 	LoadFromFile(path string) error
 }
 
+// ReverseMatch is another viewer's stored match with a user: ViewerID
+// scored the user Score.
+type ReverseMatch struct {
+	ViewerID string  `json:"viewer_id"`
+	Score    float64 `json:"score"`
+}
+
+// sortReverseMatches orders by score desc, then viewer id desc, matching
+// the ZREVRANGE order redis returns.
+func sortReverseMatches(out []ReverseMatch) {
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].ViewerID > out[j].ViewerID
+	})
+}
+
+// MatchCursor marks the last match a client has seen. Paging by (score, id)
+// instead of an offset means score changes between pages can't shift
+// entries and cause skips or duplicates.
+type MatchCursor struct {
+	Score    float64
+	TargetID string
+}
+
+// CursorAfter returns the cursor pointing just past m.
+func CursorAfter(m MatchResult) *MatchCursor {
+	return &MatchCursor{Score: m.Score, TargetID: m.TargetID}
+}
+
+// Encode returns an opaque, URL-safe form of the cursor.
+func (c MatchCursor) Encode() string {
+	raw := strconv.FormatFloat(c.Score, 'f', -1, 64) + ":" + c.TargetID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseMatchCursor decodes a cursor produced by Encode.
+func ParseMatchCursor(v string) (*MatchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	score, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &MatchCursor{Score: f, TargetID: id}, nil
+}
+
+// ranksBelow reports whether m sorts after the cursor.
+func (c MatchCursor) ranksBelow(m MatchResult) bool {
+	return m.Score < c.Score || (m.Score == c.Score && m.TargetID < c.TargetID)
+}
+
 type MemoryStorage struct {
-	mu    sync.RWMutex
-	cache map[string]map[string]MatchResult
+	mu       sync.RWMutex
+	cache    map[string]map[string]MatchResult
+	versions map[string]uint64
+	pins     map[string]map[string]struct{}
 }
 
-func (s *MemoryStorage) GetMatch(viewerID, targetID string) (MatchResult, bool) {
+func (s *MemoryStorage) GetMatch(ctx context.Context, viewerID, targetID string) (MatchResult, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if vDeps, ok := s.cache[viewerID]; ok {
@@ -78,33 +288,216 @@ func (s *MemoryStorage) GetMatch(viewerID, targetID string) (MatchResult, bool)
 	return MatchResult{}, false
 }
 
-func (s *MemoryStorage) GetTopMatches(viewerID string, n int) []MatchResult {
+func (s *MemoryStorage) GetMatches(ctx context.Context, viewerID string, targetIDs []string) map[string]MatchResult {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	vDeps, ok := s.cache[viewerID]
-	if !ok || len(vDeps) == 0 {
-		return []MatchResult{}
+	out := make(map[string]MatchResult, len(targetIDs))
+	for _, id := range targetIDs {
+		if m, ok := s.cache[viewerID][id]; ok {
+			out[id] = m
+		}
 	}
-	matches := make([]MatchResult, 0, len(vDeps))
-	for _, m := range vDeps {
+	return out
+}
+
+func (s *MemoryStorage) GetTopMatches(ctx context.Context, viewerID string, n int) []MatchResult {
+	return s.GetTopMatchesAfter(ctx, viewerID, nil, n)
+}
+
+func (s *MemoryStorage) GetTopMatchesAfter(ctx context.Context, viewerID string, cursor *MatchCursor, n int) []MatchResult {
+	s.mu.RLock()
+	matches := make([]MatchResult, 0, len(s.cache[viewerID]))
+	for _, m := range s.cache[viewerID] {
 		matches = append(matches, m)
 	}
+	s.mu.RUnlock()
+
+	// Same order as ZREVRANGE on the redis ZSET: score desc, ties by target
+	// id desc. Without the tie-break, map order would shuffle equal scores
+	// between requests.
 	sort.Slice(matches, func(i, j int) bool {
-		return matches[i].Score > matches[j].Score
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].TargetID > matches[j].TargetID
 	})
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			return cursor.ranksBelow(matches[i])
+		})
+	}
+	matches = matches[start:]
 	if len(matches) > n {
-		return matches[:n]
+		matches = matches[:n]
 	}
 	return matches
 }
 
-func (s *MemoryStorage) UpdateMatch(viewerID, targetID string, res MatchResult) {
+func (s *MemoryStorage) UpdateMatch(ctx context.Context, viewerID, targetID string, res MatchResult) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, ok := s.cache[viewerID]; !ok {
 		s.cache[viewerID] = make(map[string]MatchResult)
 	}
 	s.cache[viewerID][targetID] = res
+	s.bumpVersionLocked(viewerID)
+}
+
+func (s *MemoryStorage) RecordFailure(ctx context.Context, viewerID, targetID, msg string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.cache[viewerID][targetID]
+	if !ok {
+		return
+	}
+	m.LastError = msg
+	m.LastErrorAt = &at
+	s.cache[viewerID][targetID] = m
+	s.bumpVersionLocked(viewerID)
+}
+
+func (s *MemoryStorage) bumpVersionLocked(viewerID string) {
+	if s.versions == nil {
+		s.versions = make(map[string]uint64)
+	}
+	s.versions[viewerID]++
+}
+
+func (s *MemoryStorage) MatchVersion(ctx context.Context, viewerID string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.versions[viewerID]
+}
+
+func (s *MemoryStorage) ClearMatches(ctx context.Context, viewerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cache[viewerID]; !ok {
+		return
+	}
+	delete(s.cache, viewerID)
+	s.bumpVersionLocked(viewerID)
+}
+
+func (s *MemoryStorage) RemoveUserMatches(ctx context.Context, userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cache[userID]; ok {
+		delete(s.cache, userID)
+		s.bumpVersionLocked(userID)
+	}
+	delete(s.pins, userID)
+	for _, pinned := range s.pins {
+		delete(pinned, userID)
+	}
+	for viewerID, matches := range s.cache {
+		if _, ok := matches[userID]; ok {
+			delete(matches, userID)
+			s.bumpVersionLocked(viewerID)
+		}
+	}
+}
+
+func (s *MemoryStorage) PinMatch(ctx context.Context, viewerID, targetID string, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pins == nil {
+		s.pins = make(map[string]map[string]struct{})
+	}
+	if _, ok := s.pins[viewerID]; !ok {
+		s.pins[viewerID] = make(map[string]struct{})
+	}
+	if _, ok := s.pins[viewerID][targetID]; ok {
+		return nil
+	}
+	if len(s.pins[viewerID]) >= limit {
+		return ErrPinLimit
+	}
+	s.pins[viewerID][targetID] = struct{}{}
+	s.bumpVersionLocked(viewerID)
+	return nil
+}
+
+func (s *MemoryStorage) UnpinMatch(ctx context.Context, viewerID, targetID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pins[viewerID][targetID]; !ok {
+		return
+	}
+	delete(s.pins[viewerID], targetID)
+	s.bumpVersionLocked(viewerID)
+}
+
+func (s *MemoryStorage) IsPinned(ctx context.Context, viewerID, targetID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.pins[viewerID][targetID]
+	return ok
+}
+
+func (s *MemoryStorage) PinnedMatches(ctx context.Context, viewerID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.pins[viewerID]))
+	for id := range s.pins[viewerID] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// MatchedBy scans every viewer's matches; the memory store is small.
+func (s *MemoryStorage) MatchedBy(ctx context.Context, targetID string, minScore float64, n int) []ReverseMatch {
+	s.mu.RLock()
+	out := []ReverseMatch{}
+	for viewerID, matches := range s.cache {
+		if m, ok := matches[targetID]; ok && viewerID != targetID && m.Score >= minScore {
+			out = append(out, ReverseMatch{ViewerID: viewerID, Score: m.Score})
+		}
+	}
+	s.mu.RUnlock()
+	sortReverseMatches(out)
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Reindex has nothing to rebuild: the memory store keeps no secondary
+// indexes. It reports the number of stored matches.
+func (s *MemoryStorage) Reindex(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, matches := range s.cache {
+		n += len(matches)
+	}
+	return n, nil
+}
+
+func (s *MemoryStorage) AllMatches(ctx context.Context, fn func(viewerID string, m MatchResult) error) error {
+	s.mu.RLock()
+	viewers := make([]string, 0, len(s.cache))
+	for viewerID := range s.cache {
+		viewers = append(viewers, viewerID)
+	}
+	s.mu.RUnlock()
+
+	// Copy one viewer at a time so a slow fn doesn't hold the lock.
+	for _, viewerID := range viewers {
+		s.mu.RLock()
+		matches := make([]MatchResult, 0, len(s.cache[viewerID]))
+		for _, m := range s.cache[viewerID] {
+			matches = append(matches, m)
+		}
+		s.mu.RUnlock()
+		for _, m := range matches {
+			if err := fn(viewerID, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (s *MemoryStorage) LoadFromFile(path string) error {
@@ -123,62 +516,651 @@ func (s *MemoryStorage) LoadFromFile(path string) error {
 			s.cache[m.ViewerID] = make(map[string]MatchResult)
 		}
 		s.cache[m.ViewerID][m.TargetID] = MatchResult{
-			TargetID:  m.TargetID,
-			Score:     m.Score,
-			Reason:    m.Reason,
-			Timestamp: time.Now(),
+			TargetID:   m.TargetID,
+			Score:      m.Score,
+			Reason:     m.Reason,
+			ReasonTags: m.ReasonTags,
+			Timestamp:  time.Now(),
+			Model:      m.Model,
 		}
+		s.bumpVersionLocked(m.ViewerID)
 	}
 	return nil
 }
 
+// redisTimeout bounds each redis call so a slow redis can't stall callers.
+const redisTimeout = 3 * time.Second
+
+// redisScanTimeout bounds key scans, which walk the whole keyspace.
+const redisScanTimeout = 10 * time.Second
+
 type RedisStorage struct {
 	client *redis.Client
+	// readClient, when set, serves read-only lookups (e.g. a replica).
+	readClient *redis.Client
+	// compress gzips stored match JSON; either form is read back. It is
+	// atomic because it can be toggled while workers write.
+	compress atomic.Bool
+}
+
+func (s *RedisStorage) reader() *redis.Client {
+	if s.readClient != nil {
+		return s.readClient
+	}
+	return s.client
+}
+
+func (s *RedisStorage) GetMatch(ctx context.Context, viewerID, targetID string) (MatchResult, bool) {
+	m, ok, err := s.lookupMatch(ctx, viewerID, targetID)
+	if err != nil {
+		log.Printf("[matcher] warning: redis get error viewer=%s target=%s: %v", viewerID, targetID, err)
+	}
+	return m, ok
 }
 
-func (s *RedisStorage) GetMatch(viewerID, targetID string) (MatchResult, bool) {
-	ctx := context.Background()
-	val, err := s.client.Get(ctx, fmt.Sprintf("match:%s:%s", viewerID, targetID)).Bytes()
+// lookupMatch reports a missing match as (false, nil) and only returns an
+// error for redis or decode failures.
+func (s *RedisStorage) lookupMatch(ctx context.Context, viewerID, targetID string) (MatchResult, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	val, err := s.reader().Get(ctx, fmt.Sprintf("match:%s:%s", viewerID, targetID)).Bytes()
+	if err == redis.Nil {
+		return MatchResult{}, false, nil
+	}
 	if err != nil {
-		return MatchResult{}, false
+		return MatchResult{}, false, err
 	}
 	var m MatchResult
-	json.Unmarshal(val, &m)
-	return m, true
+	if err := codec.Unmarshal(val, &m); err != nil {
+		return MatchResult{}, false, fmt.Errorf("decode match %s:%s: %w", viewerID, targetID, err)
+	}
+	return m, true, nil
+}
+
+func (s *RedisStorage) GetMatches(ctx context.Context, viewerID string, targetIDs []string) map[string]MatchResult {
+	out := make(map[string]MatchResult, len(targetIDs))
+	if len(targetIDs) == 0 {
+		return out
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	for _, m := range s.matchDetails(ctx, viewerID, targetIDs) {
+		out[m.TargetID] = m
+	}
+	return out
 }
 
-func (s *RedisStorage) GetTopMatches(viewerID string, n int) []MatchResult {
-	ctx := context.Background()
+func (s *RedisStorage) GetTopMatches(ctx context.Context, viewerID string, n int) []MatchResult {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
 	// Get IDs from ZSET
-	ids, err := s.client.ZRevRange(ctx, "matches:"+viewerID, 0, int64(n-1)).Result()
+	ids, err := s.reader().ZRevRange(ctx, "matches:"+viewerID, 0, int64(n-1)).Result()
 	if err != nil {
 		return []MatchResult{}
 	}
-	out := make([]MatchResult, 0, len(ids))
+	if len(ids) == 0 {
+		return []MatchResult{}
+	}
+	return s.matchDetails(ctx, viewerID, ids)
+}
+
+func (s *RedisStorage) GetTopMatchesAfter(ctx context.Context, viewerID string, cursor *MatchCursor, n int) []MatchResult {
+	if cursor == nil {
+		return s.GetTopMatches(ctx, viewerID, n)
+	}
+	if n <= 0 {
+		return []MatchResult{}
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	key := "matches:" + viewerID
+	score := strconv.FormatFloat(cursor.Score, 'f', -1, 64)
+
+	// Members tied with the cursor's score come back in reverse lex order,
+	// so keep the ones after the cursor id, then continue strictly below.
+	ties, err := s.reader().ZRevRangeByScore(ctx, key, &redis.ZRangeBy{Max: score, Min: score}).Result()
+	if err != nil {
+		log.Printf("[matcher] redis range error viewer=%s: %v", viewerID, err)
+		return []MatchResult{}
+	}
+	ids := make([]string, 0, n)
+	for _, id := range ties {
+		if id < cursor.TargetID && len(ids) < n {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) < n {
+		below, err := s.reader().ZRevRangeByScore(ctx, key, &redis.ZRangeBy{
+			Max:   "(" + score,
+			Min:   "-inf",
+			Count: int64(n - len(ids)),
+		}).Result()
+		if err != nil {
+			log.Printf("[matcher] redis range error viewer=%s: %v", viewerID, err)
+			return []MatchResult{}
+		}
+		ids = append(ids, below...)
+	}
+	if len(ids) == 0 {
+		return []MatchResult{}
+	}
+	return s.matchDetails(ctx, viewerID, ids)
+}
+
+// matchDetails loads the stored match for each ranked id, keeping order and
+// skipping ids whose detail key is missing or unreadable.
+func (s *RedisStorage) matchDetails(ctx context.Context, viewerID string, ids []string) []MatchResult {
+	keys := make([]string, 0, len(ids))
 	for _, id := range ids {
-		// Parallel fetch or individual (individual for simplicity now)
-		if m, ok := s.GetMatch(viewerID, id); ok {
-			out = append(out, m)
+		keys = append(keys, fmt.Sprintf("match:%s:%s", viewerID, id))
+	}
+	// Single MGET instead of one GET per id; results keep the ZSET order.
+	vals, err := s.reader().MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("[matcher] redis mget error: %v", err)
+		return []MatchResult{}
+	}
+	out := make([]MatchResult, 0, len(vals))
+	for _, v := range vals {
+		str, ok := v.(string)
+		if !ok {
+			continue // missing detail key
 		}
+		var m MatchResult
+		if err := codec.Unmarshal([]byte(str), &m); err != nil {
+			continue
+		}
+		out = append(out, m)
 	}
 	return out
 }
 
-func (s *RedisStorage) UpdateMatch(viewerID, targetID string, res MatchResult) {
-	ctx := context.Background()
-	data, _ := json.Marshal(res)
+// updateMatchScript stores a match's details, ranking and reverse index
+// entries and bumps the viewer's version. While a Reindex runs, the index
+// entries also go into the keys it is building, so the swap keeps them.
+var updateMatchScript = redis.NewScript(`
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[2], ARGV[4])
+redis.call('INCR', KEYS[4])
+local tmp = redis.call('GET', KEYS[5])
+if tmp then
+	redis.call('ZADD', tmp .. KEYS[2], ARGV[2], ARGV[3])
+	redis.call('ZADD', tmp .. KEYS[3], ARGV[2], ARGV[4])
+	redis.call('EXPIRE', tmp .. KEYS[2], ARGV[5])
+	redis.call('EXPIRE', tmp .. KEYS[3], ARGV[5])
+end
+return 1
+`)
 
-	pipe := s.client.Pipeline()
-	// Store details
-	pipe.Set(ctx, fmt.Sprintf("match:%s:%s", viewerID, targetID), data, 0)
-	// Update ranking
-	pipe.ZAdd(ctx, "matches:"+viewerID, redis.Z{Score: res.Score, Member: targetID})
-	_, err := pipe.Exec(ctx)
+func (s *RedisStorage) UpdateMatch(ctx context.Context, viewerID, targetID string, res MatchResult) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	data, _ := codec.Marshal(res, s.compress.Load())
+
+	keys := []string{
+		fmt.Sprintf("match:%s:%s", viewerID, targetID),
+		"matches:" + viewerID,
+		matchedByKey(targetID),
+		matchVersionKey(viewerID),
+		reindexActiveKey,
+	}
+	score := strconv.FormatFloat(res.Score, 'f', -1, 64)
+	err := updateMatchScript.Run(ctx, s.client, keys, data, score, targetID, viewerID, int(reindexKeyTTL.Seconds())).Err()
 	if err != nil {
 		log.Printf("[matcher] redis update error: %v", err)
 	}
 }
 
+// RecordFailure reads the match from the primary under WATCH, so neither a
+// lagging replica nor a result written in between is overwritten with the
+// older score and reason.
+func (s *RedisStorage) RecordFailure(ctx context.Context, viewerID, targetID, msg string, at time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	key := fmt.Sprintf("match:%s:%s", viewerID, targetID)
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, key).Bytes()
+		if err != nil {
+			return err
+		}
+		var m MatchResult
+		if err := codec.Unmarshal(val, &m); err != nil {
+			return fmt.Errorf("decode match %s:%s: %w", viewerID, targetID, err)
+		}
+		m.LastError = msg
+		m.LastErrorAt = &at
+		data, _ := codec.Marshal(m, s.compress.Load())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			pipe.Incr(ctx, matchVersionKey(viewerID))
+			return nil
+		})
+		return err
+	}, key)
+	switch {
+	case err == nil, errors.Is(err, redis.Nil):
+	case errors.Is(err, redis.TxFailedErr):
+		// A newer result landed meanwhile; it supersedes this failure.
+	default:
+		log.Printf("[matcher] redis record failure error viewer=%s target=%s: %v", viewerID, targetID, err)
+	}
+}
+
+// activeReindex returns the temporary key prefix of a running Reindex, or
+// "" when none is running.
+func (s *RedisStorage) activeReindex(ctx context.Context) string {
+	tmp, err := s.client.Get(ctx, reindexActiveKey).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("[matcher] redis reindex marker error: %v", err)
+	}
+	return tmp
+}
+
+func (s *RedisStorage) ClearMatches(ctx context.Context, viewerID string) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	ids, err := s.client.ZRange(ctx, "matches:"+viewerID, 0, -1).Result()
+	if err != nil {
+		log.Printf("[matcher] redis clear error: %v", err)
+		return
+	}
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, fmt.Sprintf("match:%s:%s", viewerID, id))
+	}
+	keys = append(keys, "matches:"+viewerID)
+	tmp := s.activeReindex(ctx)
+
+	pipe := s.client.Pipeline()
+	pipe.Del(ctx, keys...)
+	for _, id := range ids {
+		pipe.ZRem(ctx, matchedByKey(id), viewerID)
+	}
+	if tmp != "" {
+		pipe.Del(ctx, tmp+"matches:"+viewerID)
+		for _, id := range ids {
+			pipe.ZRem(ctx, tmp+matchedByKey(id), viewerID)
+		}
+	}
+	pipe.Incr(ctx, matchVersionKey(viewerID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[matcher] redis clear error: %v", err)
+	}
+}
+
+func (s *RedisStorage) RemoveUserMatches(ctx context.Context, userID string) {
+	s.ClearMatches(ctx, userID)
+
+	// Other viewers' matches pointing at the user are found by key pattern.
+	ctx, cancel := context.WithTimeout(ctx, redisScanTimeout)
+	defer cancel()
+	suffix := ":" + userID
+	tmp := s.activeReindex(ctx)
+	pipe := s.client.Pipeline()
+	pipe.Del(ctx, pinnedKey(userID), matchedByKey(userID))
+	if tmp != "" {
+		pipe.Del(ctx, tmp+matchedByKey(userID))
+	}
+	iter := s.client.Scan(ctx, 0, "match:*"+suffix, 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		viewerID := strings.TrimSuffix(strings.TrimPrefix(key, "match:"), suffix)
+		pipe.Del(ctx, key)
+		pipe.ZRem(ctx, "matches:"+viewerID, userID)
+		if tmp != "" {
+			pipe.ZRem(ctx, tmp+"matches:"+viewerID, userID)
+		}
+		pipe.SRem(ctx, pinnedKey(viewerID), userID)
+		pipe.Incr(ctx, matchVersionKey(viewerID))
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("[matcher] redis remove user scan error: %v", err)
+		return
+	}
+	if pipe.Len() == 0 {
+		return
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[matcher] redis remove user error: %v", err)
+	}
+}
+
+func (s *RedisStorage) MatchVersion(ctx context.Context, viewerID string) uint64 {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	v, err := s.reader().Get(ctx, matchVersionKey(viewerID)).Uint64()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("[matcher] redis version error: %v", err)
+		}
+		return 0
+	}
+	return v
+}
+
+// MatchedBy reads the matched_by:<target> index kept by UpdateMatch.
+// Matches stored before the index existed are missing until recomputed.
+func (s *RedisStorage) MatchedBy(ctx context.Context, targetID string, minScore float64, n int) []ReverseMatch {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	rng := &redis.ZRangeBy{Max: "+inf", Min: strconv.FormatFloat(minScore, 'f', -1, 64)}
+	if n > 0 {
+		rng.Count = int64(n)
+	}
+	zs, err := s.reader().ZRevRangeByScoreWithScores(ctx, matchedByKey(targetID), rng).Result()
+	if err != nil {
+		log.Printf("[matcher] redis matched-by error target=%s: %v", targetID, err)
+		return []ReverseMatch{}
+	}
+	out := make([]ReverseMatch, 0, len(zs))
+	for _, z := range zs {
+		id, _ := z.Member.(string)
+		out = append(out, ReverseMatch{ViewerID: id, Score: z.Score})
+	}
+	return out
+}
+
+// AllMatches scans the match detail keys in batches. Matches written during
+// the scan may or may not be included.
+func (s *RedisStorage) AllMatches(ctx context.Context, fn func(viewerID string, m MatchResult) error) error {
+	var cursor uint64
+	for {
+		scanCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+		keys, next, err := s.reader().Scan(scanCtx, cursor, "match:*", 500).Result()
+		var vals []any
+		if err == nil && len(keys) > 0 {
+			vals, err = s.reader().MGet(scanCtx, keys...).Result()
+		}
+		cancel()
+		if err != nil {
+			return fmt.Errorf("scan matches: %w", err)
+		}
+		for i, v := range vals {
+			str, ok := v.(string)
+			if !ok {
+				continue // deleted since the scan
+			}
+			viewerID, _, ok := strings.Cut(strings.TrimPrefix(keys[i], "match:"), ":")
+			if !ok {
+				continue
+			}
+			var m MatchResult
+			if err := codec.Unmarshal([]byte(str), &m); err != nil {
+				log.Printf("[matcher] skipping unreadable match %s: %v", keys[i], err)
+				continue
+			}
+			if err := fn(viewerID, m); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ErrReindexRunning is returned by Reindex while another run is in
+// progress.
+var ErrReindexRunning = errors.New("a reindex is already running")
+
+// reindexKeyTTL expires a Reindex run's temporary keys, and its marker, if
+// it dies before cleaning them up.
+const reindexKeyTTL = time.Hour
+
+// reindexActiveKey holds the temporary key prefix of the running Reindex,
+// so writes made meanwhile also reach the index it is building.
+const reindexActiveKey = "reindex:matches:active"
+
+// dropStaleIndexScript deletes an index key unless a write during the
+// Reindex (ARGV[1] is its prefix) has recreated its temporary key.
+const dropStaleIndexScript = `
+if redis.call('EXISTS', ARGV[1] .. KEYS[1]) == 0 then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// Reindex rebuilds the matches:<viewer> rankings and the matched_by:<target>
+// reverse index from the match detail keys. Each index is built under a
+// temporary key and renamed into place, so readers see the old index or the
+// new one, never a partial one. While it runs, reindexActiveKey names the
+// temporary prefix and UpdateMatch, ClearMatches and RemoveUserMatches apply
+// their index changes there too, so live traffic isn't lost in the swap.
+// Index keys with no matches behind them are deleted. Only one Reindex runs
+// at a time.
+func (s *RedisStorage) Reindex(ctx context.Context) (int, error) {
+	tmp := fmt.Sprintf("reindex:%d:", time.Now().UnixNano())
+	markCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+	started, err := s.client.SetNX(markCtx, reindexActiveKey, tmp, reindexKeyTTL).Result()
+	cancel()
+	if err != nil {
+		return 0, fmt.Errorf("mark reindex: %w", err)
+	}
+	if !started {
+		return 0, ErrReindexRunning
+	}
+	defer s.finishReindex(context.WithoutCancel(ctx), tmp)
+
+	indexed := 0
+	var cursor uint64
+	for {
+		batchCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+		keys, next, err := s.client.Scan(batchCtx, cursor, "match:*", 500).Result()
+		var vals []any
+		if err == nil && len(keys) > 0 {
+			vals, err = s.client.MGet(batchCtx, keys...).Result()
+		}
+		if err != nil {
+			cancel()
+			return indexed, fmt.Errorf("scan matches: %w", err)
+		}
+		pipe := s.client.Pipeline()
+		for i, v := range vals {
+			str, ok := v.(string)
+			if !ok {
+				continue // deleted since the scan
+			}
+			viewerID, targetID, ok := strings.Cut(strings.TrimPrefix(keys[i], "match:"), ":")
+			if !ok {
+				continue
+			}
+			var m MatchResult
+			if err := codec.Unmarshal([]byte(str), &m); err != nil {
+				log.Printf("[matcher] reindex skipping unreadable match %s: %v", keys[i], err)
+				continue
+			}
+			ranking, rev := tmp+"matches:"+viewerID, tmp+matchedByKey(targetID)
+			pipe.ZAdd(batchCtx, ranking, redis.Z{Score: m.Score, Member: targetID})
+			pipe.ZAdd(batchCtx, rev, redis.Z{Score: m.Score, Member: viewerID})
+			pipe.Expire(batchCtx, ranking, reindexKeyTTL)
+			pipe.Expire(batchCtx, rev, reindexKeyTTL)
+			indexed++
+		}
+		if pipe.Len() > 0 {
+			_, err = pipe.Exec(batchCtx)
+		}
+		cancel()
+		if err != nil {
+			return indexed, fmt.Errorf("build index: %w", err)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	// Swap in every temporary key, including ones live writes created.
+	built, err := s.scanKeys(ctx, tmp+"*")
+	if err != nil {
+		return indexed, fmt.Errorf("scan new index keys: %w", err)
+	}
+	swapped := make(map[string]bool, len(built))
+	pipe := s.client.Pipeline()
+	flush := func() error {
+		if pipe.Len() < 500 {
+			return nil
+		}
+		return s.execReindex(ctx, pipe)
+	}
+	for _, key := range built {
+		real := strings.TrimPrefix(key, tmp)
+		pipe.Rename(ctx, key, real)
+		pipe.Persist(ctx, real)
+		if viewerID, ok := strings.CutPrefix(real, "matches:"); ok {
+			pipe.Incr(ctx, matchVersionKey(viewerID))
+		}
+		swapped[real] = true
+		if err := flush(); err != nil {
+			return indexed, err
+		}
+	}
+	for _, pattern := range []string{"matches:*", "matched_by:*"} {
+		scanCtx, cancel := context.WithTimeout(ctx, redisScanTimeout)
+		iter := s.client.Scan(scanCtx, 0, pattern, 500).Iterator()
+		for iter.Next(scanCtx) {
+			if key := iter.Val(); !swapped[key] {
+				pipe.Eval(ctx, dropStaleIndexScript, []string{key}, tmp)
+				if err := flush(); err != nil {
+					cancel()
+					return indexed, err
+				}
+			}
+		}
+		err := iter.Err()
+		cancel()
+		if err != nil {
+			return indexed, fmt.Errorf("scan index keys: %w", err)
+		}
+	}
+	if pipe.Len() > 0 {
+		if err := s.execReindex(ctx, pipe); err != nil {
+			return indexed, err
+		}
+	}
+	return indexed, nil
+}
+
+// finishReindex clears the reindex marker, then drops temporary keys that
+// were never swapped in: those of a failed run, or ones a live write
+// recreated after its swap.
+func (s *RedisStorage) finishReindex(ctx context.Context, tmp string) {
+	delCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	if err := s.client.Del(delCtx, reindexActiveKey).Err(); err != nil {
+		log.Printf("[matcher] reindex marker cleanup error: %v", err)
+		return
+	}
+	left, err := s.scanKeys(ctx, tmp+"*")
+	if err == nil && len(left) > 0 {
+		err = s.client.Del(delCtx, left...).Err()
+	}
+	if err != nil {
+		log.Printf("[matcher] reindex cleanup error: %v", err)
+	}
+}
+
+// scanKeys lists the keys matching pattern.
+func (s *RedisStorage) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	scanCtx, cancel := context.WithTimeout(ctx, redisScanTimeout)
+	defer cancel()
+	var keys []string
+	iter := s.client.Scan(scanCtx, 0, pattern, 500).Iterator()
+	for iter.Next(scanCtx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// execReindex runs one batch of Reindex's swap commands. A temporary key
+// that a concurrent ClearMatches deleted before its rename is skipped.
+func (s *RedisStorage) execReindex(ctx context.Context, pipe redis.Pipeliner) error {
+	execCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	cmds, _ := pipe.Exec(execCtx)
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != redis.Nil && !strings.Contains(err.Error(), "no such key") {
+			return fmt.Errorf("swap index: %w", err)
+		}
+	}
+	return nil
+}
+
+// matchedByKey is the reverse index of viewers who have a match with
+// targetID, scored by that match.
+func matchedByKey(targetID string) string {
+	return "matched_by:" + targetID
+}
+
+func matchVersionKey(viewerID string) string {
+	return "matches_version:" + viewerID
+}
+
+func pinnedKey(viewerID string) string {
+	return "pinned:" + viewerID
+}
+
+// pinMatchScript adds a pin unless the set is already full, so concurrent
+// pins can't overshoot the limit. It returns 0 when the set is full.
+var pinMatchScript = redis.NewScript(`
+if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+	return 1
+end
+if redis.call('SCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('SADD', KEYS[1], ARGV[1])
+redis.call('INCR', KEYS[2])
+return 1
+`)
+
+func (s *RedisStorage) PinMatch(ctx context.Context, viewerID, targetID string, limit int) error {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	keys := []string{pinnedKey(viewerID), matchVersionKey(viewerID)}
+	added, err := pinMatchScript.Run(ctx, s.client, keys, targetID, limit).Int()
+	if err != nil {
+		return fmt.Errorf("pin match: %w", err)
+	}
+	if added == 0 {
+		return ErrPinLimit
+	}
+	return nil
+}
+
+func (s *RedisStorage) UnpinMatch(ctx context.Context, viewerID, targetID string) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	pipe := s.client.Pipeline()
+	pipe.SRem(ctx, pinnedKey(viewerID), targetID)
+	pipe.Incr(ctx, matchVersionKey(viewerID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[matcher] redis unpin error viewer=%s target=%s: %v", viewerID, targetID, err)
+	}
+}
+
+func (s *RedisStorage) IsPinned(ctx context.Context, viewerID, targetID string) bool {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	ok, err := s.reader().SIsMember(ctx, pinnedKey(viewerID), targetID).Result()
+	if err != nil {
+		log.Printf("[matcher] redis pin lookup error viewer=%s: %v", viewerID, err)
+	}
+	return ok
+}
+
+func (s *RedisStorage) PinnedMatches(ctx context.Context, viewerID string) []string {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	ids, err := s.reader().SMembers(ctx, pinnedKey(viewerID)).Result()
+	if err != nil {
+		log.Printf("[matcher] redis pin list error viewer=%s: %v", viewerID, err)
+		return nil
+	}
+	return ids
+}
+
 func (s *RedisStorage) LoadFromFile(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -189,33 +1171,49 @@ func (s *RedisStorage) LoadFromFile(path string) error {
 		return err
 	}
 	for _, m := range matches {
-		s.UpdateMatch(m.ViewerID, m.TargetID, MatchResult{
-			TargetID:  m.TargetID,
-			Score:     m.Score,
-			Reason:    m.Reason,
-			Timestamp: time.Now(),
+		s.UpdateMatch(context.Background(), m.ViewerID, m.TargetID, MatchResult{
+			TargetID:   m.TargetID,
+			Score:      m.Score,
+			Reason:     m.Reason,
+			ReasonTags: m.ReasonTags,
+			Timestamp:  time.Now(),
+			Model:      m.Model,
 		})
 	}
 	return nil
 }
 
 type matchingJob struct {
+	// ctx carries values of the request that queued the job, such as its
+	// xAI trace id, but not its cancellation.
+	ctx       context.Context
 	viewer    UserInput
 	candidate UserInput
+	direction Direction
 }
 
+// ErrNoAIClient is returned by match calculations when the service was
+// built without an xAI API key.
+var ErrNoAIClient = errors.New("matcher has no AI client configured")
+
 // NewService creates a new matching service with a background worker pool.
-func NewService(apiKey string, redisAddr, redisPwd string, redisDB int) *Service {
-	client := xai.NewClient(apiKey)
+// client is shared with the caller's other xAI work, so limits such as its
+// concurrency cap cover both. With a nil client the service still serves
+// stored matches but computes no new ones.
+func NewService(client AIClient, redisAddr, redisPwd string, redisDB int) *Service {
+	if client == nil {
+		log.Printf("[matcher] warning: no xAI API key configured, match calculation is disabled")
+	}
 	var storage Storage
 	if redisAddr != "" {
-		storage = &RedisStorage{
-			client: redis.NewClient(&redis.Options{
+		rs := &RedisStorage{
+			client: redisguard.Install(redis.NewClient(&redis.Options{
 				Addr:     redisAddr,
 				Password: redisPwd,
 				DB:       redisDB,
-			}),
+			})),
 		}
+		storage = rs
 		log.Printf("[matcher] using redis storage")
 	} else {
 		storage = &MemoryStorage{
@@ -229,9 +1227,9 @@ func NewService(apiKey string, redisAddr, redisPwd string, redisDB int) *Service
 		storage:  storage,
 		jobs:     make(chan matchingJob, 1000),
 	}
-	for i := 0; i < 5; i++ {
-		go s.worker(i)
-	}
+	s.maxTokens.Store(DefaultMaxTokens)
+	s.SetRetry(DefaultRetryAttempts, DefaultRetryBackoff)
+	s.startWorkers(5)
 	return s
 }
 
@@ -245,121 +1243,648 @@ func NewServiceWithClient(client AIClient) *Service {
 		},
 		jobs: make(chan matchingJob, 1000),
 	}
-	for i := 0; i < 5; i++ {
-		go s.worker(i)
-	}
+	s.maxTokens.Store(DefaultMaxTokens)
+	s.SetRetry(DefaultRetryAttempts, DefaultRetryBackoff)
+	s.startWorkers(5)
 	return s
 }
 
+// AllMatches calls fn for every stored match and stops at the first error fn
+// returns. Order is unspecified.
+func (s *Service) AllMatches(ctx context.Context, fn func(viewerID string, m MatchResult) error) error {
+	return s.storage.AllMatches(ctx, fn)
+}
+
 // LoadFromFile loads pre-calculated matches from a JSON file.
 func (s *Service) LoadFromFile(path string) error {
 	return s.storage.LoadFromFile(path)
 }
 
 // GetMatch returns a specific match result from cache. Returns empty if not found.
-func (s *Service) GetMatch(viewerID, targetID string) MatchResult {
-	if m, ok := s.storage.GetMatch(viewerID, targetID); ok {
+func (s *Service) GetMatch(ctx context.Context, viewerID, targetID string) MatchResult {
+	if m, ok := s.storage.GetMatch(ctx, viewerID, targetID); ok {
 		return m
 	}
 	return MatchResult{}
 }
 
-// GetTopMatches returns the top N matches for the viewer.
-func (s *Service) GetTopMatches(viewerID string, n int) []MatchResult {
-	return s.storage.GetTopMatches(viewerID, n)
+// FindMatch returns the cached match and whether one exists.
+func (s *Service) FindMatch(ctx context.Context, viewerID, targetID string) (MatchResult, bool) {
+	return s.storage.GetMatch(ctx, viewerID, targetID)
+}
+
+// GetMatches returns the viewer's cached matches among targetIDs, keyed by
+// target id. It never calls the AI.
+func (s *Service) GetMatches(ctx context.Context, viewerID string, targetIDs []string) map[string]MatchResult {
+	return s.storage.GetMatches(ctx, viewerID, targetIDs)
+}
+
+// GetTopMatches returns the viewer's pinned matches followed by the top n
+// others; see GetTopMatchesAfter.
+func (s *Service) GetTopMatches(ctx context.Context, viewerID string, n int) []MatchResult {
+	return s.GetTopMatchesAfter(ctx, viewerID, nil, n)
+}
+
+// GetTopMatchesAfter returns the next n unpinned matches ranked below
+// cursor. The first page (nil cursor) leads with the viewer's pinned
+// matches, marked Pinned and ranked among themselves by score; they don't
+// count toward n, so cursors only ever point into the unpinned ranking.
+func (s *Service) GetTopMatchesAfter(ctx context.Context, viewerID string, cursor *MatchCursor, n int) []MatchResult {
+	pinnedIDs := s.storage.PinnedMatches(ctx, viewerID)
+	if len(pinnedIDs) == 0 {
+		return s.storage.GetTopMatchesAfter(ctx, viewerID, cursor, n)
+	}
+	isPinned := make(map[string]bool, len(pinnedIDs))
+	for _, id := range pinnedIDs {
+		isPinned[id] = true
+	}
+
+	var out []MatchResult
+	if cursor == nil {
+		out = s.pinnedMatches(ctx, viewerID, pinnedIDs)
+	}
+	// Over-fetch so skipping the pinned entries still fills the page.
+	ranked := 0
+	for _, m := range s.storage.GetTopMatchesAfter(ctx, viewerID, cursor, n+len(pinnedIDs)) {
+		if ranked == n {
+			break
+		}
+		if isPinned[m.TargetID] {
+			continue
+		}
+		out = append(out, m)
+		ranked++
+	}
+	if out == nil {
+		out = []MatchResult{}
+	}
+	return out
+}
+
+// pinnedMatches returns the viewer's matches among pinnedIDs, marked Pinned
+// and ranked among themselves by score.
+func (s *Service) pinnedMatches(ctx context.Context, viewerID string, pinnedIDs []string) []MatchResult {
+	if len(pinnedIDs) == 0 {
+		return nil
+	}
+	var out []MatchResult
+	for _, m := range s.storage.GetMatches(ctx, viewerID, pinnedIDs) {
+		m.Pinned = true
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].TargetID > out[j].TargetID
+	})
+	return out
+}
+
+// MaxPinnedMatches caps how many matches a viewer can pin.
+const MaxPinnedMatches = 10
+
+// ErrMatchNotFound is returned by PinMatch when the viewer has no match with
+// the target to pin.
+var ErrMatchNotFound = errors.New("no match with this user")
+
+// ErrPinLimit is returned by PinMatch when the viewer already has
+// MaxPinnedMatches pins.
+var ErrPinLimit = errors.New("pin limit reached")
+
+// PinMatch keeps the viewer's match with targetID at the top of
+// GetTopMatches regardless of score. Pinning an already pinned match is a
+// no-op.
+func (s *Service) PinMatch(ctx context.Context, viewerID, targetID string) error {
+	if _, ok := s.storage.GetMatch(ctx, viewerID, targetID); !ok {
+		return ErrMatchNotFound
+	}
+	return s.storage.PinMatch(ctx, viewerID, targetID, MaxPinnedMatches)
+}
+
+// UnpinMatch returns the match to its score-ranked place.
+func (s *Service) UnpinMatch(ctx context.Context, viewerID, targetID string) {
+	s.storage.UnpinMatch(ctx, viewerID, targetID)
+}
+
+// IsPinned reports whether the viewer pinned their match with targetID.
+func (s *Service) IsPinned(ctx context.Context, viewerID, targetID string) bool {
+	return s.storage.IsPinned(ctx, viewerID, targetID)
+}
+
+// MatchedBy returns the viewers who scored their match with targetID at
+// least minScore, highest first, so a user can see who is interested in
+// them even when those viewers aren't among their own top matches.
+func (s *Service) MatchedBy(ctx context.Context, targetID string, minScore float64, n int) []ReverseMatch {
+	return s.storage.MatchedBy(ctx, targetID, minScore, n)
+}
+
+// Reindex rebuilds the storage's secondary indexes from the stored matches,
+// e.g. after a bulk import, and returns how many matches it indexed.
+func (s *Service) Reindex(ctx context.Context) (int, error) {
+	return s.storage.Reindex(ctx)
+}
+
+// MatchVersion returns the viewer's match-set version. It changes whenever a
+// match for the viewer is stored or cleared.
+func (s *Service) MatchVersion(ctx context.Context, viewerID string) uint64 {
+	return s.storage.MatchVersion(ctx, viewerID)
+}
+
+// ClearMatches drops every cached match for the viewer.
+func (s *Service) ClearMatches(ctx context.Context, viewerID string) {
+	s.storage.ClearMatches(ctx, viewerID)
+}
+
+// RemoveUserMatches drops every match involving the user in either direction.
+func (s *Service) RemoveUserMatches(ctx context.Context, userID string) {
+	s.storage.RemoveUserMatches(ctx, userID)
+}
+
+// SetRequireLocation limits matching to users who have shared a location.
+// When enabled, a viewer without a location gets no jobs and candidates
+// without one are skipped, so no AI calls are spent on unmeetable pairs.
+func (s *Service) SetRequireLocation(require bool) {
+	s.requireLocation.Store(require)
+}
+
+// SetMaxTokens caps the length of each match completion; 0 removes the cap.
+func (s *Service) SetMaxTokens(n int) {
+	s.maxTokens.Store(int64(max(n, 0)))
+}
+
+// SetRetry sets how many times a worker tries a job whose AI call fails
+// with a retryable error, waiting backoff (doubled each time) in between.
+// attempts below 1 are treated as 1, i.e. no retry.
+func (s *Service) SetRetry(attempts int, backoff time.Duration) {
+	s.retryAttempts.Store(int64(max(attempts, 1)))
+	s.retryBackoff.Store(int64(max(backoff, 0)))
+}
+
+// SetSampling sets the strategy SampleCandidates uses; nil disables sampling.
+func (s *Service) SetSampling(strategy SamplingStrategy) {
+	if strategy == nil {
+		s.sampling.Store(nil)
+		return
+	}
+	s.sampling.Store(&strategy)
+}
+
+// RankCandidates orders candidates as RankByInterestOverlap does. With the
+// DistanceWeighting flag on, interest-overlap ties go to the nearest
+// candidate instead of straight to profile score.
+func (s *Service) RankCandidates(primary UserInput, candidates []UserInput) []UserInput {
+	return rankByInterestOverlap(primary, candidates, s.Flags().DistanceWeighting)
+}
+
+// NewSampler starts sampling candidates for primary with the configured
+// strategy; see the package-level NewSampler.
+func (s *Service) NewSampler(primary UserInput) Sampler {
+	var strategy SamplingStrategy
+	if p := s.sampling.Load(); p != nil {
+		strategy = *p
+	}
+	return NewSampler(strategy, primary)
+}
+
+// SampleCandidates applies the configured sampling strategy, returning the
+// candidates unchanged when none is set.
+func (s *Service) SampleCandidates(primary UserInput, candidates []UserInput) []UserInput {
+	strategy := s.sampling.Load()
+	if strategy == nil {
+		return candidates
+	}
+	return (*strategy).Sample(primary, candidates)
 }
 
 // CalculateMatchesAsync queues jobs to calculate matches between the primary user and all candidates.
-func (s *Service) CalculateMatchesAsync(primary UserInput, candidates []UserInput) {
+// The jobs keep ctx's values, so xAI calls carry the caller's trace id, but
+// outlive its cancellation.
+func (s *Service) CalculateMatchesAsync(ctx context.Context, primary UserInput, candidates []UserInput) {
+	ctx = context.WithoutCancel(ctx)
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		log.Printf("[matcher] shutting down, ignoring matches for viewer=%s", primary.ID)
+		return
+	}
+	s.producers.Add(1)
+	s.closeMu.Unlock()
 	go func() {
-		for _, c := range candidates {
-			if c.ID == primary.ID {
-				continue
-			}
-			s.jobs <- matchingJob{viewer: primary, candidate: c}
-			// Queue reverse direction too if symmetric (optional, but good for UX)
-			s.jobs <- matchingJob{viewer: c, candidate: primary}
-		}
+		defer s.producers.Done()
+		s.enqueueMatches(ctx, primary, candidates)
+	}()
+}
+
+// Shutdown stops taking new matching work and waits until every queued job
+// has been computed and its result written to storage, or until ctx is
+// done. Storage writes are synchronous, so once it returns nil every
+// result is persisted. It is safe to call more than once.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.closeMu.Lock()
+	first := !s.closed
+	s.closed = true
+	s.closeMu.Unlock()
+	if first {
+		go func() {
+			s.producers.Wait()
+			close(s.jobs)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Printf("[matcher] shutdown interrupted with %d jobs still queued", len(s.jobs))
+		return ctx.Err()
+	}
+}
+
+// HasAIClient reports whether the service can compute new matches.
+func (s *Service) HasAIClient() bool {
+	return s.aiClient != nil
+}
+
+// QueueDepth returns how many jobs are waiting for a worker.
+func (s *Service) QueueDepth() int {
+	return len(s.jobs)
+}
+
+// QueueCapacity returns the job queue size.
+func (s *Service) QueueCapacity() int {
+	return cap(s.jobs)
+}
+
+// SetRedisCompression toggles gzip compression of match values written to
+// redis. It has no effect with memory storage.
+func (s *Service) SetRedisCompression(enabled bool) {
+	if rs, ok := s.storage.(*RedisStorage); ok {
+		rs.compress.Store(enabled)
+	}
+}
+
+// SetReadReplica sends match reads to the redis at addr (e.g. a replica),
+// with the primary's password and DB, while writes stay on the primary. It
+// has no effect with memory storage or an empty addr, and must be called
+// before the service handles requests.
+func (s *Service) SetReadReplica(addr string) {
+	rs, ok := s.storage.(*RedisStorage)
+	if !ok || addr == "" {
+		return
+	}
+	opts := rs.client.Options()
+	rs.readClient = redisguard.Install(redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	}))
+	log.Printf("[matcher] using redis read replica %s", addr)
+}
+
+// DroppedJobs returns how many jobs were discarded because the queue was full.
+func (s *Service) DroppedJobs() uint64 {
+	return s.droppedJobs.Load()
+}
+
+func (s *Service) enqueueMatches(ctx context.Context, primary UserInput, candidates []UserInput) {
+	requireLocation := s.requireLocation.Load()
+	if requireLocation && !primary.HasLocation {
+		log.Printf("[matcher] skipping viewer=%s without location", primary.ID)
+		return
+	}
+	dropped := 0
+	for _, c := range candidates {
+		if c.ID == primary.ID {
+			continue
+		}
+		if requireLocation && !c.HasLocation {
+			continue
+		}
+		if !s.enqueue(matchingJob{ctx: ctx, viewer: primary, candidate: c, direction: Forward}) {
+			dropped++
+		}
+		// Queue the reverse direction too; with roles set it is scored from
+		// the candidate's side rather than mirroring this one.
+		if !s.enqueue(matchingJob{ctx: ctx, viewer: c, candidate: primary, direction: Reverse}) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("[matcher] queue full, dropped %d jobs for viewer=%s (total dropped=%d)", dropped, primary.ID, s.DroppedJobs())
+	}
+}
+
+// enqueue adds a job without blocking. When the queue is full the job is
+// dropped and counted; it will be recomputed on the user's next trigger.
+func (s *Service) enqueue(job matchingJob) bool {
+	select {
+	case s.jobs <- job:
+		return true
+	default:
+		s.droppedJobs.Add(1)
+		return false
+	}
+}
+
+// startWorkers starts n workers that run until Shutdown closes the queue.
+func (s *Service) startWorkers(n int) {
+	for i := 0; i < n; i++ {
+		s.workers.Add(1)
+		go func(id int) {
+			defer s.workers.Done()
+			s.worker(id)
+		}(i)
+	}
 }
 
 func (s *Service) worker(id int) {
 	for job := range s.jobs {
+		ctx := job.ctx
 		// 1. Check if we already have a recent result (e.g. < 24h) to skip re-work
 		// (For simplicity in this step, we'll overwrite if queued)
 
 		// 2. Call AI
-		res, err := s.callAI(job.viewer, job.candidate)
+		res, err := s.callAIWithRetry(ctx, id, job.viewer, job.candidate, job.direction)
+		if errors.Is(err, ErrNoAIClient) {
+			// Already reported once at startup.
+			continue
+		}
 		if err != nil {
-			log.Printf("[matcher] worker %d failed: %v", id, err)
+			log.Printf("[matcher] worker %d failed viewer=%s target=%s: %v", id, job.viewer.ID, job.candidate.ID, err)
+			s.recordFailure(ctx, job.viewer.ID, job.candidate.ID, err)
 			continue
 		}
 
 		// 3. Update Cache
-		s.updateCache(job.viewer.ID, job.candidate.ID, res)
+		s.updateCache(ctx, job.viewer.ID, job.candidate.ID, res)
 	}
 }
 
-func (s *Service) updateCache(viewerID, targetID string, res MatchResult) {
-	s.storage.UpdateMatch(viewerID, targetID, res)
+// callAIWithRetry runs callAI, retrying retryable errors with exponential
+// backoff up to the configured number of attempts. A cancelled ctx ends the
+// wait between attempts.
+func (s *Service) callAIWithRetry(ctx context.Context, worker int, v, c UserInput, dir Direction) (MatchResult, error) {
+	attempts := int(s.retryAttempts.Load())
+	backoff := time.Duration(s.retryBackoff.Load())
+	for attempt := 1; ; attempt++ {
+		res, err := s.callAI(ctx, v, c, dir)
+		if err == nil || attempt >= attempts || !xai.IsRetryable(err) {
+			return res, err
+		}
+		log.Printf("[matcher] worker %d attempt %d/%d failed viewer=%s target=%s, retrying in %s: %v", worker, attempt, attempts, v.ID, c.ID, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return res, ctx.Err()
+		}
+		backoff *= 2
+	}
 }
 
-func (s *Service) callAI(v, c UserInput) (MatchResult, error) {
-	// If no data, skip
-	if len(v.Tweets) == 0 && v.Interests == "" {
-		return MatchResult{}, fmt.Errorf("viewer has no data")
+// recordFailure notes a failed recompute on the existing match without
+// touching its score or reason. Pairs with no prior match only get the log line.
+func (s *Service) recordFailure(ctx context.Context, viewerID, targetID string, err error) {
+	s.storage.RecordFailure(ctx, viewerID, targetID, err.Error(), time.Now())
+}
+
+func (s *Service) updateCache(ctx context.Context, viewerID, targetID string, res MatchResult) {
+	s.storage.UpdateMatch(ctx, viewerID, targetID, res)
+}
+
+// MatchPrompt returns the prompt callAI sends for viewer v and candidate c
+// scored in direction dir.
+func (s *Service) MatchPrompt(v, c UserInput, dir Direction) string {
+	return buildMatchPrompt(v, c, s.roles.Load(), dir, s.PromptTweetLimit())
+}
+
+// SetPromptTweetLimit sets how many of each user's tweets a match prompt
+// includes, trading match quality against tokens per call; n <= 0 restores
+// DefaultPromptTweetLimit.
+func (s *Service) SetPromptTweetLimit(n int) {
+	s.promptTweets.Store(int64(max(n, 0)))
+}
+
+// PromptTweetLimit returns how many tweets per user a match prompt includes.
+func (s *Service) PromptTweetLimit() int {
+	if n := s.promptTweets.Load(); n > 0 {
+		return int(n)
 	}
+	return DefaultPromptTweetLimit
+}
+
+// SetRoles switches to role-aware prompts that frame the viewer and the
+// candidate differently; nil (the default) restores the symmetric prompt.
+func (s *Service) SetRoles(roles *MatchRoles) {
+	s.roles.Store(roles)
+}
 
-	prompt := fmt.Sprintf(`Analyze social compatibility between User A and User B.
-User A: %s. Interests: %s. Recent tweets: %s.
-User B: %s. Interests: %s. Recent tweets: %s.
+// buildMatchPrompt formats the compatibility prompt, keeping each user's
+// first tweetLimit tweets. With roles the prompt is directional: the
+// viewer is User A, in the viewer role going Forward and the candidate role
+// going Reverse, and only their side is scored.
+func buildMatchPrompt(v, c UserInput, roles *MatchRoles, dir Direction, tweetLimit int) string {
+	if roles != nil {
+		r := *roles
+		if dir == Reverse {
+			r.Viewer, r.Candidate = r.Candidate, r.Viewer
+		}
+		return buildRoleMatchPrompt(v, c, r, tweetLimit)
+	}
+	return fmt.Sprintf(`Analyze social compatibility between User A and User B.
+User A: %s. Bio: %s. Interests: %s. Recent tweets: %s.
+User B: %s. Bio: %s. Interests: %s. Recent tweets: %s.
 
 Return JSON: {
   "score": 0-100, 
-  "reason": "Very brief sentence on why they are a good match. Address User A as 'You'. E.g. 'You both love hiking and outdoor adventures!'"
+  "reason": "Very brief sentence on why they are a good match. Address User A as 'You'. E.g. 'You both love hiking and outdoor adventures!'",
+  "tags": ["Up to 5 short lowercase category tags for what they share, e.g. outdoors, technology, music"]
 }`,
-		v.Summary, v.Interests, strings.Join(truncate(v.Tweets, 5), " | "),
-		c.Summary, c.Interests, strings.Join(truncate(c.Tweets, 5), " | "))
+		v.Summary, v.Description, v.Interests, strings.Join(truncate(v.Tweets, tweetLimit), " | "),
+		c.Summary, c.Description, c.Interests, strings.Join(truncate(c.Tweets, tweetLimit), " | "))
+}
 
-	req := xai.ChatRequest{
-		Model: xai.ModelGrok41Fast,
-		Messages: []xai.Message{
-			{Role: "user", Content: prompt},
-		},
+func buildRoleMatchPrompt(v, c UserInput, roles MatchRoles, tweetLimit int) string {
+	return fmt.Sprintf(`Assess how well User B fits what User A is looking for. User A is the %[1]s; User B is the %[2]s.
+User A (%[1]s): %[3]s. Bio: %[4]s. Interests: %[5]s. Recent tweets: %[6]s.
+User B (%[2]s): %[7]s. Bio: %[8]s. Interests: %[9]s. Recent tweets: %[10]s.
+
+Score only from User A's side: how valuable would User B be to User A as their %[2]s? The reverse pairing is scored separately.
+
+Return JSON: {
+  "score": 0-100, 
+  "reason": "Very brief sentence on why User B suits User A as their %[2]s. Address User A as 'You'.",
+  "tags": ["Up to 5 short lowercase category tags for what they share, e.g. outdoors, technology, music"]
+}`,
+		roles.Viewer, roles.Candidate,
+		v.Summary, v.Description, v.Interests, strings.Join(truncate(v.Tweets, tweetLimit), " | "),
+		c.Summary, c.Description, c.Interests, strings.Join(truncate(c.Tweets, tweetLimit), " | "))
+}
+
+func (s *Service) callAI(ctx context.Context, v, c UserInput, dir Direction) (MatchResult, error) {
+	res, _, err := s.callAIRaw(ctx, v, c, dir)
+	return res, err
+}
+
+// callAIRaw is callAI that also returns the model's reply as written,
+// before JSON extraction. The reply is set whenever the model answered,
+// even if it could not be parsed.
+func (s *Service) callAIRaw(ctx context.Context, v, c UserInput, dir Direction) (MatchResult, string, error) {
+	if s.aiClient == nil {
+		return MatchResult{}, "", ErrNoAIClient
+	}
+	if err := checkMatchInputs(v); err != nil {
+		return MatchResult{}, "", err
 	}
 
-	resp, err := s.aiClient.CreateChatCompletion(context.Background(), req)
+	req := s.matchRequest(v, c, dir)
+	raw, err := s.chatReply(ctx, req, v.ID, c.ID)
 	if err != nil {
-		return MatchResult{}, err
+		return MatchResult{}, "", err
+	}
+	res, err := parseMatchReply(c.ID, raw)
+	if err != nil {
+		// One corrective reprompt; a second bad reply is returned as is.
+		log.Printf("[matcher] unparseable reply viewer=%s target=%s, retrying: %v", v.ID, c.ID, err)
+		req = xai.JSONRetryRequest(req, raw)
+		if raw, err = s.chatReply(ctx, req, v.ID, c.ID); err != nil {
+			return MatchResult{}, "", err
+		}
+		res, err = parseMatchReply(c.ID, raw)
+	}
+	res.Model = string(req.Model)
+	return res, raw, err
+}
+
+// chatReply sends req and returns the first choice's content.
+func (s *Service) chatReply(ctx context.Context, req xai.ChatRequest, viewerID, targetID string) (string, error) {
+	resp, err := s.aiClient.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	raw, err := xai.FirstChoiceContent(resp)
+	if err != nil {
+		log.Printf("[matcher] empty reply viewer=%s target=%s response_id=%s", viewerID, targetID, resp.ID)
+		return "", err
+	}
+	return raw, nil
+}
+
+// ExplainMatch computes the viewer->candidate match now, stores it as a
+// worker would, and also returns the model's raw reply for debugging.
+func (s *Service) ExplainMatch(ctx context.Context, v, c UserInput) (MatchResult, string, error) {
+	res, raw, err := s.callAIRaw(ctx, v, c, Forward)
+	if err != nil {
+		if !errors.Is(err, ErrNoAIClient) {
+			s.recordFailure(ctx, v.ID, c.ID, err)
+		}
+		return MatchResult{}, raw, err
+	}
+	s.updateCache(ctx, v.ID, c.ID, res)
+	return res, raw, nil
+}
+
+// checkMatchInputs rejects viewers with nothing for the model to go on.
+func checkMatchInputs(v UserInput) error {
+	// If no data, skip
+	if len(v.Tweets) == 0 && v.Interests == "" && v.Description == "" {
+		return fmt.Errorf("viewer has no data")
 	}
-	if len(resp.Choices) == 0 {
-		return MatchResult{}, fmt.Errorf("no choices")
+	return nil
+}
+
+// SetModel sets the chat model used for matching; empty restores
+// xai.DefaultModel.
+func (s *Service) SetModel(m xai.Model) {
+	if m == "" {
+		s.model.Store(nil)
+		return
 	}
+	s.model.Store(&m)
+}
 
-	content := resp.Choices[0].Message.Content
-	// Simple JSON extraction
-	start := strings.Index(content, "{")
-	end := strings.LastIndex(content, "}")
-	if start != -1 && end != -1 && end > start {
-		content = content[start : end+1]
+func (s *Service) matchModel() xai.Model {
+	if m := s.model.Load(); m != nil {
+		return *m
 	}
+	return xai.DefaultModel
+}
+
+func (s *Service) matchRequest(v, c UserInput, dir Direction) xai.ChatRequest {
+	return xai.ChatRequest{
+		Model: s.matchModel(),
+		Messages: []xai.Message{
+			{Role: "user", Content: s.MatchPrompt(v, c, dir)},
+		},
+		MaxTokens: int(s.maxTokens.Load()),
+	}
+}
+
+// parseMatchReply decodes the model's JSON reply into a match for targetID.
+func parseMatchReply(targetID, reply string) (MatchResult, error) {
+	content := xai.ExtractJSON(reply)
 
 	var out struct {
-		Score  float64 `json:"score"`
-		Reason string  `json:"reason"`
+		Score  float64         `json:"score"`
+		Reason string          `json:"reason"`
+		Tags   json.RawMessage `json:"tags"`
 	}
 	if err := json.Unmarshal([]byte(content), &out); err != nil {
 		return MatchResult{}, err
 	}
 
 	return MatchResult{
-		TargetID:  c.ID,
-		Score:     out.Score,
-		Reason:    out.Reason,
-		Timestamp: time.Now(),
+		TargetID:   targetID,
+		Score:      out.Score,
+		Reason:     out.Reason,
+		ReasonTags: parseReasonTags(out.Tags),
+		Timestamp:  time.Now(),
 	}, nil
 }
 
+// parseReasonTags accepts the model's tags as a JSON array or a
+// comma-separated string, lowercases and dedupes them, and keeps at most
+// MaxReasonTags. Anything else yields no tags rather than failing the match.
+func parseReasonTags(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var items []any
+	if err := json.Unmarshal(raw, &items); err != nil {
+		var joined string
+		if err := json.Unmarshal(raw, &joined); err != nil {
+			return nil
+		}
+		for _, part := range strings.Split(joined, ",") {
+			items = append(items, part)
+		}
+	}
+
+	var tags []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			continue
+		}
+		tag := strings.ToLower(strings.TrimSpace(str))
+		if tag == "" || len(tag) > 32 || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) >= MaxReasonTags {
+			break
+		}
+	}
+	return tags
+}
+
 func truncate(s []string, n int) []string {
 	if len(s) > n {
 		return s[:n]
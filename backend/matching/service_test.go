@@ -2,49 +2,26 @@ package matching
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"glowmeet/redisguard"
 	"glowmeet/xai"
+	"glowmeet/xai/xaitest"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
-)
-
-// Mock AI Client
-type mockAIClient struct {
-	mu       sync.Mutex
-	response *xai.ChatResponse
-	err      error
-	calls    []xai.ChatRequest
-}
 
-func (m *mockAIClient) CreateChatCompletion(ctx context.Context, req xai.ChatRequest) (*xai.ChatResponse, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.calls = append(m.calls, req)
-	if m.err != nil {
-		return nil, m.err
-	}
-	return m.response, nil
-}
-
-func (m *mockAIClient) getCallCount() int {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	return len(m.calls)
-}
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
 
 func TestService_EndToEnd(t *testing.T) {
-	mock := &mockAIClient{
-		response: &xai.ChatResponse{
-			Choices: []xai.Choice{
-				{
-					Message: xai.Message{
-						Content: `{"score": 88.5, "reason": "Good match."}`,
-					},
-				},
-			},
-		},
-	}
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 88.5, "reason": "Good match."}`)
 
 	service := NewServiceWithClient(mock)
 
@@ -52,12 +29,12 @@ func TestService_EndToEnd(t *testing.T) {
 	candidate := UserInput{ID: "c1", Summary: "Designer", Interests: "UI, AI"}
 
 	// 1. Trigger Async Calculation
-	service.CalculateMatchesAsync(viewer, []UserInput{candidate})
+	service.CalculateMatchesAsync(context.Background(), viewer, []UserInput{candidate})
 
 	// 2. Wait for worker to process (allow up to 1 second)
 	success := false
 	for i := 0; i < 20; i++ {
-		match := service.GetMatch("v1", "c1")
+		match := service.GetMatch(context.Background(), "v1", "c1")
 		if match.Score > 0 {
 			success = true
 			if match.Score != 88.5 {
@@ -76,22 +53,22 @@ func TestService_EndToEnd(t *testing.T) {
 	}
 
 	// 3. Check Mock Calls
-	count := mock.getCallCount()
+	count := len(mock.ChatCalls())
 	if count < 1 {
 		t.Errorf("expected at least 1 mock call, got %d", count)
 	}
 }
 
 func TestService_GetTopMatches(t *testing.T) {
-	service := NewServiceWithClient(&mockAIClient{})
+	service := NewServiceWithClient(xaitest.NewFakeClient())
 
 	// Manually inject data into cache
-	service.updateCache("v1", "c1", MatchResult{TargetID: "c1", Score: 50.0})
-	service.updateCache("v1", "c2", MatchResult{TargetID: "c2", Score: 90.0})
-	service.updateCache("v1", "c3", MatchResult{TargetID: "c3", Score: 10.0})
-	service.updateCache("v1", "c4", MatchResult{TargetID: "c4", Score: 75.0})
+	service.updateCache(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50.0})
+	service.updateCache(context.Background(), "v1", "c2", MatchResult{TargetID: "c2", Score: 90.0})
+	service.updateCache(context.Background(), "v1", "c3", MatchResult{TargetID: "c3", Score: 10.0})
+	service.updateCache(context.Background(), "v1", "c4", MatchResult{TargetID: "c4", Score: 75.0})
 
-	matches := service.GetTopMatches("v1", 3)
+	matches := service.GetTopMatches(context.Background(), "v1", 3)
 
 	if len(matches) != 3 {
 		t.Errorf("expected 3 matches, got %d", len(matches))
@@ -107,20 +84,208 @@ func TestService_GetTopMatches(t *testing.T) {
 	}
 }
 
+func TestService_FailurePreservesMatch(t *testing.T) {
+	mock := xaitest.NewFakeClient().
+		QueueChat(`{"score": 82, "reason": "Good match."}`).
+		QueueChatError(xaitest.RateLimitError())
+	service := NewServiceWithClient(mock)
+	service.SetRetry(1, 0)
+
+	viewer := UserInput{ID: "v1", Interests: "Go"}
+	candidate := UserInput{ID: "c1", Interests: "Go"}
+	res, err := service.callAI(context.Background(), viewer, candidate, Forward)
+	if err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	service.updateCache(context.Background(), "v1", "c1", res)
+
+	service.jobs <- matchingJob{ctx: context.Background(), viewer: viewer, candidate: candidate}
+	deadline := time.Now().Add(time.Second)
+	for service.GetMatch(context.Background(), "v1", "c1").LastError == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m := service.GetMatch(context.Background(), "v1", "c1")
+	if m.Score != 82 || m.Reason != "Good match." {
+		t.Errorf("expected prior score and reason to be kept, got %+v", m)
+	}
+	if !strings.Contains(m.LastError, "429") || m.LastErrorAt == nil {
+		t.Errorf("expected the failure to be recorded, got %+v", m)
+	}
+
+	// A pair without a prior match is not created by a failure.
+	service.recordFailure(context.Background(), "v1", "c2", errors.New("boom"))
+	if _, ok := service.FindMatch(context.Background(), "v1", "c2"); ok {
+		t.Error("expected no match to be created for a failed new pair")
+	}
+}
+
+func TestRedisStorage_RecordFailureKeepsConcurrentResult(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	live := &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	live.UpdateMatch(ctx, "v1", "c1", MatchResult{TargetID: "c1", Score: 40, Reason: "Old."})
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	client.AddHook(&afterFirstCommand{name: "get", fn: func() {
+		// A worker's fresh result lands after the failed one read the match.
+		live.UpdateMatch(ctx, "v1", "c1", MatchResult{TargetID: "c1", Score: 90, Reason: "Fresh."})
+	}})
+	// A replica that hasn't caught up still serves the old match.
+	replica := miniredis.RunT(t)
+	stale := &RedisStorage{client: redis.NewClient(&redis.Options{Addr: replica.Addr()})}
+	stale.UpdateMatch(ctx, "v1", "c1", MatchResult{TargetID: "c1", Score: 40, Reason: "Old."})
+	storage := &RedisStorage{client: client, readClient: stale.client}
+
+	storage.RecordFailure(ctx, "v1", "c1", "boom", time.Now())
+	m, ok := live.GetMatch(ctx, "v1", "c1")
+	if !ok || m.Score != 90 || m.Reason != "Fresh." || m.LastError != "" {
+		t.Errorf("expected the concurrent result to be kept, got %+v", m)
+	}
+
+	// Without a concurrent write the failure is recorded on the primary's copy.
+	storage.RecordFailure(ctx, "v1", "c1", "boom", time.Now())
+	if m, _ := live.GetMatch(ctx, "v1", "c1"); m.Score != 90 || m.LastError != "boom" || m.LastErrorAt == nil {
+		t.Errorf("expected the failure recorded on the primary's match, got %+v", m)
+	}
+}
+
+func TestService_WorkerRetriesTransientErrors(t *testing.T) {
+	mock := xaitest.NewFakeClient().
+		QueueChatError(xaitest.RateLimitError()).
+		QueueChatError(&xai.APIError{StatusCode: http.StatusBadGateway}).
+		QueueChat(`{"score": 77, "reason": "Third time lucky."}`)
+	service := NewServiceWithClient(mock)
+	service.SetRetry(3, time.Millisecond)
+
+	service.jobs <- matchingJob{ctx: context.Background(), viewer: UserInput{ID: "v1", Interests: "Go"}, candidate: UserInput{ID: "c1", Interests: "Go"}}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := service.FindMatch(context.Background(), "v1", "c1"); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	m, ok := service.FindMatch(context.Background(), "v1", "c1")
+	if !ok || m.Score != 77 {
+		t.Fatalf("expected the match to be stored after retries, got %+v (found=%t)", m, ok)
+	}
+	if got := len(mock.ChatCalls()); got != 3 {
+		t.Errorf("expected 3 AI calls, got %d", got)
+	}
+}
+
+func TestService_RetryBackoffStopsOnCancel(t *testing.T) {
+	mock := xaitest.NewFakeClient().SetChatError(&xai.APIError{StatusCode: http.StatusServiceUnavailable})
+	service := NewServiceWithClient(mock)
+	service.SetRetry(3, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := service.callAIWithRetry(ctx, 0, UserInput{ID: "v1", Interests: "Go"}, UserInput{ID: "c1"}, Forward)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation to end the backoff, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to stop waiting once cancelled, took %s", elapsed)
+	}
+	if got := len(mock.ChatCalls()); got != 1 {
+		t.Errorf("expected no further attempts after cancel, got %d calls", got)
+	}
+}
+
+func TestService_WorkerDropsPermanentErrors(t *testing.T) {
+	mock := xaitest.NewFakeClient().
+		QueueChatError(&xai.APIError{StatusCode: http.StatusBadRequest}).
+		QueueChat(`{"score": 77, "reason": "Should not be reached."}`)
+	service := NewServiceWithClient(mock)
+	service.SetRetry(3, time.Millisecond)
+
+	res, err := service.callAIWithRetry(context.Background(), 0, UserInput{ID: "v1", Interests: "Go"}, UserInput{ID: "c1"}, Forward)
+	if err == nil {
+		t.Fatalf("expected the 400 to be returned, got %+v", res)
+	}
+	if got := len(mock.ChatCalls()); got != 1 {
+		t.Errorf("expected 1 AI call for a non-retryable error, got %d", got)
+	}
+}
+
+func TestService_RecordsModel(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 61, "reason": "Both build things."}`)
+	service := NewServiceWithClient(mock)
+	service.storage = &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	service.CalculateMatchesAsync(context.Background(), UserInput{ID: "v1", Interests: "Go"}, []UserInput{{ID: "c1", Interests: "Rust"}})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := service.FindMatch(context.Background(), "v1", "c1"); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	calls := mock.ChatCalls()
+	if len(calls) == 0 || calls[0].Model == "" {
+		t.Fatalf("expected a request with a model, got %+v", calls)
+	}
+	m, ok := service.FindMatch(context.Background(), "v1", "c1")
+	if !ok || m.Model != string(calls[0].Model) {
+		t.Errorf("expected stored match to carry model %q, got %+v", calls[0].Model, m)
+	}
+}
+
+// tracedChat records the trace id each chat call was made with.
+type tracedChat struct {
+	*xaitest.FakeClient
+	mu  sync.Mutex
+	ids []string
+}
+
+func (c *tracedChat) CreateChatCompletion(ctx context.Context, req xai.ChatRequest) (*xai.ChatResponse, error) {
+	c.mu.Lock()
+	c.ids = append(c.ids, xai.TraceID(ctx))
+	c.mu.Unlock()
+	return c.FakeClient.CreateChatCompletion(ctx, req)
+}
+
+func TestService_JobsKeepCallerTraceID(t *testing.T) {
+	ai := &tracedChat{FakeClient: xaitest.NewFakeClient().SetChat(`{"score": 61, "reason": "Both build things."}`)}
+	service := NewServiceWithClient(ai)
+
+	// The request that queued the jobs may be gone before they run.
+	ctx, cancel := context.WithCancel(xai.WithTraceID(context.Background(), "req-1"))
+	cancel()
+	service.CalculateMatchesAsync(ctx, UserInput{ID: "v1", Interests: "Go"}, []UserInput{{ID: "c1", Interests: "Go"}})
+	deadline := time.Now().Add(time.Second)
+	done := func() bool {
+		_, forward := service.FindMatch(context.Background(), "v1", "c1")
+		_, reverse := service.FindMatch(context.Background(), "c1", "v1")
+		return forward && reverse
+	}
+	for !done() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !done() {
+		t.Fatal("expected the jobs to run despite the cancelled request")
+	}
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	if len(ai.ids) != 2 || ai.ids[0] != "req-1" || ai.ids[1] != "req-1" {
+		t.Errorf("expected both directions to carry the trace id, got %q", ai.ids)
+	}
+}
+
 func TestService_CalculateEmpty(t *testing.T) {
-	service := NewServiceWithClient(&mockAIClient{})
+	service := NewServiceWithClient(xaitest.NewFakeClient())
 	// Should not crash
-	service.CalculateMatchesAsync(UserInput{ID: "v1"}, []UserInput{})
+	service.CalculateMatchesAsync(context.Background(), UserInput{ID: "v1"}, []UserInput{})
 }
 
 func TestService_Concurrency(t *testing.T) {
-	mock := &mockAIClient{
-		response: &xai.ChatResponse{
-			Choices: []xai.Choice{
-				{Message: xai.Message{Content: `{"score": 50, "reason": "ok"}`}},
-			},
-		},
-	}
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 50, "reason": "ok"}`)
 	service := NewServiceWithClient(mock)
 
 	var wg sync.WaitGroup
@@ -132,7 +297,7 @@ func TestService_Concurrency(t *testing.T) {
 			defer wg.Done()
 			viewer := UserInput{ID: fmt.Sprintf("v%d", id), Interests: "x"}
 			candidate := UserInput{ID: "c1", Interests: "y"}
-			service.CalculateMatchesAsync(viewer, []UserInput{candidate})
+			service.CalculateMatchesAsync(context.Background(), viewer, []UserInput{candidate})
 		}(i)
 	}
 
@@ -142,7 +307,7 @@ func TestService_Concurrency(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			for k := 0; k < 5; k++ {
-				service.GetTopMatches("v1", 5)
+				service.GetTopMatches(context.Background(), "v1", 5)
 				time.Sleep(10 * time.Millisecond)
 			}
 		}()
@@ -151,3 +316,1113 @@ func TestService_Concurrency(t *testing.T) {
 	wg.Wait()
 	// Pass if no race/panic
 }
+
+func TestNewService_EmptyAPIKey(t *testing.T) {
+	service := NewService(nil, "", "", 0)
+	if service.aiClient != nil {
+		t.Fatalf("expected no AI client without an API key, got %T", service.aiClient)
+	}
+
+	viewer := UserInput{ID: "v1", Interests: "Go"}
+	candidate := UserInput{ID: "c1", Interests: "Go"}
+	if _, err := service.callAI(context.Background(), viewer, candidate, Forward); !errors.Is(err, ErrNoAIClient) {
+		t.Errorf("expected ErrNoAIClient, got %v", err)
+	}
+
+	// Queued jobs are drained without storing anything.
+	service.CalculateMatchesAsync(context.Background(), viewer, []UserInput{candidate})
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := service.FindMatch(context.Background(), "v1", "c1"); ok {
+		t.Error("expected no match to be computed")
+	}
+}
+
+func TestService_EnqueueDoesNotBlockWhenFull(t *testing.T) {
+	// No workers drain this queue, so it fills after two jobs.
+	service := &Service{
+		aiClient: xaitest.NewFakeClient(),
+		storage:  &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		jobs:     make(chan matchingJob, 2),
+	}
+
+	candidates := []UserInput{{ID: "c1"}, {ID: "c2"}, {ID: "c3"}}
+
+	done := make(chan struct{})
+	go func() {
+		service.enqueueMatches(context.Background(), UserInput{ID: "v1"}, candidates)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue blocked on a full queue")
+	}
+
+	if got := len(service.jobs); got != 2 {
+		t.Errorf("expected 2 queued jobs, got %d", got)
+	}
+	if got := service.DroppedJobs(); got != 4 {
+		t.Errorf("expected 4 dropped jobs, got %d", got)
+	}
+}
+
+func TestService_RequireLocationSkipsUnlocated(t *testing.T) {
+	service := &Service{
+		aiClient: xaitest.NewFakeClient(),
+		storage:  &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		jobs:     make(chan matchingJob, 10),
+	}
+	service.SetRequireLocation(true)
+
+	candidates := []UserInput{{ID: "c1", HasLocation: true}, {ID: "c2"}}
+
+	service.enqueueMatches(context.Background(), UserInput{ID: "v1"}, candidates)
+	if got := len(service.jobs); got != 0 {
+		t.Fatalf("expected no jobs for a viewer without location, got %d", got)
+	}
+
+	service.enqueueMatches(context.Background(), UserInput{ID: "v1", HasLocation: true}, candidates)
+	if got := len(service.jobs); got != 2 {
+		t.Fatalf("expected 2 jobs (both directions for c1), got %d", got)
+	}
+	for len(service.jobs) > 0 {
+		job := <-service.jobs
+		if job.viewer.ID == "c2" || job.candidate.ID == "c2" {
+			t.Errorf("expected c2 to be skipped, got job %s->%s", job.viewer.ID, job.candidate.ID)
+		}
+	}
+}
+
+func TestStorage_ClearMatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50})
+			storage.UpdateMatch(context.Background(), "v1", "c2", MatchResult{TargetID: "c2", Score: 70})
+			storage.UpdateMatch(context.Background(), "v2", "c1", MatchResult{TargetID: "c1", Score: 30})
+
+			storage.ClearMatches(context.Background(), "v1")
+
+			if got := storage.GetTopMatches(context.Background(), "v1", 5); len(got) != 0 {
+				t.Errorf("expected no matches for v1, got %d", len(got))
+			}
+			if _, ok := storage.GetMatch(context.Background(), "v1", "c1"); ok {
+				t.Error("expected v1->c1 to be cleared")
+			}
+			if _, ok := storage.GetMatch(context.Background(), "v2", "c1"); !ok {
+				t.Error("expected other viewers' matches to be kept")
+			}
+		})
+	}
+
+	if mr.Exists("matches:v1") || mr.Exists("match:v1:c1") || mr.Exists("match:v1:c2") {
+		t.Error("expected redis keys for v1 to be deleted")
+	}
+}
+
+func TestStorage_RemoveUserMatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			storage.UpdateMatch(context.Background(), "u1", "u2", MatchResult{TargetID: "u2", Score: 50})
+			storage.UpdateMatch(context.Background(), "u2", "u1", MatchResult{TargetID: "u1", Score: 60})
+			storage.UpdateMatch(context.Background(), "u2", "u3", MatchResult{TargetID: "u3", Score: 40})
+			storage.UpdateMatch(context.Background(), "u3", "u1", MatchResult{TargetID: "u1", Score: 30})
+			before := storage.MatchVersion(context.Background(), "u2")
+
+			storage.RemoveUserMatches(context.Background(), "u1")
+
+			for _, pair := range [][2]string{{"u1", "u2"}, {"u2", "u1"}, {"u3", "u1"}} {
+				if _, ok := storage.GetMatch(context.Background(), pair[0], pair[1]); ok {
+					t.Errorf("expected %s->%s to be removed", pair[0], pair[1])
+				}
+			}
+			if top := storage.GetTopMatches(context.Background(), "u2", 5); len(top) != 1 || top[0].TargetID != "u3" {
+				t.Errorf("expected only u2->u3 to remain ranked, got %+v", top)
+			}
+			if storage.MatchVersion(context.Background(), "u2") <= before {
+				t.Error("expected affected viewer's version to change")
+			}
+		})
+	}
+}
+
+func TestStorage_MatchVersion(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			if v := storage.MatchVersion(context.Background(), "v1"); v != 0 {
+				t.Fatalf("expected initial version 0, got %d", v)
+			}
+
+			storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50})
+			v1 := storage.MatchVersion(context.Background(), "v1")
+			if v1 == 0 {
+				t.Fatal("expected version to increase after update")
+			}
+
+			// Reads and other viewers' writes leave the version alone.
+			storage.GetTopMatches(context.Background(), "v1", 5)
+			storage.GetMatch(context.Background(), "v1", "c1")
+			storage.UpdateMatch(context.Background(), "v2", "c1", MatchResult{TargetID: "c1", Score: 10})
+			if v := storage.MatchVersion(context.Background(), "v1"); v != v1 {
+				t.Errorf("expected stable version %d, got %d", v1, v)
+			}
+
+			storage.UpdateMatch(context.Background(), "v1", "c2", MatchResult{TargetID: "c2", Score: 60})
+			v2 := storage.MatchVersion(context.Background(), "v1")
+			if v2 <= v1 {
+				t.Errorf("expected version > %d after second update, got %d", v1, v2)
+			}
+
+			storage.ClearMatches(context.Background(), "v1")
+			if v := storage.MatchVersion(context.Background(), "v1"); v <= v2 {
+				t.Errorf("expected version > %d after clear, got %d", v2, v)
+			}
+		})
+	}
+}
+
+func TestStorage_MatchedBy(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	viewers := func(ms []ReverseMatch) string {
+		out := make([]string, 0, len(ms))
+		for _, m := range ms {
+			out = append(out, fmt.Sprintf("%s=%g", m.ViewerID, m.Score))
+		}
+		return strings.Join(out, ",")
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			storage.UpdateMatch(context.Background(), "a", "me", MatchResult{TargetID: "me", Score: 90})
+			storage.UpdateMatch(context.Background(), "b", "me", MatchResult{TargetID: "me", Score: 40})
+			storage.UpdateMatch(context.Background(), "c", "me", MatchResult{TargetID: "me", Score: 75})
+			storage.UpdateMatch(context.Background(), "d", "me", MatchResult{TargetID: "me", Score: 75})
+			storage.UpdateMatch(context.Background(), "a", "other", MatchResult{TargetID: "other", Score: 99})
+
+			if got := viewers(storage.MatchedBy(context.Background(), "me", 70, 0)); got != "a=90,d=75,c=75" {
+				t.Errorf("expected high-scoring viewers, got %s", got)
+			}
+			if got := viewers(storage.MatchedBy(context.Background(), "me", 70, 2)); got != "a=90,d=75" {
+				t.Errorf("expected the limit to apply, got %s", got)
+			}
+
+			// A rescore moves the viewer; clearing or removing drops them.
+			storage.UpdateMatch(context.Background(), "b", "me", MatchResult{TargetID: "me", Score: 95})
+			storage.ClearMatches(context.Background(), "a")
+			if got := viewers(storage.MatchedBy(context.Background(), "me", 70, 0)); got != "b=95,d=75,c=75" {
+				t.Errorf("expected the index to follow updates and clears, got %s", got)
+			}
+			storage.RemoveUserMatches(context.Background(), "d")
+			if got := viewers(storage.MatchedBy(context.Background(), "me", 0, 0)); got != "b=95,c=75" {
+				t.Errorf("expected a removed user to leave the index, got %s", got)
+			}
+			storage.RemoveUserMatches(context.Background(), "me")
+			if got := storage.MatchedBy(context.Background(), "me", 0, 0); len(got) != 0 {
+				t.Errorf("expected no reverse matches for a removed user, got %s", viewers(got))
+			}
+		})
+	}
+}
+
+func TestRedisStorage_Reindex(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	storage := &RedisStorage{client: client}
+	storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 80})
+	storage.UpdateMatch(context.Background(), "v1", "c2", MatchResult{TargetID: "c2", Score: 60})
+	storage.UpdateMatch(context.Background(), "v2", "c1", MatchResult{TargetID: "c1", Score: 90})
+
+	// Corrupt every index: drop a ranking entry, add a ghost, lose the
+	// reverse index and leave an orphaned ranking behind.
+	ctx := context.Background()
+	client.ZRem(ctx, "matches:v1", "c1")
+	client.ZAdd(ctx, "matches:v1", redis.Z{Score: 99, Member: "ghost"})
+	client.Del(ctx, matchedByKey("c1"))
+	client.ZAdd(ctx, "matches:orphan", redis.Z{Score: 50, Member: "c1"})
+	before := storage.MatchVersion(context.Background(), "v1")
+
+	n, err := storage.Reindex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 matches indexed, got %d", n)
+	}
+	var ids []string
+	for _, m := range storage.GetTopMatches(context.Background(), "v1", 10) {
+		ids = append(ids, fmt.Sprintf("%s=%g", m.TargetID, m.Score))
+	}
+	if got := strings.Join(ids, ","); got != "c1=80,c2=60" {
+		t.Errorf("expected the ranking to be restored, got %s", got)
+	}
+	if got := storage.MatchedBy(context.Background(), "c1", 0, 0); len(got) != 2 || got[0].ViewerID != "v2" || got[1].ViewerID != "v1" {
+		t.Errorf("expected the reverse index to be restored, got %+v", got)
+	}
+	if mr.Exists("matches:orphan") {
+		t.Error("expected an index key without matches to be deleted")
+	}
+	if storage.MatchVersion(context.Background(), "v1") <= before {
+		t.Error("expected reindexed viewers' versions to be bumped")
+	}
+	for _, k := range mr.Keys() {
+		if strings.HasPrefix(k, "reindex:") {
+			t.Errorf("expected no temporary keys left, found %s", k)
+		}
+	}
+}
+
+// onFirstCommand runs fn before the first command named name, so a test can
+// interleave a write with a scan in progress.
+type onFirstCommand struct {
+	name string
+	fn   func()
+	once sync.Once
+}
+
+func (h *onFirstCommand) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *onFirstCommand) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == h.name {
+			h.once.Do(h.fn)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *onFirstCommand) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// afterFirstCommand runs fn once the first command named name has
+// returned, so a test can land a write between a read and the write it feeds.
+type afterFirstCommand struct {
+	name string
+	fn   func()
+	once sync.Once
+}
+
+func (h *afterFirstCommand) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *afterFirstCommand) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if cmd.Name() == h.name {
+			h.once.Do(h.fn)
+		}
+		return err
+	}
+}
+
+func (h *afterFirstCommand) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisStorage_ReindexKeepsLiveWrites(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	live := &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	live.UpdateMatch(ctx, "v1", "c1", MatchResult{TargetID: "c1", Score: 80})
+	live.UpdateMatch(ctx, "v3", "c1", MatchResult{TargetID: "c1", Score: 40})
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	client.AddHook(&onFirstCommand{name: "mget", fn: func() {
+		// Lands after the scan has listed the match keys.
+		live.UpdateMatch(ctx, "v1", "c2", MatchResult{TargetID: "c2", Score: 60})
+		live.UpdateMatch(ctx, "v2", "c9", MatchResult{TargetID: "c9", Score: 70})
+		live.ClearMatches(ctx, "v3")
+	}})
+	storage := &RedisStorage{client: client}
+
+	if _, err := storage.Reindex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, viewer := range []string{"v1", "v2", "v3"} {
+		for _, m := range storage.GetTopMatches(ctx, viewer, 10) {
+			ids = append(ids, viewer+">"+m.TargetID)
+		}
+	}
+	if got := strings.Join(ids, ","); got != "v1>c1,v1>c2,v2>c9" {
+		t.Errorf("expected writes made during the reindex to survive it, got %s", got)
+	}
+	if got := storage.MatchedBy(ctx, "c9", 0, 0); len(got) != 1 || got[0].ViewerID != "v2" {
+		t.Errorf("expected the reverse index to include the live write, got %+v", got)
+	}
+	for _, k := range mr.Keys() {
+		if strings.HasPrefix(k, "reindex:") {
+			t.Errorf("expected no reindex keys left, found %s", k)
+		}
+	}
+
+	mr.Set(reindexActiveKey, "reindex:1:")
+	if _, err := storage.Reindex(ctx); !errors.Is(err, ErrReindexRunning) {
+		t.Errorf("expected a second reindex to be refused, got %v", err)
+	}
+}
+
+func TestStorage_AllMatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50, Reason: "one"})
+			storage.UpdateMatch(context.Background(), "v1", "c2", MatchResult{TargetID: "c2", Score: 60, Reason: "two"})
+			storage.UpdateMatch(context.Background(), "v2", "c1", MatchResult{TargetID: "c1", Score: 70, Reason: "three"})
+
+			got := map[string]string{}
+			err := storage.AllMatches(context.Background(), func(viewerID string, m MatchResult) error {
+				got[viewerID+">"+m.TargetID] = m.Reason
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"v1>c1": "one", "v1>c2": "two", "v2>c1": "three"}
+			if len(got) != len(want) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+			for k, v := range want {
+				if got[k] != v {
+					t.Errorf("%s: expected %q, got %q", k, v, got[k])
+				}
+			}
+
+			stop := errors.New("stop")
+			calls := 0
+			err = storage.AllMatches(context.Background(), func(string, MatchResult) error {
+				calls++
+				return stop
+			})
+			if err != stop || calls != 1 {
+				t.Errorf("expected iteration to stop at the first error, got err=%v after %d calls", err, calls)
+			}
+		})
+	}
+}
+
+func TestService_PinnedMatchesLead(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			service := &Service{storage: storage}
+			for i, id := range []string{"c1", "c2", "c3", "c4"} {
+				storage.UpdateMatch(context.Background(), "v1", id, MatchResult{TargetID: id, Score: float64(90 - 10*i)})
+			}
+			storage.UpdateMatch(context.Background(), "c2", "v1", MatchResult{TargetID: "v1", Score: 50})
+
+			if err := service.PinMatch(context.Background(), "v1", "c4"); err != nil {
+				t.Fatal(err)
+			}
+			if err := service.PinMatch(context.Background(), "v1", "c3"); err != nil {
+				t.Fatal(err)
+			}
+			if err := service.PinMatch(context.Background(), "v1", "nobody"); !errors.Is(err, ErrMatchNotFound) {
+				t.Errorf("expected ErrMatchNotFound, got %v", err)
+			}
+
+			got := service.GetTopMatches(context.Background(), "v1", 2)
+			want := []string{"c3", "c4", "c1", "c2"}
+			if len(got) != len(want) {
+				t.Fatalf("expected %v, got %+v", want, got)
+			}
+			for i, id := range want {
+				if got[i].TargetID != id || got[i].Pinned != (i < 2) {
+					t.Errorf("position %d: expected %s pinned=%v, got %+v", i, id, i < 2, got[i])
+				}
+			}
+			if next := service.GetTopMatchesAfter(context.Background(), "v1", CursorAfter(got[3]), 2); len(next) != 0 {
+				t.Errorf("expected pinned matches to be left off later pages, got %+v", next)
+			}
+
+			service.UnpinMatch(context.Background(), "v1", "c3")
+			if service.IsPinned(context.Background(), "v1", "c3") || !service.IsPinned(context.Background(), "v1", "c4") {
+				t.Error("expected only c4 to stay pinned")
+			}
+
+			// Pins go with the user.
+			service.RemoveUserMatches(context.Background(), "c4")
+			if service.IsPinned(context.Background(), "v1", "c4") {
+				t.Error("expected a removed user's pin to be dropped")
+			}
+		})
+	}
+}
+
+func TestService_PinLimit(t *testing.T) {
+	storage := &MemoryStorage{cache: make(map[string]map[string]MatchResult)}
+	service := &Service{storage: storage}
+	for i := 0; i <= MaxPinnedMatches; i++ {
+		id := fmt.Sprintf("c%d", i)
+		storage.UpdateMatch(context.Background(), "v1", id, MatchResult{TargetID: id, Score: 50})
+	}
+	for i := 0; i < MaxPinnedMatches; i++ {
+		if err := service.PinMatch(context.Background(), "v1", fmt.Sprintf("c%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := service.PinMatch(context.Background(), "v1", "c0"); err != nil {
+		t.Errorf("expected re-pinning to be a no-op, got %v", err)
+	}
+	if err := service.PinMatch(context.Background(), "v1", fmt.Sprintf("c%d", MaxPinnedMatches)); !errors.Is(err, ErrPinLimit) {
+		t.Errorf("expected ErrPinLimit, got %v", err)
+	}
+}
+
+func TestService_ConcurrentPinsKeepLimit(t *testing.T) {
+	mr := miniredis.RunT(t)
+	stores := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+	for name, storage := range stores {
+		t.Run(name, func(t *testing.T) {
+			service := &Service{storage: storage}
+			n := MaxPinnedMatches + 5
+			for i := 0; i < n; i++ {
+				id := fmt.Sprintf("c%d", i)
+				storage.UpdateMatch(context.Background(), "v1", id, MatchResult{TargetID: id, Score: 50})
+			}
+
+			var wg sync.WaitGroup
+			var limited atomic.Int32
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+					switch err := service.PinMatch(context.Background(), "v1", id); {
+					case errors.Is(err, ErrPinLimit):
+						limited.Add(1)
+					case err != nil:
+						t.Error(err)
+					}
+				}(fmt.Sprintf("c%d", i))
+			}
+			wg.Wait()
+			if got := len(storage.PinnedMatches(context.Background(), "v1")); got != MaxPinnedMatches {
+				t.Errorf("expected exactly %d pins, got %d", MaxPinnedMatches, got)
+			}
+			if limited.Load() != 5 {
+				t.Errorf("expected 5 pins over the limit to be refused, got %d", limited.Load())
+			}
+		})
+	}
+}
+
+func TestRedisStorage_GetTopMatchesRankedOrder(t *testing.T) {
+	mr := miniredis.RunT(t)
+	storage := &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50, Reason: "one"})
+	storage.UpdateMatch(context.Background(), "v1", "c2", MatchResult{TargetID: "c2", Score: 90, Reason: "two"})
+	storage.UpdateMatch(context.Background(), "v1", "c3", MatchResult{TargetID: "c3", Score: 10, Reason: "three"})
+	storage.UpdateMatch(context.Background(), "v1", "c4", MatchResult{TargetID: "c4", Score: 75, Reason: "four"})
+	// A ranked id whose detail key is gone is skipped rather than returned empty.
+	mr.Del("match:v1:c4")
+
+	matches := storage.GetTopMatches(context.Background(), "v1", 3)
+	want := []string{"c2", "c1"}
+	if len(matches) != len(want) {
+		t.Fatalf("expected %d matches, got %d: %+v", len(want), len(matches), matches)
+	}
+	for i, id := range want {
+		if matches[i].TargetID != id {
+			t.Errorf("position %d: expected %s, got %s", i, id, matches[i].TargetID)
+		}
+	}
+	if matches[0].Reason != "two" || matches[0].Score != 90 {
+		t.Errorf("expected details to be decoded, got %+v", matches[0])
+	}
+
+	if got := storage.GetTopMatches(context.Background(), "nobody", 3); len(got) != 0 {
+		t.Errorf("expected no matches for unknown viewer, got %d", len(got))
+	}
+}
+
+func TestRedisStorage_ReadClient(t *testing.T) {
+	primary := miniredis.RunT(t)
+	replica := miniredis.RunT(t)
+	storage := &RedisStorage{
+		client:     redis.NewClient(&redis.Options{Addr: primary.Addr()}),
+		readClient: redis.NewClient(&redis.Options{Addr: replica.Addr()}),
+	}
+
+	storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50})
+	if !primary.Exists("match:v1:c1") || replica.Exists("match:v1:c1") {
+		t.Fatal("expected writes to go to the primary only")
+	}
+	if _, ok := storage.GetMatch(context.Background(), "v1", "c1"); ok {
+		t.Error("expected reads to be served by the (empty) replica")
+	}
+
+	// Simulate replication.
+	replicated := &RedisStorage{client: storage.readClient}
+	replicated.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50})
+	if m, ok := storage.GetMatch(context.Background(), "v1", "c1"); !ok || m.Score != 50 {
+		t.Errorf("expected replica read, got %+v, %t", m, ok)
+	}
+	if top := storage.GetTopMatches(context.Background(), "v1", 5); len(top) != 1 {
+		t.Errorf("expected top matches from the replica, got %d", len(top))
+	}
+	if storage.MatchVersion(context.Background(), "v1") == 0 {
+		t.Error("expected version to be read from the replica")
+	}
+}
+
+func TestService_SetRedisCompressionWhileWriting(t *testing.T) {
+	mr := miniredis.RunT(t)
+	service := NewServiceWithClient(xaitest.NewFakeClient())
+	service.storage = &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			service.updateCache(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		service.SetRedisCompression(i%2 == 0)
+	}
+	wg.Wait()
+	if _, ok := service.FindMatch(context.Background(), "v1", "c1"); !ok {
+		t.Error("expected the match to be readable whichever form it was written in")
+	}
+}
+
+func TestRedisStorage_Compression(t *testing.T) {
+	mr := miniredis.RunT(t)
+	storage := &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	storage.compress.Store(true)
+
+	storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 80, Reason: "Compressed."})
+	raw, err := mr.Get("match:v1:c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(raw, "{") {
+		t.Errorf("expected a compressed value, got %q", raw)
+	}
+
+	// A value written before compression was enabled.
+	mr.Set("match:v1:c2", `{"target_id":"c2","score":60,"reason":"Legacy."}`)
+	mr.ZAdd("matches:v1", 60, "c2")
+
+	for id, reason := range map[string]string{"c1": "Compressed.", "c2": "Legacy."} {
+		if m, ok := storage.GetMatch(context.Background(), "v1", id); !ok || m.Reason != reason {
+			t.Errorf("GetMatch(%s): expected %q, got %+v", id, reason, m)
+		}
+	}
+	if top := storage.GetTopMatches(context.Background(), "v1", 5); len(top) != 2 || top[0].Reason != "Compressed." || top[1].Reason != "Legacy." {
+		t.Errorf("expected both values from top matches, got %+v", top)
+	}
+}
+
+func TestRedisStorage_LookupMatchErrors(t *testing.T) {
+	mr := miniredis.RunT(t)
+	storage := &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	if _, ok, err := storage.lookupMatch(context.Background(), "v1", "missing"); ok || err != nil {
+		t.Errorf("expected missing match to be (false, nil), got (%t, %v)", ok, err)
+	}
+
+	storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 50})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok, err := storage.lookupMatch(cancelled, "v1", "c1"); ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled context to abort the lookup, got (%t, %v)", ok, err)
+	}
+
+	storage.client.Close()
+	if _, ok, err := storage.lookupMatch(context.Background(), "v1", "c1"); ok || err == nil {
+		t.Errorf("expected closed client to return an error, got (%t, %v)", ok, err)
+	}
+	if _, ok := storage.GetMatch(context.Background(), "v1", "c1"); ok {
+		t.Error("expected GetMatch to report not found on error")
+	}
+}
+
+func TestService_ReasonTags(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 81, "reason": "You both hike.", "tags": ["Outdoors", "technology", "outdoors", 7, "music", "food", "travel", "books"]}`)
+
+	for name, storage := range map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := &Service{aiClient: mock, storage: storage}
+			res, err := service.callAI(context.Background(), UserInput{ID: "v1", Interests: "hiking"}, UserInput{ID: "c1", Interests: "hiking"}, Forward)
+			if err != nil {
+				t.Fatalf("callAI: %v", err)
+			}
+			service.updateCache(context.Background(), "v1", "c1", res)
+
+			got, ok := storage.GetMatch(context.Background(), "v1", "c1")
+			if !ok {
+				t.Fatal("expected stored match")
+			}
+			want := "outdoors,technology,music,food,travel"
+			if strings.Join(got.ReasonTags, ",") != want {
+				t.Errorf("expected tags %s, got %v", want, got.ReasonTags)
+			}
+			if top := storage.GetTopMatches(context.Background(), "v1", 1); len(top) != 1 || len(top[0].ReasonTags) != MaxReasonTags {
+				t.Errorf("expected tags in top matches, got %+v", top)
+			}
+		})
+	}
+}
+
+func TestService_CallAIIncludesDescription(t *testing.T) {
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 70, "reason": "ok"}`)
+	service := &Service{aiClient: mock}
+
+	viewer := UserInput{ID: "v1", Description: "Rust compiler hacker"}
+	candidate := UserInput{ID: "c1", Description: "Amateur astronomer"}
+	if _, err := service.callAI(context.Background(), viewer, candidate, Forward); err != nil {
+		t.Fatalf("expected a bio alone to be enough data, got %v", err)
+	}
+
+	calls := mock.ChatCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 call, got %d", len(calls))
+	}
+	prompt := calls[0].Messages[0].Content
+	for _, want := range []string{"Rust compiler hacker", "Amateur astronomer"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("expected prompt to include %q, got:\n%s", want, prompt)
+		}
+	}
+}
+
+func TestService_CallAIEmptyChoices(t *testing.T) {
+	mock := xaitest.NewFakeClient().QueueChatResponse(&xai.ChatResponse{ID: "resp-empty"})
+	service := &Service{aiClient: mock}
+
+	_, err := service.callAI(context.Background(), UserInput{ID: "v1", Description: "Hiker"}, UserInput{ID: "c1"}, Forward)
+	if !errors.Is(err, xai.ErrNoChoices) {
+		t.Fatalf("expected ErrNoChoices, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "resp-empty") {
+		t.Errorf("expected the error to name the response id, got %v", err)
+	}
+}
+
+func TestService_RetriesUnparseableReplyOnce(t *testing.T) {
+	mock := xaitest.NewFakeClient().QueueChat("Sure! Score: high", `{"score": 72, "reason": "Both hike"}`)
+	service := NewServiceWithClient(mock)
+
+	v := UserInput{ID: "v1", Description: "Hiker"}
+	res, raw, err := service.ExplainMatch(context.Background(), v, UserInput{ID: "c1"})
+	if err != nil {
+		t.Fatalf("expected the corrective retry to succeed, got %v (raw %q)", err, raw)
+	}
+	if res.Score != 72 {
+		t.Errorf("expected score from the second reply, got %v", res.Score)
+	}
+	if got := service.GetMatch(context.Background(), "v1", "c1"); got.Score != 72 {
+		t.Errorf("expected the retried match to be stored, got %+v", got)
+	}
+
+	calls := mock.ChatCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 chat calls, got %d", len(calls))
+	}
+	msgs := calls[1].Messages
+	if n := len(msgs); n != len(calls[0].Messages)+2 || msgs[n-2].Content != "Sure! Score: high" || msgs[n-1].Content != xai.JSONCorrection {
+		t.Errorf("expected the retry to replay the bad reply and a correction, got %+v", msgs)
+	}
+
+	// A second bad reply is not retried again.
+	mock = xaitest.NewFakeClient().SetChat("still not json")
+	service = NewServiceWithClient(mock)
+	if _, _, err := service.ExplainMatch(context.Background(), v, UserInput{ID: "c1"}); err == nil {
+		t.Error("expected a parse error after the retry")
+	}
+	if n := len(mock.ChatCalls()); n != 2 {
+		t.Errorf("expected exactly one retry, got %d calls", n)
+	}
+}
+
+func TestParseReasonTags(t *testing.T) {
+	cases := map[string]string{
+		``:                      "",
+		`null`:                  "",
+		`"music, Food ,"`:       "music,food",
+		`{"not":"tags"}`:        "",
+		`["a", "", "A", "b"]`:   "a,b",
+		`[1, true, "x", null]`:  "x",
+		`["one","two","three"]`: "one,two,three",
+	}
+	for raw, want := range cases {
+		if got := strings.Join(parseReasonTags(json.RawMessage(raw)), ","); got != want {
+			t.Errorf("parseReasonTags(%s) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestStorage_GetTopMatchesAfter(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	ids := func(ms []MatchResult) string {
+		out := make([]string, 0, len(ms))
+		for _, m := range ms {
+			out = append(out, m.TargetID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			for id, score := range map[string]float64{"a": 90, "b": 80, "c": 80, "d": 70, "e": 60, "f": 50} {
+				storage.UpdateMatch(context.Background(), "v1", id, MatchResult{TargetID: id, Score: score})
+			}
+
+			page1 := storage.GetTopMatchesAfter(context.Background(), "v1", nil, 2)
+			if got := ids(page1); got != "a,c" {
+				t.Fatalf("page 1: expected a,c, got %s", got)
+			}
+
+			// Scores change between pages: a new match lands above the
+			// cursor and one already seen drops below it. Offset paging
+			// would repeat c and skip b here.
+			storage.UpdateMatch(context.Background(), "v1", "z", MatchResult{TargetID: "z", Score: 99})
+			storage.UpdateMatch(context.Background(), "v1", "e", MatchResult{TargetID: "e", Score: 75})
+
+			page2 := storage.GetTopMatchesAfter(context.Background(), "v1", CursorAfter(page1[len(page1)-1]), 2)
+			if got := ids(page2); got != "b,e" {
+				t.Fatalf("page 2: expected b,e, got %s", got)
+			}
+			page3 := storage.GetTopMatchesAfter(context.Background(), "v1", CursorAfter(page2[len(page2)-1]), 5)
+			if got := ids(page3); got != "d,f" {
+				t.Errorf("page 3: expected d,f, got %s", got)
+			}
+			if got := storage.GetTopMatchesAfter(context.Background(), "v1", CursorAfter(page3[len(page3)-1]), 5); len(got) != 0 {
+				t.Errorf("expected an empty page past the end, got %s", ids(got))
+			}
+		})
+	}
+}
+
+func TestMatchCursor_EncodeParse(t *testing.T) {
+	c := MatchCursor{Score: 82.5, TargetID: "user:42"}
+	got, err := ParseMatchCursor(c.Encode())
+	if err != nil || *got != c {
+		t.Fatalf("expected round trip of %+v, got %+v, %v", c, got, err)
+	}
+	for _, bad := range []string{"", "%%%", "bm9jb2xvbg", "YWJjOnVzZXI"} {
+		if _, err := ParseMatchCursor(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestService_CallAIMaxTokens(t *testing.T) {
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 70, "reason": "ok"}`)
+	service := NewServiceWithClient(mock)
+	viewer := UserInput{ID: "v1", Interests: "climbing"}
+	candidate := UserInput{ID: "c1", Interests: "hiking"}
+
+	if _, err := service.callAI(context.Background(), viewer, candidate, Forward); err != nil {
+		t.Fatal(err)
+	}
+	service.SetMaxTokens(64)
+	if _, err := service.callAI(context.Background(), viewer, candidate, Forward); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := mock.ChatCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(calls))
+	}
+	if calls[0].MaxTokens != DefaultMaxTokens || calls[1].MaxTokens != 64 {
+		t.Errorf("expected max_tokens %d then 64, got %d and %d", DefaultMaxTokens, calls[0].MaxTokens, calls[1].MaxTokens)
+	}
+}
+
+func TestStorage_GetTopMatchesTieOrder(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"c3", "c1", "c5", "c2", "c4"} {
+				storage.UpdateMatch(context.Background(), "v1", id, MatchResult{TargetID: id, Score: 80})
+			}
+			storage.UpdateMatch(context.Background(), "v1", "top", MatchResult{TargetID: "top", Score: 95})
+
+			// Both backends break ties by target id descending, matching ZREVRANGE.
+			want := "top,c5,c4,c3,c2"
+			for i := 0; i < 20; i++ {
+				got := storage.GetTopMatches(context.Background(), "v1", 5)
+				ids := make([]string, 0, len(got))
+				for _, m := range got {
+					ids = append(ids, m.TargetID)
+				}
+				if strings.Join(ids, ",") != want {
+					t.Fatalf("attempt %d: expected %s, got %s", i, want, strings.Join(ids, ","))
+				}
+			}
+		})
+	}
+}
+
+func TestBuildMatchPrompt(t *testing.T) {
+	v := UserInput{
+		Summary:     "Trail runner",
+		Description: "Runs ultras",
+		Interests:   "running, coffee",
+		Tweets:      []string{"t1", "t2", "t3", "t4", "t5", "t6", "t7"},
+	}
+	c := UserInput{Summary: "Barista", Interests: "coffee"}
+
+	prompt := buildMatchPrompt(v, c, nil, Forward, DefaultPromptTweetLimit)
+	if !strings.Contains(prompt, "User A: Trail runner. Bio: Runs ultras. Interests: running, coffee. Recent tweets: t1 | t2 | t3 | t4 | t5.") {
+		t.Errorf("expected user A line with %d tweets, got:\n%s", DefaultPromptTweetLimit, prompt)
+	}
+	if strings.Contains(prompt, "t6") {
+		t.Error("expected tweets past the limit to be dropped")
+	}
+	if !strings.Contains(prompt, "User B: Barista. Bio: . Interests: coffee. Recent tweets: .") {
+		t.Errorf("expected empty fields to stay empty for user B, got:\n%s", prompt)
+	}
+
+	empty := buildMatchPrompt(UserInput{}, UserInput{}, nil, Forward, DefaultPromptTweetLimit)
+	if !strings.Contains(empty, "User A: . Bio: . Interests: . Recent tweets: .") || !strings.Contains(empty, `"score": 0-100`) {
+		t.Errorf("expected the template intact for empty inputs, got:\n%s", empty)
+	}
+	if (&Service{}).MatchPrompt(v, c, Forward) != prompt {
+		t.Error("expected MatchPrompt to match buildMatchPrompt")
+	}
+}
+
+func TestService_PromptTweetLimit(t *testing.T) {
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 60, "reason": "ok"}`)
+	service := NewServiceWithClient(mock)
+	service.SetPromptTweetLimit(2)
+	v := UserInput{ID: "v", Tweets: []string{"v1", "v2", "v3"}}
+	c := UserInput{ID: "c", Tweets: []string{"c1", "c2", "c3", "c4"}}
+
+	if _, err := service.callAI(context.Background(), v, c, Forward); err != nil {
+		t.Fatalf("callAI: %v", err)
+	}
+	prompt := mock.ChatCalls()[0].Messages[0].Content
+	// Each user's two tweets are joined by one separator.
+	if got := strings.Count(prompt, " | "); got != 2 {
+		t.Errorf("expected 2 tweet separators for a limit of 2, got %d:\n%s", got, prompt)
+	}
+	if strings.Contains(prompt, "v3") || strings.Contains(prompt, "c3") {
+		t.Error("expected tweets past the limit to be dropped")
+	}
+
+	service.SetPromptTweetLimit(0)
+	if got := service.PromptTweetLimit(); got != DefaultPromptTweetLimit {
+		t.Errorf("expected 0 to restore the default %d, got %d", DefaultPromptTweetLimit, got)
+	}
+}
+
+func TestMatchPrompt_RoleAware(t *testing.T) {
+	a := UserInput{ID: "a", Summary: "Junior dev learning Go"}
+	b := UserInput{ID: "b", Summary: "Staff engineer who mentors"}
+	service := &Service{}
+
+	symmetric := service.MatchPrompt(a, b, Forward)
+	if service.MatchPrompt(b, a, Reverse) != buildMatchPrompt(b, a, nil, Forward, DefaultPromptTweetLimit) {
+		t.Error("expected direction not to matter without roles")
+	}
+	service.SetRoles(&MatchRoles{Viewer: "mentee", Candidate: "mentor"})
+	forward := service.MatchPrompt(a, b, Forward)
+	// The reverse job has the mentor b score a back, as their mentee.
+	reverse := service.MatchPrompt(b, a, Reverse)
+
+	if forward == symmetric {
+		t.Fatal("expected role-aware mode to change the prompt")
+	}
+	if forward == reverse {
+		t.Fatal("expected the two directions to get different prompts")
+	}
+	if !strings.Contains(forward, "User A (mentee): Junior dev learning Go.") || !strings.Contains(forward, "User B (mentor): Staff engineer who mentors.") {
+		t.Errorf("expected a framed as mentee and b as mentor, got:\n%s", forward)
+	}
+	if !strings.Contains(reverse, "User A (mentor): Staff engineer who mentors.") || !strings.Contains(reverse, "User B (mentee): Junior dev learning Go.") {
+		t.Errorf("expected the reverse job to keep b as the mentor, got:\n%s", reverse)
+	}
+	if !strings.Contains(reverse, "how valuable would User B be to User A as their mentee?") {
+		t.Errorf("expected the reverse job to ask how good a mentee a is for b, got:\n%s", reverse)
+	}
+	if !strings.Contains(forward, `"score": 0-100`) {
+		t.Errorf("expected the reply format to be unchanged, got:\n%s", forward)
+	}
+
+	service.SetRoles(nil)
+	if service.MatchPrompt(a, b, Forward) != symmetric {
+		t.Error("expected nil roles to restore the symmetric prompt")
+	}
+}
+
+func TestService_ReverseJobUsesSwappedRoles(t *testing.T) {
+	mock := xaitest.NewFakeClient().SetChat(`{"score": 70, "reason": "Good fit."}`)
+	service := NewServiceWithClient(mock)
+	service.SetRoles(&MatchRoles{Viewer: "mentee", Candidate: "mentor"})
+
+	a := UserInput{ID: "a", Summary: "Junior dev learning Go", Interests: "go"}
+	b := UserInput{ID: "b", Summary: "Staff engineer who mentors", Interests: "go"}
+	service.CalculateMatchesAsync(context.Background(), a, []UserInput{b})
+	deadline := time.Now().Add(time.Second)
+	for len(mock.ChatCalls()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	prompts := []string{}
+	for _, call := range mock.ChatCalls() {
+		prompts = append(prompts, call.Messages[0].Content)
+	}
+	want := []string{service.MatchPrompt(a, b, Forward), service.MatchPrompt(b, a, Reverse)}
+	for _, p := range want {
+		if !slices.Contains(prompts, p) {
+			t.Errorf("expected the queued jobs to send:\n%s\ngot:\n%v", p, prompts)
+		}
+	}
+}
+
+func TestStorage_GetMatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]Storage{
+		"memory": &MemoryStorage{cache: make(map[string]map[string]MatchResult)},
+		"redis":  &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			storage.UpdateMatch(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 80, Reason: "one"})
+			storage.UpdateMatch(context.Background(), "v1", "c2", MatchResult{TargetID: "c2", Score: 60, Reason: "two"})
+			storage.UpdateMatch(context.Background(), "v2", "c3", MatchResult{TargetID: "c3", Score: 70})
+
+			got := storage.GetMatches(context.Background(), "v1", []string{"c1", "c2", "c3", "missing"})
+			if len(got) != 2 || got["c1"].Reason != "one" || got["c2"].Score != 60 {
+				t.Errorf("expected exactly c1 and c2, got %+v", got)
+			}
+			if got := storage.GetMatches(context.Background(), "v1", nil); len(got) != 0 {
+				t.Errorf("expected an empty map for no ids, got %+v", got)
+			}
+		})
+	}
+}
+
+// slowChat delays every reply so jobs are still queued when a test acts.
+type slowChat struct {
+	*xaitest.FakeClient
+	delay time.Duration
+}
+
+func (c slowChat) CreateChatCompletion(ctx context.Context, req xai.ChatRequest) (*xai.ChatResponse, error) {
+	time.Sleep(c.delay)
+	return c.FakeClient.CreateChatCompletion(ctx, req)
+}
+
+func TestService_ShutdownDrainsQueuedJobs(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ai := slowChat{FakeClient: xaitest.NewFakeClient().SetChat(`{"score": 70, "reason": "ok"}`), delay: 20 * time.Millisecond}
+	service := NewServiceWithClient(ai)
+	service.storage = &RedisStorage{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	var candidates []UserInput
+	for i := 0; i < 10; i++ {
+		candidates = append(candidates, UserInput{ID: fmt.Sprintf("c%d", i), Interests: "x"})
+	}
+	service.CalculateMatchesAsync(context.Background(), UserInput{ID: "v1", Interests: "x"}, candidates)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := service.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if n := len(service.GetTopMatches(context.Background(), "v1", 100)); n != len(candidates) {
+		t.Errorf("expected all %d viewer matches persisted by Shutdown, got %d", len(candidates), n)
+	}
+	for _, c := range candidates {
+		if _, ok := service.FindMatch(context.Background(), c.ID, "v1"); !ok {
+			t.Errorf("expected the reverse match for %s persisted by Shutdown", c.ID)
+		}
+	}
+
+	// Work arriving after shutdown is ignored rather than panicking on the
+	// closed queue, and a second Shutdown returns at once.
+	service.CalculateMatchesAsync(context.Background(), UserInput{ID: "v2", Interests: "x"}, candidates)
+	if err := service.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+	if n := len(service.GetTopMatches(context.Background(), "v2", 100)); n != 0 {
+		t.Errorf("expected no matches for work queued after shutdown, got %d", n)
+	}
+}
+
+func TestService_ShutdownHonorsContext(t *testing.T) {
+	ai := slowChat{FakeClient: xaitest.NewFakeClient().SetChat(`{"score": 70, "reason": "ok"}`), delay: 200 * time.Millisecond}
+	service := NewServiceWithClient(ai)
+	service.CalculateMatchesAsync(context.Background(), UserInput{ID: "v1", Interests: "x"}, []UserInput{{ID: "c1", Interests: "x"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := service.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to cut Shutdown short, got %v", err)
+	}
+}
+
+func TestNewService_GuardsRedisClients(t *testing.T) {
+	mr := miniredis.RunT(t)
+	service := NewService(nil, mr.Addr(), "secret", 2)
+	service.SetReadReplica(mr.Addr())
+	rs := service.storage.(*RedisStorage)
+	if rs.readClient == nil {
+		t.Fatal("expected SetReadReplica to add a read client")
+	}
+	if opts := rs.readClient.Options(); opts.Password != "secret" || opts.DB != 2 {
+		t.Errorf("expected the replica to share the primary's password and DB, got %q/%d", opts.Password, opts.DB)
+	}
+	for _, c := range []*redis.Client{rs.client, rs.readClient} {
+		if err := c.Keys(context.Background(), "*").Err(); !errors.Is(err, redisguard.ErrBlocked) {
+			t.Errorf("expected KEYS to be blocked, got %v", err)
+		}
+	}
+}
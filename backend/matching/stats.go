@@ -0,0 +1,164 @@
+package matching
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxStatsMatches caps how many of a viewer's top matches ViewerStats reads.
+const MaxStatsMatches = 1000
+
+// statsTTL is how long ViewerStats reuses a result while the viewer's match
+// set is unchanged. Mutual counts depend on other viewers' matches, so the
+// cache can't live on the version alone.
+const statsTTL = time.Minute
+
+// topSharedInterests is how many interests ViewerStats reports.
+const topSharedInterests = 5
+
+// ViewerStats summarizes a viewer's matching activity.
+type ViewerStats struct {
+	// Matches is how many matches the viewer has, up to MaxStatsMatches.
+	Matches      int     `json:"matches"`
+	AverageScore float64 `json:"average_score"`
+	// Mutual counts matches where the other user has a match with the
+	// viewer too.
+	Mutual int `json:"mutual"`
+	// TopSharedInterests are the interests the viewer shares with the most
+	// of their matches, most common first.
+	TopSharedInterests []InterestCount `json:"top_shared_interests"`
+}
+
+// InterestCount is how many of a viewer's matches share an interest.
+type InterestCount struct {
+	Interest string `json:"interest"`
+	Count    int    `json:"count"`
+}
+
+// InterestLookup returns the interest tokens (lowercased, as in
+// UserInput.InterestTokens) of each of userIDs, keyed by id and leaving out
+// unknown users. It is called once per batch rather than once per user.
+type InterestLookup func(ctx context.Context, userIDs []string) map[string][]string
+
+type cachedStats struct {
+	stats     ViewerStats
+	version   uint64
+	expiresAt time.Time
+}
+
+// statsCache holds recent ViewerStats results per viewer.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedStats
+}
+
+func (c *statsCache) get(viewerID string, version uint64, now time.Time) (ViewerStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[viewerID]
+	if !ok || e.version != version || now.After(e.expiresAt) {
+		return ViewerStats{}, false
+	}
+	return e.stats, true
+}
+
+func (c *statsCache) put(viewerID string, version uint64, stats ViewerStats, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedStats)
+	}
+	// Drop expired entries so viewers who stop asking don't pile up.
+	for id, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[viewerID] = cachedStats{stats: stats, version: version, expiresAt: now.Add(statsTTL)}
+}
+
+// SetInterestLookup gives ViewerStats and DiverseMatches access to users'
+// interests; without one, TopSharedInterests is empty and DiverseMatches
+// keeps score order.
+func (s *Service) SetInterestLookup(fn InterestLookup) {
+	s.interests.Store(&fn)
+}
+
+// ViewerStats summarizes the viewer's cached matches. Results are reused for
+// up to a minute while the viewer's match set is unchanged.
+func (s *Service) ViewerStats(ctx context.Context, viewerID string) ViewerStats {
+	now := time.Now()
+	version := s.storage.MatchVersion(ctx, viewerID)
+	if stats, ok := s.stats.get(viewerID, version, now); ok {
+		return stats
+	}
+
+	matches := s.storage.GetTopMatches(ctx, viewerID, MaxStatsMatches)
+	stats := ViewerStats{Matches: len(matches), TopSharedInterests: []InterestCount{}}
+	if len(matches) == 0 {
+		s.stats.put(viewerID, version, stats, now)
+		return stats
+	}
+
+	matchedBy := make(map[string]bool)
+	for _, m := range s.storage.MatchedBy(ctx, viewerID, 0, 0) {
+		matchedBy[m.ViewerID] = true
+	}
+	var lookup InterestLookup
+	if fn := s.interests.Load(); fn != nil {
+		lookup = *fn
+	}
+	var own map[string]bool
+	var tokens map[string][]string
+	if lookup != nil {
+		ids := make([]string, 0, len(matches)+1)
+		ids = append(ids, viewerID)
+		for _, m := range matches {
+			ids = append(ids, m.TargetID)
+		}
+		tokens = lookup(ctx, ids)
+		own = make(map[string]bool)
+		for _, t := range tokens[viewerID] {
+			own[t] = true
+		}
+	}
+
+	total := 0.0
+	shared := make(map[string]int)
+	for _, m := range matches {
+		total += m.Score
+		if matchedBy[m.TargetID] {
+			stats.Mutual++
+		}
+		if len(own) == 0 {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, t := range tokens[m.TargetID] {
+			if own[t] && !seen[t] {
+				seen[t] = true
+				shared[t]++
+			}
+		}
+	}
+	stats.AverageScore = total / float64(len(matches))
+
+	for interest, n := range shared {
+		stats.TopSharedInterests = append(stats.TopSharedInterests, InterestCount{Interest: interest, Count: n})
+	}
+	sort.Slice(stats.TopSharedInterests, func(i, j int) bool {
+		a, b := stats.TopSharedInterests[i], stats.TopSharedInterests[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Interest < b.Interest
+	})
+	if len(stats.TopSharedInterests) > topSharedInterests {
+		stats.TopSharedInterests = stats.TopSharedInterests[:topSharedInterests]
+	}
+
+	s.stats.put(viewerID, version, stats, now)
+	return stats
+}
@@ -0,0 +1,58 @@
+package matching
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"glowmeet/xai/xaitest"
+)
+
+func TestService_ViewerStats(t *testing.T) {
+	service := NewServiceWithClient(xaitest.NewFakeClient())
+	interests := map[string][]string{
+		"v": {"hiking", "jazz", "go"},
+		"a": {"hiking", "jazz"},
+		"b": {"jazz"},
+		"c": {"chess"},
+	}
+	service.SetInterestLookup(func(_ context.Context, ids []string) map[string][]string {
+		out := make(map[string][]string)
+		for _, id := range ids {
+			if tokens, ok := interests[id]; ok {
+				out[id] = tokens
+			}
+		}
+		return out
+	})
+
+	if got := service.ViewerStats(context.Background(), "v"); got.Matches != 0 || got.AverageScore != 0 || len(got.TopSharedInterests) != 0 {
+		t.Errorf("expected empty stats without matches, got %+v", got)
+	}
+
+	service.storage.UpdateMatch(context.Background(), "v", "a", MatchResult{TargetID: "a", Score: 90})
+	service.storage.UpdateMatch(context.Background(), "v", "b", MatchResult{TargetID: "b", Score: 60})
+	service.storage.UpdateMatch(context.Background(), "v", "c", MatchResult{TargetID: "c", Score: 30})
+	service.storage.UpdateMatch(context.Background(), "a", "v", MatchResult{TargetID: "v", Score: 80})
+	service.storage.UpdateMatch(context.Background(), "x", "v", MatchResult{TargetID: "v", Score: 99}) // not one of v's matches
+
+	got := service.ViewerStats(context.Background(), "v")
+	if got.Matches != 3 || got.AverageScore != 60 || got.Mutual != 1 {
+		t.Errorf("expected 3 matches averaging 60 with 1 mutual, got %+v", got)
+	}
+	want := []InterestCount{{"jazz", 2}, {"hiking", 1}}
+	if !reflect.DeepEqual(got.TopSharedInterests, want) {
+		t.Errorf("expected shared interests %v, got %v", want, got.TopSharedInterests)
+	}
+
+	// Another viewer's change is served from the cache; a change to the
+	// viewer's own matches is not.
+	service.storage.UpdateMatch(context.Background(), "b", "v", MatchResult{TargetID: "v", Score: 70})
+	if got := service.ViewerStats(context.Background(), "v"); got.Mutual != 1 {
+		t.Errorf("expected cached stats, got %+v", got)
+	}
+	service.storage.UpdateMatch(context.Background(), "v", "c", MatchResult{TargetID: "c", Score: 90})
+	if got := service.ViewerStats(context.Background(), "v"); got.Mutual != 2 || got.AverageScore != 80 {
+		t.Errorf("expected fresh stats after the viewer's matches changed, got %+v", got)
+	}
+}
@@ -0,0 +1,161 @@
+package matching
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"glowmeet/xai"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ErrStreamingUnsupported is returned by CalculateMatchStream when the AI
+// client can't stream completions.
+var ErrStreamingUnsupported = errors.New("matching: AI client does not support streaming")
+
+// CalculateMatchStream computes the viewer->candidate match, sending pieces
+// of the match reason as the model writes them. When the stream ends the
+// full reply is parsed and stored like any other match (or the failure is
+// recorded) before the channel is closed, so a caller that drained the
+// channel can read the result back with FindMatch.
+func (s *Service) CalculateMatchStream(ctx context.Context, v, c UserInput) (<-chan string, error) {
+	if s.aiClient == nil {
+		return nil, ErrNoAIClient
+	}
+	streamer, ok := s.aiClient.(xai.ChatStreamer)
+	if !ok {
+		return nil, ErrStreamingUnsupported
+	}
+	if err := checkMatchInputs(v); err != nil {
+		return nil, err
+	}
+
+	req := s.matchRequest(v, c, Forward)
+	deltas, err := streamer.StreamChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		var reply strings.Builder
+		var reason reasonScanner
+		var streamErr error
+		for d := range deltas {
+			if d.Err != nil {
+				streamErr = d.Err
+				continue
+			}
+			reply.WriteString(d.Content)
+			if piece := reason.feed(d.Content); piece != "" {
+				select {
+				case out <- piece:
+				case <-ctx.Done():
+				}
+			}
+		}
+		if streamErr == nil {
+			streamErr = ctx.Err()
+		}
+
+		res, err := parseMatchReply(c.ID, reply.String())
+		res.Model = string(req.Model)
+		if streamErr != nil {
+			err = streamErr
+		}
+		// The outcome is stored even if the client went away mid-stream.
+		storeCtx := context.WithoutCancel(ctx)
+		if err != nil {
+			log.Printf("[matcher] stream failed viewer=%s target=%s: %v", v.ID, c.ID, err)
+			s.recordFailure(storeCtx, v.ID, c.ID, err)
+			return
+		}
+		s.updateCache(storeCtx, v.ID, c.ID, res)
+	}()
+	return out, nil
+}
+
+var reasonKeyPattern = regexp.MustCompile(`"reason"\s*:\s*"`)
+
+// reasonScanner pulls the "reason" string value out of a JSON reply as it
+// streams in, unescaping it on the way. Escapes split across deltas are held
+// back until complete.
+type reasonScanner struct {
+	buf   string
+	pos   int // next unread byte of the reason value; 0 until found
+	found bool
+	done  bool
+}
+
+// feed adds a delta and returns any newly available reason text.
+func (r *reasonScanner) feed(delta string) string {
+	r.buf += delta
+	if r.done {
+		return ""
+	}
+	if !r.found {
+		loc := reasonKeyPattern.FindStringIndex(r.buf)
+		if loc == nil {
+			return ""
+		}
+		r.found = true
+		r.pos = loc[1]
+	}
+
+	var out strings.Builder
+	for r.pos < len(r.buf) {
+		ch := r.buf[r.pos]
+		if ch == '"' {
+			r.done = true
+			break
+		}
+		if ch != '\\' {
+			out.WriteByte(ch)
+			r.pos++
+			continue
+		}
+		n := r.escapeLen()
+		if n == 0 {
+			break // wait for the rest of the escape
+		}
+		var unescaped string
+		if err := json.Unmarshal([]byte(`"`+r.buf[r.pos:r.pos+n]+`"`), &unescaped); err == nil {
+			out.WriteString(unescaped)
+		}
+		r.pos += n
+	}
+	return out.String()
+}
+
+// escapeLen returns the length of the escape at r.pos, or 0 if it is not
+// all in the buffer yet. A high surrogate followed by another \u escape is
+// taken together with it, since the halves of a pair only decode as one.
+func (r *reasonScanner) escapeLen() int {
+	rest := r.buf[r.pos:]
+	if len(rest) < 2 {
+		return 0
+	}
+	if rest[1] != 'u' {
+		return 2
+	}
+	if len(rest) < 6 {
+		return 0
+	}
+	hi, err := strconv.ParseUint(rest[2:6], 16, 16)
+	if err != nil || !utf16.IsSurrogate(rune(hi)) || hi >= 0xDC00 {
+		return 6
+	}
+	switch {
+	case len(rest) < 8:
+		return 0
+	case rest[6:8] != `\u`:
+		return 6
+	case len(rest) < 12:
+		return 0
+	}
+	return 12
+}
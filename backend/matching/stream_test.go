@@ -0,0 +1,120 @@
+package matching
+
+import (
+	"context"
+	"errors"
+	"glowmeet/xai"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatedStreamer sends the deltas it is given on the stream, one at a time,
+// so tests control when the reply finishes.
+type gatedStreamer struct {
+	deltas chan xai.ChatDelta
+}
+
+func (g *gatedStreamer) CreateChatCompletion(ctx context.Context, req xai.ChatRequest) (*xai.ChatResponse, error) {
+	return nil, errors.New("not used")
+}
+
+func (g *gatedStreamer) StreamChatCompletion(ctx context.Context, req xai.ChatRequest) (<-chan xai.ChatDelta, error) {
+	return g.deltas, nil
+}
+
+func TestService_CalculateMatchStream(t *testing.T) {
+	ai := &gatedStreamer{deltas: make(chan xai.ChatDelta)}
+	service := NewServiceWithClient(ai)
+	viewer := UserInput{ID: "v1", Interests: "hiking"}
+	candidate := UserInput{ID: "c1", Interests: "hiking"}
+
+	chunks, err := service.CalculateMatchStream(context.Background(), viewer, candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { ai.deltas <- xai.ChatDelta{Content: `{"score": 88, "reason": "You both `} }()
+	select {
+	case got := <-chunks:
+		if got != "You both " {
+			t.Errorf("expected the first reason piece, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a chunk before the reply finished")
+	}
+	if _, ok := service.FindMatch(context.Background(), "v1", "c1"); ok {
+		t.Fatal("expected no stored match before the stream ends")
+	}
+
+	go func() {
+		ai.deltas <- xai.ChatDelta{Content: `love \"long\" trails.", "tags": ["outdoors"]}`}
+		close(ai.deltas)
+	}()
+	var rest strings.Builder
+	for c := range chunks {
+		rest.WriteString(c)
+	}
+	if rest.String() != `love "long" trails.` {
+		t.Errorf("expected the rest of the reason, got %q", rest.String())
+	}
+
+	m, ok := service.FindMatch(context.Background(), "v1", "c1")
+	if !ok || m.Score != 88 || m.Reason != `You both love "long" trails.` || len(m.ReasonTags) != 1 {
+		t.Errorf("expected the assembled match to be stored, got %+v (found=%t)", m, ok)
+	}
+}
+
+func TestService_CalculateMatchStreamFailure(t *testing.T) {
+	ai := &gatedStreamer{deltas: make(chan xai.ChatDelta, 2)}
+	service := NewServiceWithClient(ai)
+	service.updateCache(context.Background(), "v1", "c1", MatchResult{TargetID: "c1", Score: 40, Reason: "old"})
+
+	ai.deltas <- xai.ChatDelta{Content: `{"score": 9`}
+	ai.deltas <- xai.ChatDelta{Err: errors.New("connection reset")}
+	close(ai.deltas)
+
+	chunks, err := service.CalculateMatchStream(context.Background(), UserInput{ID: "v1", Interests: "go"}, UserInput{ID: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range chunks {
+	}
+	m, _ := service.FindMatch(context.Background(), "v1", "c1")
+	if m.Score != 40 || m.Reason != "old" || !strings.Contains(m.LastError, "connection reset") {
+		t.Errorf("expected the failure recorded on the old match, got %+v", m)
+	}
+
+	if _, err := NewServiceWithClient(&chatOnly{}).CalculateMatchStream(context.Background(), UserInput{ID: "v1", Interests: "go"}, UserInput{ID: "c1"}); !errors.Is(err, ErrStreamingUnsupported) {
+		t.Errorf("expected ErrStreamingUnsupported, got %v", err)
+	}
+}
+
+type chatOnly struct{}
+
+func (chatOnly) CreateChatCompletion(ctx context.Context, req xai.ChatRequest) (*xai.ChatResponse, error) {
+	return nil, errors.New("not used")
+}
+
+func TestReasonScanner(t *testing.T) {
+	deltas := []string{`{"sco`, `re": 70, "rea`, `son"`, `: "Caf`, `é `, `fans \`, `n`, `both \/ `, `\u`, `2764"`, `, "tags": []}`}
+	var r reasonScanner
+	var got strings.Builder
+	for _, d := range deltas {
+		got.WriteString(r.feed(d))
+	}
+	if want := "Café fans \nboth / ❤"; got.String() != want {
+		t.Errorf("expected %q, got %q", want, got.String())
+	}
+}
+
+func TestReasonScanner_SurrogatePairSplitAcrossDeltas(t *testing.T) {
+	reply := `{"score": 70, "reason": "Fun \ud83d\ude00 and \ud83d!", "tags": []}`
+	for split := 1; split < len(reply); split++ {
+		var r reasonScanner
+		got := r.feed(reply[:split]) + r.feed(reply[split:])
+		if want := "Fun 😀 and \uFFFD!"; got != want {
+			t.Errorf("split at %d: expected %q, got %q", split, want, got)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Package redisguard keeps commands that walk or wipe the whole keyspace
+// from being sent on a redis client.
+package redisguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// blocked walk or wipe the whole keyspace in one call, stalling redis for
+// every other client on a large dataset.
+var blocked = map[string]bool{
+	"keys":     true,
+	"flushall": true,
+	"flushdb":  true,
+}
+
+// ErrBlocked is returned for a command the guard refuses to send.
+var ErrBlocked = errors.New("redis command blocked")
+
+// hook fails blocked commands before they reach redis.
+type hook struct{}
+
+func (hook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (hook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := check(cmd); err != nil {
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (hook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if err := check(cmd); err != nil {
+				return err
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func check(cmd redis.Cmder) error {
+	if !blocked[strings.ToLower(cmd.Name())] {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s", ErrBlocked, cmd.Name())
+	cmd.SetErr(err)
+	return err
+}
+
+// Install adds the guard to c and returns it.
+func Install(c *redis.Client) *redis.Client {
+	c.AddHook(hook{})
+	return c
+}
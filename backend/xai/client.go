@@ -1,12 +1,16 @@
 package xai
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -21,17 +25,208 @@ const (
 	ModelGrok41FastNonReasoning Model = "grok-4-1-fast-non-reasoning"
 )
 
+// DefaultModel is the chat model used when neither the request nor
+// WithDefaultModel names one.
+const DefaultModel = ModelGrok41Fast
+
+// IsKnownModel reports whether m is one of the chat models this package
+// knows about. Unknown models are still sent as given; callers use this to
+// warn about likely typos.
+func IsKnownModel(m Model) bool {
+	switch m {
+	case ModelGrok41Fast, ModelGrok41FastNonReasoning:
+		return true
+	}
+	return false
+}
+
+// ChatCompleter is implemented by clients that can run chat completions.
+type ChatCompleter interface {
+	CreateChatCompletion(ctx context.Context, req ChatRequest) (*ChatResponse, error)
+}
+
+// ChatStreamer is implemented by clients that can stream chat completions.
+type ChatStreamer interface {
+	StreamChatCompletion(ctx context.Context, req ChatRequest) (<-chan ChatDelta, error)
+}
+
+// ImageGenerator is implemented by clients that can generate images from a prompt.
+type ImageGenerator interface {
+	GenerateImage(ctx context.Context, prompt string) (string, error)
+}
+
+// ResponseGenerator is implemented by clients that can call the responses API.
+type ResponseGenerator interface {
+	GenerateResponse(ctx context.Context, req ResponseRequest) (*ResponsesResponse, error)
+}
+
+// Pinger is implemented by clients that can check connectivity and credentials.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+var (
+	_ ChatCompleter     = (*Client)(nil)
+	_ ImageGenerator    = (*Client)(nil)
+	_ ResponseGenerator = (*Client)(nil)
+	_ Pinger            = (*Client)(nil)
+)
+
+// ErrUnauthorized is returned by Ping when the API rejects the key.
+var ErrUnauthorized = errors.New("xai: api key rejected")
+
+// APIError is returned when the xAI API answers with a non-200 status.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("xai api error: status=%d body=%s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the status suggests retrying may succeed: rate
+// limiting or a server-side failure.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// IsRetryable reports whether err is a transient failure worth retrying:
+// a temporary API status, a network error or timeout, or a response cut
+// short. Cancellation and other API errors are not.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
 type Client struct {
 	apiKey     string
+	baseURL    string
 	httpClient *http.Client
+	// sem bounds in-flight requests when set by WithMaxConcurrency.
+	sem chan struct{}
+	// traceHeader carries the context's trace id on each request; empty
+	// disables it.
+	traceHeader string
+	// userAgent is sent on every request; empty leaves Go's default.
+	userAgent string
+	// defaultModel fills in requests that don't name a model.
+	defaultModel Model
+}
+
+// DefaultTraceHeader is the header a context's trace id is sent in.
+const DefaultTraceHeader = "X-Request-Id"
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context whose xAI requests carry id in the trace
+// header, so calls can be matched up with xAI-side logs.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceID returns the id set by WithTraceID, or "".
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// WithTraceHeader sets the header the trace id is sent in. An empty name
+// stops sending it.
+func WithTraceHeader(name string) Option {
+	return func(c *Client) {
+		c.traceHeader = name
+	}
+}
+
+// DefaultUserAgent identifies GlowMeet traffic when WithUserAgent isn't used.
+const DefaultUserAgent = "glowmeet"
+
+// WithUserAgent sets the User-Agent sent on every request, e.g. to add a
+// version or contact string. An empty value keeps DefaultUserAgent.
+func WithUserAgent(s string) Option {
+	return func(c *Client) {
+		if s != "" {
+			c.userAgent = s
+		}
+	}
+}
+
+// WithDefaultModel sets the model used by requests that leave Model empty.
+// An empty m keeps DefaultModel.
+func WithDefaultModel(m Model) Option {
+	return func(c *Client) {
+		if m != "" {
+			c.defaultModel = m
+		}
+	}
 }
 
-func NewClient(apiKey string) *Client {
-	return &Client{
-		apiKey: apiKey,
+// setHeaders sets the headers shared by every request: the User-Agent and
+// the request context's trace id, if any.
+func (c *Client) setHeaders(req *http.Request) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if c.traceHeader == "" {
+		return
+	}
+	if id := TraceID(req.Context()); id != "" {
+		req.Header.Set(c.traceHeader, id)
+	}
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithMaxConcurrency caps how many requests the client has in flight at
+// once. Callers beyond the cap wait for a slot or for their context to end.
+// n <= 0 leaves the client unbounded.
+func WithMaxConcurrency(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+func NewClient(apiKey string, opts ...Option) *Client {
+	c := &Client{
+		apiKey:  apiKey,
+		baseURL: BaseURL,
 		httpClient: &http.Client{
 			Timeout: 5 * time.Minute,
 		},
+		traceHeader:  DefaultTraceHeader,
+		userAgent:    DefaultUserAgent,
+		defaultModel: DefaultModel,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// acquire waits for a request slot. The returned func releases it.
+func (c *Client) acquire(ctx context.Context) (func(), error) {
+	if c.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.sem <- struct{}{}:
+		return func() { <-c.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
@@ -41,6 +236,8 @@ type ChatRequest struct {
 	Messages []Message `json:"messages"`
 	Model    Model     `json:"model"`
 	Stream   bool      `json:"stream"`
+	// MaxTokens caps the completion length; 0 leaves it to the API default.
+	MaxTokens int `json:"max_tokens,omitempty"`
 }
 
 type Message struct {
@@ -61,7 +258,7 @@ type Choice struct {
 
 func (c *Client) CreateChatCompletion(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
 	if req.Model == "" {
-		req.Model = ModelGrok41Fast // Default model
+		req.Model = c.defaultModel
 	}
 
 	body, err := json.Marshal(req)
@@ -69,13 +266,20 @@ func (c *Client) CreateChatCompletion(ctx context.Context, req ChatRequest) (*Ch
 		return nil, err
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, BaseURL+"/chat/completions", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.setHeaders(httpReq)
+
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
@@ -86,7 +290,7 @@ func (c *Client) CreateChatCompletion(ctx context.Context, req ChatRequest) (*Ch
 	if resp.StatusCode != http.StatusOK {
 		var errorBody bytes.Buffer
 		_, _ = errorBody.ReadFrom(resp.Body)
-		return nil, fmt.Errorf("xai api error: status=%d body=%s", resp.StatusCode, errorBody.String())
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: errorBody.String()}
 	}
 
 	var chatResp ChatResponse
@@ -97,6 +301,149 @@ func (c *Client) CreateChatCompletion(ctx context.Context, req ChatRequest) (*Ch
 	return &chatResp, nil
 }
 
+// ChatDelta is one streamed piece of a chat completion. A delta with Err set
+// is the last one sent before the channel closes.
+type ChatDelta struct {
+	Content string
+	Err     error
+}
+
+type chatStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+// StreamChatCompletion runs a chat completion with stream=true and sends the
+// content deltas as they arrive. Errors before the stream starts (including
+// non-200 responses) are returned directly; later ones arrive as a final
+// ChatDelta. The channel is closed when the stream ends or ctx is done.
+func (c *Client) StreamChatCompletion(ctx context.Context, req ChatRequest) (<-chan ChatDelta, error) {
+	if req.Model == "" {
+		req.Model = c.defaultModel
+	}
+	req.Stream = true
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.setHeaders(httpReq)
+
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer release()
+		defer resp.Body.Close()
+		var errorBody bytes.Buffer
+		_, _ = errorBody.ReadFrom(resp.Body)
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: errorBody.String()}
+	}
+
+	out := make(chan ChatDelta)
+	go func() {
+		defer close(out)
+		defer release()
+		defer resp.Body.Close()
+
+		send := func(d ChatDelta) bool {
+			select {
+			case out <- d:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue // blank separators, comments, event names
+			}
+			data = strings.TrimSpace(data)
+			if data == "[DONE]" {
+				return
+			}
+			var chunk chatStreamChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				send(ChatDelta{Err: fmt.Errorf("decode stream chunk: %w", err)})
+				return
+			}
+			for _, choice := range chunk.Choices {
+				if choice.Delta.Content == "" {
+					continue
+				}
+				if !send(ChatDelta{Content: choice.Delta.Content}) {
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			send(ChatDelta{Err: err})
+			return
+		}
+		send(ChatDelta{Err: io.ErrUnexpectedEOF})
+	}()
+	return out, nil
+}
+
+// Ping lists the available models, a cheap call that checks the API is
+// reachable and the key is accepted. Auth failures wrap ErrUnauthorized.
+func (c *Client) Ping(ctx context.Context) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/models", nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.setHeaders(httpReq)
+
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errorBody bytes.Buffer
+		_, _ = errorBody.ReadFrom(resp.Body)
+		apiErr := &APIError{StatusCode: resp.StatusCode, Body: errorBody.String()}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: %w", ErrUnauthorized, apiErr)
+		}
+		return apiErr
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
 type ImageRequest struct {
 	Prompt         string `json:"prompt"`
 	Model          string `json:"model"`
@@ -125,13 +472,20 @@ func (c *Client) GenerateImage(ctx context.Context, prompt string) (string, erro
 		return "", err
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, BaseURL+"/images/generations", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/images/generations", bytes.NewReader(body))
 	if err != nil {
 		return "", err
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.setHeaders(httpReq)
+
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
 
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
@@ -142,7 +496,7 @@ func (c *Client) GenerateImage(ctx context.Context, prompt string) (string, erro
 	if resp.StatusCode != http.StatusOK {
 		var errorBody bytes.Buffer
 		_, _ = errorBody.ReadFrom(resp.Body)
-		return "", fmt.Errorf("xai api error: status=%d body=%s", resp.StatusCode, errorBody.String())
+		return "", &APIError{StatusCode: resp.StatusCode, Body: errorBody.String()}
 	}
 
 	var imgResp ImageResponse
@@ -186,9 +540,90 @@ type WebSearchFilters struct {
 }
 
 type ResponsesResponse struct {
-	Output    []ResponseItem `json:"output"`
-	Citations []string       `json:"citations"`
-	Usage     interface{}    `json:"usage"` // Simplified for now
+	Output []ResponseItem `json:"output"`
+	// RawCitations is the top-level citation list as returned; use
+	// Citations for the merged, de-duplicated sources.
+	RawCitations []string    `json:"citations"`
+	Usage        interface{} `json:"usage"` // Simplified for now
+}
+
+// Citations returns the response's source URLs: the top-level citations
+// followed by any url_citation annotations on output text, in order, without
+// blanks or duplicates.
+func (r *ResponsesResponse) Citations() []string {
+	if r == nil {
+		return nil
+	}
+	var out []string
+	seen := make(map[string]bool)
+	add := func(u string) {
+		u = strings.TrimSpace(u)
+		if u != "" && !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	for _, c := range r.RawCitations {
+		add(c)
+	}
+	for _, part := range r.outputParts() {
+		for _, a := range part.Annotations {
+			if a.Type == "url_citation" {
+				add(a.URL)
+			}
+		}
+	}
+	return out
+}
+
+// OutputText returns the text of the response's output, joining multiple
+// text parts with newlines.
+func (r *ResponsesResponse) OutputText() string {
+	if r == nil {
+		return ""
+	}
+	var texts []string
+	for _, item := range r.Output {
+		if s, ok := item.Content.(string); ok && s != "" {
+			texts = append(texts, s)
+		}
+	}
+	for _, part := range r.outputParts() {
+		if part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// outputContentPart is one entry of a message item's content list.
+type outputContentPart struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"annotations"`
+}
+
+// outputParts decodes the structured content parts of message output items.
+// Items whose content is a plain string or something else are skipped.
+func (r *ResponsesResponse) outputParts() []outputContentPart {
+	var out []outputContentPart
+	for _, item := range r.Output {
+		if _, ok := item.Content.([]interface{}); !ok {
+			continue
+		}
+		raw, err := json.Marshal(item.Content)
+		if err != nil {
+			continue
+		}
+		var parts []outputContentPart
+		if json.Unmarshal(raw, &parts) == nil {
+			out = append(out, parts...)
+		}
+	}
+	return out
 }
 
 type ResponseItem struct {
@@ -211,7 +646,7 @@ type FunctionCall struct {
 // This endpoint returns a ResponsesResponse with an Output array.
 func (c *Client) GenerateResponse(ctx context.Context, req ResponseRequest) (*ResponsesResponse, error) {
 	if req.Model == "" {
-		req.Model = string(ModelGrok41Fast)
+		req.Model = string(c.defaultModel)
 	}
 
 	body, err := json.Marshal(req)
@@ -219,13 +654,20 @@ func (c *Client) GenerateResponse(ctx context.Context, req ResponseRequest) (*Re
 		return nil, err
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, BaseURL+"/responses", bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/responses", bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.setHeaders(httpReq)
+
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
@@ -236,7 +678,7 @@ func (c *Client) GenerateResponse(ctx context.Context, req ResponseRequest) (*Re
 	if resp.StatusCode != http.StatusOK {
 		var errorBody bytes.Buffer
 		_, _ = errorBody.ReadFrom(resp.Body)
-		return nil, fmt.Errorf("xai api error: status=%d body=%s", resp.StatusCode, errorBody.String())
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: errorBody.String()}
 	}
 
 	var responsesResp ResponsesResponse
@@ -255,3 +697,48 @@ func (c *Client) GenerateResponse(ctx context.Context, req ResponseRequest) (*Re
 
 	return &responsesResp, nil
 }
+
+// ErrNoChoices is returned by FirstChoiceContent for a completion with no
+// choices.
+var ErrNoChoices = errors.New("xai: response has no choices")
+
+// FirstChoiceContent returns the first choice's message content. A response
+// without choices is an error that names the response id for debugging.
+func FirstChoiceContent(resp *ChatResponse) (string, error) {
+	if resp == nil {
+		return "", ErrNoChoices
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("%w (response_id=%s)", ErrNoChoices, resp.ID)
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// ExtractJSON returns the outermost {...} block of a model reply, so JSON
+// wrapped in prose or markdown fences can still be decoded. If no block is
+// found the content is returned unchanged.
+func ExtractJSON(content string) string {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start != -1 && end != -1 && end > start {
+		return content[start : end+1]
+	}
+	return content
+}
+
+// JSONCorrection is the follow-up sent after a reply that should have been
+// JSON could not be decoded.
+const JSONCorrection = "Your previous response was not valid JSON. Return only the JSON object."
+
+// JSONRetryRequest returns a copy of req that replays the conversation with
+// the model's unparseable reply and a JSONCorrection message appended.
+func JSONRetryRequest(req ChatRequest, reply string) ChatRequest {
+	msgs := make([]Message, 0, len(req.Messages)+2)
+	msgs = append(msgs, req.Messages...)
+	msgs = append(msgs,
+		Message{Role: "assistant", Content: reply},
+		Message{Role: "user", Content: JSONCorrection},
+	)
+	req.Messages = msgs
+	return req
+}
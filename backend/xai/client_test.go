@@ -2,9 +2,18 @@ package xai
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -183,3 +192,365 @@ func TestClient_GenerateResponse_XSearch_Integration(t *testing.T) {
 		}
 	}
 }
+
+func TestExtractJSON(t *testing.T) {
+	cases := map[string]string{
+		`{"score": 1}`:                          `{"score": 1}`,
+		"```json\n{\"score\": 1}\n```":          `{"score": 1}`,
+		`Sure! {"a": {"b": 2}} hope that helps`: `{"a": {"b": 2}}`,
+		`no json here`:                          `no json here`,
+	}
+	for in, want := range cases {
+		if got := ExtractJSON(in); got != want {
+			t.Errorf("ExtractJSON(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{fmt.Errorf("match: %w", &APIError{StatusCode: http.StatusServiceUnavailable}), true},
+		{&APIError{StatusCode: http.StatusBadRequest}, false},
+		{&APIError{StatusCode: http.StatusUnauthorized}, false},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("invalid character 'x' looking for beginning of value"), false},
+	}
+	for _, tc := range cases {
+		if got := IsRetryable(tc.err); got != tc.want {
+			t.Errorf("IsRetryable(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+
+	// A refused connection surfaces as a net.Error from the HTTP client.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	client := NewClient("key")
+	client.baseURL = srv.URL
+	_, err := client.CreateChatCompletion(context.Background(), ChatRequest{})
+	if !IsRetryable(err) {
+		t.Errorf("IsRetryable(%v) = false, want true", err)
+	}
+}
+
+func TestClient_WithMaxConcurrency(t *testing.T) {
+	const limit = 2
+	var inFlight, peak atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+		fmt.Fprint(w, `{"id":"x","choices":[{"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer srv.Close()
+
+	client := NewClient("test-key", WithMaxConcurrency(limit))
+	client.baseURL = srv.URL
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.CreateChatCompletion(context.Background(), ChatRequest{}); err != nil {
+				t.Errorf("CreateChatCompletion: %v", err)
+			}
+		}()
+	}
+
+	// Let the first requests reach the server, then confirm the rest wait.
+	deadline := time.Now().Add(time.Second)
+	for inFlight.Load() < limit && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := inFlight.Load(); got != limit {
+		t.Errorf("expected %d requests in flight, got %d", limit, got)
+	}
+
+	close(release)
+	wg.Wait()
+	if got := peak.Load(); got > limit {
+		t.Errorf("expected at most %d concurrent requests, saw %d", limit, got)
+	}
+}
+
+func TestClient_WithMaxConcurrencyContextCancel(t *testing.T) {
+	client := NewClient("test-key", WithMaxConcurrency(1))
+	client.sem <- struct{}{} // occupy the only slot
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.CreateChatCompletion(ctx, ChatRequest{}); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded while waiting for a slot, got %v", err)
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	status := http.StatusUnauthorized
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/models" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"error":"Incorrect API key provided"}`)
+	}))
+	defer srv.Close()
+
+	client := NewClient("bad-key")
+	client.baseURL = srv.URL
+
+	err := client.Ping(context.Background())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected wrapped APIError with status 401, got %v", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := client.Ping(context.Background()); err == nil || errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected a non-auth error for 503, got %v", err)
+	}
+
+	status = http.StatusOK
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("expected ping to succeed, got %v", err)
+	}
+}
+
+func TestClient_StreamChatCompletion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Stream {
+			t.Errorf("expected a streaming request, got %+v (%v)", req, err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, line := range []string{
+			`data: {"choices":[{"delta":{"role":"assistant"}}]}`,
+			`data: {"choices":[{"delta":{"content":"Hel"}}]}`,
+			`: keep-alive`,
+			`data: {"choices":[{"delta":{"content":"lo"}}]}`,
+			`data: [DONE]`,
+		} {
+			fmt.Fprintf(w, "%s\n\n", line)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClient("key")
+	client.baseURL = srv.URL
+
+	deltas, err := client.StreamChatCompletion(context.Background(), ChatRequest{Messages: []Message{{Role: "user", Content: "hi"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for d := range deltas {
+		if d.Err != nil {
+			t.Fatalf("unexpected stream error: %v", d.Err)
+		}
+		got = append(got, d.Content)
+	}
+	if strings.Join(got, "|") != "Hel|lo" {
+		t.Errorf("expected deltas Hel|lo, got %v", got)
+	}
+}
+
+func TestClient_StreamChatCompletionErrors(t *testing.T) {
+	var truncated atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !truncated.Load() {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":"rate limit exceeded"}`)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"partial\"}}]}\n\n")
+	}))
+	defer srv.Close()
+
+	client := NewClient("key")
+	client.baseURL = srv.URL
+
+	var apiErr *APIError
+	if _, err := client.StreamChatCompletion(context.Background(), ChatRequest{}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 APIError up front, got %v", err)
+	}
+
+	truncated.Store(true)
+	deltas, err := client.StreamChatCompletion(context.Background(), ChatRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last ChatDelta
+	for d := range deltas {
+		last = d
+	}
+	if !errors.Is(last.Err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected a stream cut short to end with ErrUnexpectedEOF, got %+v", last)
+	}
+}
+
+func TestClient_TraceHeader(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		fmt.Fprint(w, `{"id":"resp-1","choices":[{"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer srv.Close()
+
+	call := func(client *Client, ctx context.Context) http.Header {
+		t.Helper()
+		client.baseURL = srv.URL
+		resp, err := client.CreateChatCompletion(ctx, ChatRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != "resp-1" {
+			t.Errorf("expected response id resp-1, got %q", resp.ID)
+		}
+		return <-headers
+	}
+
+	traced := WithTraceID(context.Background(), "req-123")
+	if TraceID(traced) != "req-123" {
+		t.Fatalf("expected trace id in context, got %q", TraceID(traced))
+	}
+	if got := call(NewClient("key"), traced).Get(DefaultTraceHeader); got != "req-123" {
+		t.Errorf("expected %s: req-123, got %q", DefaultTraceHeader, got)
+	}
+	if got := call(NewClient("key"), context.Background()).Get(DefaultTraceHeader); got != "" {
+		t.Errorf("expected no trace header without a trace id, got %q", got)
+	}
+	if got := call(NewClient("key", WithTraceHeader("X-Trace-Id")), traced).Get("X-Trace-Id"); got != "req-123" {
+		t.Errorf("expected custom trace header, got %q", got)
+	}
+	if got := call(NewClient("key", WithTraceHeader("")), traced).Get(DefaultTraceHeader); got != "" {
+		t.Errorf("expected no trace header when disabled, got %q", got)
+	}
+}
+
+func TestClient_UserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+		if r.URL.Path == "/models" {
+			fmt.Fprint(w, `{"data":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"resp-1","choices":[{"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer srv.Close()
+
+	client := NewClient("key")
+	client.baseURL = srv.URL
+	if _, err := client.CreateChatCompletion(context.Background(), ChatRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-agents; got != DefaultUserAgent {
+		t.Errorf("expected default User-Agent %q, got %q", DefaultUserAgent, got)
+	}
+
+	client = NewClient("key", WithUserAgent("glowmeet/1.2.3 (ops@example.com)"))
+	client.baseURL = srv.URL
+	if _, err := client.CreateChatCompletion(context.Background(), ChatRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-agents; got != "glowmeet/1.2.3 (ops@example.com)" {
+		t.Errorf("expected custom User-Agent on chat, got %q", got)
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-agents; got != "glowmeet/1.2.3 (ops@example.com)" {
+		t.Errorf("expected custom User-Agent on ping, got %q", got)
+	}
+}
+
+func TestClient_DefaultModel(t *testing.T) {
+	models := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		models <- body.Model
+		fmt.Fprint(w, `{"id":"resp-1","choices":[{"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer srv.Close()
+
+	call := func(client *Client, req ChatRequest) string {
+		t.Helper()
+		client.baseURL = srv.URL
+		if _, err := client.CreateChatCompletion(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		return <-models
+	}
+
+	if got := call(NewClient("key"), ChatRequest{}); got != string(DefaultModel) {
+		t.Errorf("expected %s without an option, got %q", DefaultModel, got)
+	}
+	configured := NewClient("key", WithDefaultModel("grok-5"))
+	if got := call(configured, ChatRequest{}); got != "grok-5" {
+		t.Errorf("expected the configured default when the request omits the model, got %q", got)
+	}
+	if got := call(configured, ChatRequest{Model: ModelGrok41FastNonReasoning}); got != string(ModelGrok41FastNonReasoning) {
+		t.Errorf("expected an explicit model to win, got %q", got)
+	}
+	if IsKnownModel("grok-5") || !IsKnownModel(DefaultModel) {
+		t.Error("unexpected IsKnownModel result")
+	}
+}
+
+func TestClient_GenerateResponseCitations(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+			"output": [
+				{"type": "web_search_call"},
+				{"type": "message", "content": [{
+					"type": "output_text",
+					"text": "Builds compilers in Rust.",
+					"annotations": [
+						{"type": "url_citation", "url": "https://x.com/ada/status/2"},
+						{"type": "url_citation", "url": "https://example.com/ada"}
+					]
+				}]}
+			],
+			"citations": ["https://x.com/ada/status/1", "https://x.com/ada/status/2", ""]
+		}`)
+	}))
+	defer srv.Close()
+
+	client := NewClient("key")
+	client.baseURL = srv.URL
+	resp, err := client.GenerateResponse(context.Background(), ResponseRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://x.com/ada/status/1", "https://x.com/ada/status/2", "https://example.com/ada"}
+	if got := resp.Citations(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected merged, de-duplicated citations %v, got %v", want, got)
+	}
+	if got := resp.OutputText(); got != "Builds compilers in Rust." {
+		t.Errorf("expected output text, got %q", got)
+	}
+	if (*ResponsesResponse)(nil).Citations() != nil {
+		t.Error("expected no citations from a nil response")
+	}
+}
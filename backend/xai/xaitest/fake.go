@@ -0,0 +1,235 @@
+// Package xaitest provides a fake xAI client for tests.
+package xaitest
+
+import (
+	"context"
+	"errors"
+	"glowmeet/xai"
+	"net/http"
+	"sync"
+)
+
+// ErrNoResponse is returned when a call has nothing queued and no default set.
+var ErrNoResponse = errors.New("xaitest: no response configured")
+
+var (
+	_ xai.ChatCompleter     = (*FakeClient)(nil)
+	_ xai.ChatStreamer      = (*FakeClient)(nil)
+	_ xai.ImageGenerator    = (*FakeClient)(nil)
+	_ xai.ResponseGenerator = (*FakeClient)(nil)
+)
+
+// RateLimitError returns the error the real client produces for a 429.
+func RateLimitError() error {
+	return &xai.APIError{StatusCode: http.StatusTooManyRequests, Body: `{"error":"rate limit exceeded"}`}
+}
+
+// ChatResponse builds a chat response with a single assistant choice.
+func ChatResponse(content string) *xai.ChatResponse {
+	return &xai.ChatResponse{
+		ID:      "fake-chat",
+		Choices: []xai.Choice{{Message: xai.Message{Role: "assistant", Content: content}}},
+	}
+}
+
+type result[T any] struct {
+	val T
+	err error
+}
+
+// replies hands out queued results first, then falls back to a default.
+type replies[T any] struct {
+	queue []result[T]
+	def   *result[T]
+}
+
+func (r *replies[T]) next() (T, error) {
+	if len(r.queue) > 0 {
+		res := r.queue[0]
+		r.queue = r.queue[1:]
+		return res.val, res.err
+	}
+	if r.def != nil {
+		return r.def.val, r.def.err
+	}
+	var zero T
+	return zero, ErrNoResponse
+}
+
+// FakeClient records requests and returns canned chat, image and responses
+// replies. Queued replies are used in order; once the queue is empty the
+// default (set with the Set* methods) is returned. It is safe for concurrent use.
+type FakeClient struct {
+	mu sync.Mutex
+
+	chat      replies[*xai.ChatResponse]
+	images    replies[string]
+	responses replies[*xai.ResponsesResponse]
+
+	chatCalls     []xai.ChatRequest
+	imageCalls    []string
+	responseCalls []xai.ResponseRequest
+}
+
+// NewFakeClient returns a FakeClient with nothing configured.
+func NewFakeClient() *FakeClient {
+	return &FakeClient{}
+}
+
+// SetChat makes every unqueued chat call answer with content.
+func (f *FakeClient) SetChat(content string) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chat.def = &result[*xai.ChatResponse]{val: ChatResponse(content)}
+	return f
+}
+
+// SetChatError makes every unqueued chat call fail with err.
+func (f *FakeClient) SetChatError(err error) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chat.def = &result[*xai.ChatResponse]{err: err}
+	return f
+}
+
+// QueueChat queues one chat reply per content string.
+func (f *FakeClient) QueueChat(contents ...string) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range contents {
+		f.chat.queue = append(f.chat.queue, result[*xai.ChatResponse]{val: ChatResponse(c)})
+	}
+	return f
+}
+
+// QueueChatResponse queues a full chat response, e.g. one with no choices.
+func (f *FakeClient) QueueChatResponse(resp *xai.ChatResponse) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chat.queue = append(f.chat.queue, result[*xai.ChatResponse]{val: resp})
+	return f
+}
+
+// QueueChatError queues a failing chat call.
+func (f *FakeClient) QueueChatError(err error) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chat.queue = append(f.chat.queue, result[*xai.ChatResponse]{err: err})
+	return f
+}
+
+// SetImage makes every unqueued image call return url.
+func (f *FakeClient) SetImage(url string) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images.def = &result[string]{val: url}
+	return f
+}
+
+// QueueImage queues one image reply per url.
+func (f *FakeClient) QueueImage(urls ...string) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range urls {
+		f.images.queue = append(f.images.queue, result[string]{val: u})
+	}
+	return f
+}
+
+// QueueImageError queues a failing image call.
+func (f *FakeClient) QueueImageError(err error) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images.queue = append(f.images.queue, result[string]{err: err})
+	return f
+}
+
+// SetResponse makes every unqueued responses-API call return resp.
+func (f *FakeClient) SetResponse(resp *xai.ResponsesResponse) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses.def = &result[*xai.ResponsesResponse]{val: resp}
+	return f
+}
+
+// QueueResponse queues a responses-API reply.
+func (f *FakeClient) QueueResponse(resp *xai.ResponsesResponse) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses.queue = append(f.responses.queue, result[*xai.ResponsesResponse]{val: resp})
+	return f
+}
+
+// QueueResponseError queues a failing responses-API call.
+func (f *FakeClient) QueueResponseError(err error) *FakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses.queue = append(f.responses.queue, result[*xai.ResponsesResponse]{err: err})
+	return f
+}
+
+func (f *FakeClient) CreateChatCompletion(ctx context.Context, req xai.ChatRequest) (*xai.ChatResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chatCalls = append(f.chatCalls, req)
+	return f.chat.next()
+}
+
+// streamChunkSize is how many runes each fake stream delta carries.
+const streamChunkSize = 8
+
+// StreamChatCompletion answers from the same chat replies as
+// CreateChatCompletion, sending the content in small deltas.
+func (f *FakeClient) StreamChatCompletion(ctx context.Context, req xai.ChatRequest) (<-chan xai.ChatDelta, error) {
+	resp, err := f.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var content []rune
+	if len(resp.Choices) > 0 {
+		content = []rune(resp.Choices[0].Message.Content)
+	}
+	out := make(chan xai.ChatDelta, len(content)/streamChunkSize+1)
+	for len(content) > 0 {
+		n := min(streamChunkSize, len(content))
+		out <- xai.ChatDelta{Content: string(content[:n])}
+		content = content[n:]
+	}
+	close(out)
+	return out, nil
+}
+
+func (f *FakeClient) GenerateImage(ctx context.Context, prompt string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.imageCalls = append(f.imageCalls, prompt)
+	return f.images.next()
+}
+
+func (f *FakeClient) GenerateResponse(ctx context.Context, req xai.ResponseRequest) (*xai.ResponsesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responseCalls = append(f.responseCalls, req)
+	return f.responses.next()
+}
+
+// ChatCalls returns a copy of the chat requests received so far.
+func (f *FakeClient) ChatCalls() []xai.ChatRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]xai.ChatRequest(nil), f.chatCalls...)
+}
+
+// ImageCalls returns a copy of the image prompts received so far.
+func (f *FakeClient) ImageCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.imageCalls...)
+}
+
+// ResponseCalls returns a copy of the responses-API requests received so far.
+func (f *FakeClient) ResponseCalls() []xai.ResponseRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]xai.ResponseRequest(nil), f.responseCalls...)
+}
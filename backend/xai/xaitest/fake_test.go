@@ -0,0 +1,75 @@
+package xaitest
+
+import (
+	"context"
+	"errors"
+	"glowmeet/xai"
+	"testing"
+)
+
+func TestFakeClient_ChatQueueThenDefault(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFakeClient().QueueChat("first", "second").SetChat("default")
+
+	for _, want := range []string{"first", "second", "default", "default"} {
+		resp, err := fake.CreateChatCompletion(ctx, xai.ChatRequest{Messages: []xai.Message{{Role: "user", Content: want}}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := resp.Choices[0].Message.Content; got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+
+	calls := fake.ChatCalls()
+	if len(calls) != 4 || calls[0].Messages[0].Content != "first" {
+		t.Errorf("expected 4 recorded calls, got %+v", calls)
+	}
+}
+
+func TestFakeClient_Errors(t *testing.T) {
+	ctx := context.Background()
+	boom := errors.New("boom")
+	fake := NewFakeClient().QueueChatError(boom).QueueChatError(RateLimitError())
+
+	if _, err := fake.CreateChatCompletion(ctx, xai.ChatRequest{}); !errors.Is(err, boom) {
+		t.Errorf("expected queued error, got %v", err)
+	}
+
+	_, err := fake.CreateChatCompletion(ctx, xai.ChatRequest{})
+	var apiErr *xai.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 429 {
+		t.Errorf("expected 429 APIError, got %v", err)
+	}
+
+	if _, err := fake.CreateChatCompletion(ctx, xai.ChatRequest{}); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("expected ErrNoResponse once the queue is drained, got %v", err)
+	}
+}
+
+func TestFakeClient_ImagesAndResponses(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFakeClient().QueueImage("https://img/1").SetImage("https://img/default")
+	fake.QueueResponse(&xai.ResponsesResponse{RawCitations: []string{"https://example.com"}})
+
+	if url, _ := fake.GenerateImage(ctx, "a cat"); url != "https://img/1" {
+		t.Errorf("expected queued image, got %q", url)
+	}
+	if url, _ := fake.GenerateImage(ctx, "a dog"); url != "https://img/default" {
+		t.Errorf("expected default image, got %q", url)
+	}
+	if prompts := fake.ImageCalls(); len(prompts) != 2 || prompts[1] != "a dog" {
+		t.Errorf("unexpected image prompts %v", prompts)
+	}
+
+	resp, err := fake.GenerateResponse(ctx, xai.ResponseRequest{Model: "m"})
+	if err != nil || len(resp.Citations()) != 1 {
+		t.Errorf("expected queued responses reply, got %+v, %v", resp, err)
+	}
+	if _, err := fake.GenerateResponse(ctx, xai.ResponseRequest{}); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("expected ErrNoResponse, got %v", err)
+	}
+	if calls := fake.ResponseCalls(); len(calls) != 2 || calls[0].Model != "m" {
+		t.Errorf("unexpected responses calls %+v", calls)
+	}
+}